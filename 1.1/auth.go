@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	ScopeDebit  = "pay:debit"
+	ScopeCredit = "pay:credit"
+	ScopeAdmin  = "admin"
+
+	APIKeyHeader = "X-API-Key"
+
+	// anonymousSubject is the principal of every request when auth is disabled.
+	anonymousSubject = "anonymous"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// Principal is an authenticated caller. It may only act on the balances of
+// the users in UserIDs, unless it has the admin scope.
+type Principal struct {
+	Subject string   `json:"subject"`
+	UserIDs []string `json:"userIDs"`
+	Scopes  []string `json:"scopes"`
+}
+
+// HasScope reports whether p was granted scope. Admin implies every scope.
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+func (p Principal) CanAccess(userID string) bool {
+	return p.HasScope(ScopeAdmin) || slices.Contains(p.UserIDs, userID)
+}
+
+// Claims are the JWT claims the service accepts: the registered claims, the
+// users the token may act for and a space-separated list of scopes.
+type Claims struct {
+	UserIDs []string `json:"user_ids,omitempty"`
+	Scope   string   `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Authenticator identifies callers by API key, by an HS256 JWT verified with
+// a shared secret, or by the subject of a verified TLS client certificate, so
+// no call to an identity provider is needed.
+type Authenticator struct {
+	// JWTSecret verifies bearer tokens. Empty disables JWT authentication.
+	JWTSecret []byte
+	// Issuer and Audience, when set, must match the token's iss and aud.
+	Issuer   string
+	Audience string
+	// Disabled lets every request through as an anonymous admin. Only for
+	// local development.
+	Disabled bool
+
+	// API keys are indexed by their SHA-256 so lookups don't compare raw secrets.
+	apiKeys map[[sha256.Size]byte]Principal
+	// Client certificates are indexed by their subject's distinguished name.
+	clientCerts map[string]Principal
+}
+
+func NewAuthenticator(jwtSecret []byte) *Authenticator {
+	return &Authenticator{
+		JWTSecret:   jwtSecret,
+		apiKeys:     make(map[[sha256.Size]byte]Principal),
+		clientCerts: make(map[string]Principal),
+	}
+}
+
+func (a *Authenticator) AddAPIKey(key string, p Principal) {
+	a.apiKeys[sha256.Sum256([]byte(key))] = p
+}
+
+// AddClientCert maps the subject of a verified client certificate, as
+// formatted by pkix.Name.String (e.g. "CN=shop-42,O=Acme"), to p.
+func (a *Authenticator) AddClientCert(certSubject string, p Principal) {
+	a.clientCerts[certSubject] = p
+}
+
+// LoadAPIKeys reads a JSON array of {"key", "subject", "userIDs", "scopes"}
+// objects. An entry may have a "certSubject" instead of a "key" to
+// authenticate a TLS client certificate.
+func (a *Authenticator) LoadAPIKeys(r io.Reader) error {
+	var entries []struct {
+		Key         string `json:"key"`
+		CertSubject string `json:"certSubject"`
+		Principal
+	}
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return fmt.Errorf("decode API keys: %w", err)
+	}
+	for i, e := range entries {
+		if (e.Key == "") == (e.CertSubject == "") || e.Subject == "" {
+			return fmt.Errorf("API key %d: subject and either key or certSubject are required", i)
+		}
+		if e.CertSubject != "" {
+			a.AddClientCert(e.CertSubject, e.Principal)
+			continue
+		}
+		a.AddAPIKey(e.Key, e.Principal)
+	}
+	return nil
+}
+
+// authenticate resolves the credentials of an HTTP or gRPC request. An API
+// key takes precedence over an Authorization header, and both over the
+// client certificate, which must already be verified by the TLS handshake.
+func (a *Authenticator) authenticate(apiKey, authorization string, cert *x509.Certificate) (Principal, error) {
+	if a.Disabled {
+		return Principal{Subject: anonymousSubject, Scopes: []string{ScopeAdmin}}, nil
+	}
+	if apiKey != "" {
+		p, ok := a.apiKeys[sha256.Sum256([]byte(apiKey))]
+		if !ok {
+			return Principal{}, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+		}
+		return p, nil
+	}
+
+	if authorization == "" && cert != nil {
+		p, ok := a.clientCerts[cert.Subject.String()]
+		if !ok {
+			return Principal{}, fmt.Errorf("%w: unknown client certificate %s", ErrUnauthenticated, cert.Subject)
+		}
+		return p, nil
+	}
+
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || token == "" {
+		return Principal{}, fmt.Errorf("%w: missing credentials", ErrUnauthenticated)
+	}
+	if len(a.JWTSecret) == 0 {
+		return Principal{}, fmt.Errorf("%w: bearer tokens are not accepted", ErrUnauthenticated)
+	}
+	return a.verifyToken(token)
+}
+
+func (a *Authenticator) verifyToken(token string) (Principal, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.Audience))
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return a.JWTSecret, nil
+	}, opts...)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	if claims.Subject == "" {
+		return Principal{}, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+	return Principal{
+		Subject: claims.Subject,
+		UserIDs: claims.UserIDs,
+		Scopes:  strings.Fields(claims.Scope),
+	}, nil
+}
+
+// Require authenticates the request before calling next with the caller's
+// Principal in the context. Unauthenticated requests get a 401.
+func (a *Authenticator) Require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.authenticateRequest(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="payment-service"`)
+			writeError(w, err)
+			return
+		}
+		next(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}
+}
+
+func (a *Authenticator) authenticateRequest(r *http.Request) (Principal, error) {
+	return a.authenticate(r.Header.Get(APIKeyHeader), r.Header.Get("Authorization"), verifiedClientCert(r.TLS))
+}
+
+// UnaryInterceptor is Require for gRPC. Credentials are read from the
+// "x-api-key" and "authorization" metadata, or the TLS client certificate.
+func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		first := func(key string) string {
+			if v := md.Get(key); len(v) > 0 {
+				return v[0]
+			}
+			return ""
+		}
+		var state *tls.ConnectionState
+		if pr, ok := peer.FromContext(ctx); ok {
+			if info, ok := pr.AuthInfo.(credentials.TLSInfo); ok {
+				state = &info.State
+			}
+		}
+		p, err := a.authenticate(first("x-api-key"), first("authorization"), verifiedClientCert(state))
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		return handler(withPrincipal(ctx, p), req)
+	}
+}
+
+// verifiedClientCert returns the leaf of the client's verified chain, or nil
+// when the client sent no certificate or it wasn't checked against a CA.
+func verifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// requireAdmin guards operator endpoints such as webhook management. It must
+// run after Authenticator.Require.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authorizeAdmin(r.Context()); err != nil {
+			writeError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// IssueToken signs an HS256 token for subject, e.g. for tests and tooling.
+func IssueToken(secret []byte, subject string, userIDs, scopes []string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		UserIDs: userIDs,
+		Scope:   strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// authorizePayment checks that the caller may move money for req.UserID in
+// req's direction: debits need pay:debit and credits (including refunds)
+// need pay:credit.
+func authorizePayment(ctx context.Context, req PaymentRequest) error {
+	if err := authorizeUser(ctx, req.UserID); err != nil {
+		return err
+	}
+	p, _ := PrincipalFrom(ctx)
+	scope := ScopeDebit
+	if req.Amount > 0 {
+		scope = ScopeCredit
+	}
+	if !p.HasScope(scope) {
+		return fmt.Errorf("%w: %s lacks scope %s", ErrForbidden, p.Subject, scope)
+	}
+	return nil
+}
+
+// authorizeUser checks that the caller may act on userID's account.
+func authorizeUser(ctx context.Context, userID string) error {
+	p, ok := PrincipalFrom(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !p.CanAccess(userID) {
+		return fmt.Errorf("%w: %s may not act for user %s", ErrForbidden, p.Subject, userID)
+	}
+	return nil
+}
+
+func authorizeAdmin(ctx context.Context) error {
+	p, ok := PrincipalFrom(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !p.HasScope(ScopeAdmin) {
+		return fmt.Errorf("%w: %s lacks scope %s", ErrForbidden, p.Subject, ScopeAdmin)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"1.1/paymentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testAdmin = Principal{Subject: "test-admin", Scopes: []string{ScopeAdmin}}
+
+// asAdmin runs h as if Authenticator.Require had admitted an admin.
+func asAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(withPrincipal(r.Context(), testAdmin)))
+	}
+}
+
+func adminInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	return handler(withPrincipal(ctx, testAdmin), req)
+}
+
+func newTestAuthenticator(t *testing.T) (*Authenticator, []byte) {
+	t.Helper()
+	secret := []byte("test-secret")
+	authn := NewAuthenticator(secret)
+	authn.AddAPIKey("key-alice", Principal{Subject: "alice", UserIDs: []string{"alice"}, Scopes: []string{ScopeDebit}})
+	return authn, secret
+}
+
+func postPayment(t *testing.T, h http.HandlerFunc, req PaymentRequest, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest(http.MethodPost, "/pay", bytes.NewBuffer(body))
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestAuthenticatedPayments(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "alice", 100)
+	service.SetBalance(context.Background(), "bob", 100)
+	authn, secret := newTestAuthenticator(t)
+	handler := authn.Require(service.HandlePayment)
+
+	bobToken, err := IssueToken(secret, "bob", []string{"bob"}, []string{ScopeDebit, ScopeCredit}, time.Minute)
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+	expired, _ := IssueToken(secret, "bob", []string{"bob"}, []string{ScopeDebit}, -time.Minute)
+	forged, _ := IssueToken([]byte("other-secret"), "bob", []string{"bob"}, []string{ScopeDebit}, time.Minute)
+
+	tests := []struct {
+		name    string
+		req     PaymentRequest
+		headers map[string]string
+		want    int
+	}{
+		{"No credentials", PaymentRequest{UserID: "alice", Amount: -10, TransactionID: "txn-001"}, nil, http.StatusUnauthorized},
+		{"Unknown API key", PaymentRequest{UserID: "alice", Amount: -10, TransactionID: "txn-002"}, map[string]string{APIKeyHeader: "nope"}, http.StatusUnauthorized},
+		{"API key debit", PaymentRequest{UserID: "alice", Amount: -10, TransactionID: "txn-003"}, map[string]string{APIKeyHeader: "key-alice"}, http.StatusOK},
+		{"API key missing credit scope", PaymentRequest{UserID: "alice", Amount: 10, TransactionID: "txn-004"}, map[string]string{APIKeyHeader: "key-alice"}, http.StatusForbidden},
+		{"API key other user", PaymentRequest{UserID: "bob", Amount: -10, TransactionID: "txn-005"}, map[string]string{APIKeyHeader: "key-alice"}, http.StatusForbidden},
+		{"JWT credit", PaymentRequest{UserID: "bob", Amount: 10, TransactionID: "txn-006"}, map[string]string{"Authorization": "Bearer " + bobToken}, http.StatusOK},
+		{"JWT other user", PaymentRequest{UserID: "alice", Amount: -10, TransactionID: "txn-007"}, map[string]string{"Authorization": "Bearer " + bobToken}, http.StatusForbidden},
+		{"Expired JWT", PaymentRequest{UserID: "bob", Amount: -10, TransactionID: "txn-008"}, map[string]string{"Authorization": "Bearer " + expired}, http.StatusUnauthorized},
+		{"Forged JWT", PaymentRequest{UserID: "bob", Amount: -10, TransactionID: "txn-009"}, map[string]string{"Authorization": "Bearer " + forged}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postPayment(t, handler, tt.req, tt.headers)
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			codes := map[int]string{http.StatusUnauthorized: "unauthenticated", http.StatusForbidden: "forbidden"}
+			if code, ok := codes[tt.want]; ok && w.Header().Get(ErrorCodeHeader) != code {
+				t.Errorf("Expected error code %q, got %q", code, w.Header().Get(ErrorCodeHeader))
+			}
+		})
+	}
+
+	if _, err := service.GetTransaction(context.Background(), "txn-005"); err == nil {
+		t.Error("A forbidden payment must not be processed")
+	}
+}
+
+func TestRejectsUnsignedToken(t *testing.T) {
+	authn, _ := newTestAuthenticator(t)
+	// {"alg":"none"} with a valid-looking payload
+	token := "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJzdWIiOiJib2IiLCJzY29wZSI6ImFkbWluIiwiZXhwIjo0MTAyNDQ0ODAwfQ."
+	if _, err := authn.authenticate("", "Bearer "+token, nil); err == nil {
+		t.Error("Expected alg=none token to be rejected")
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	authn, _ := newTestAuthenticator(t)
+	handler := authn.Require(requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+	r.Header.Set(APIKeyHeader, "key-alice")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", w.Code)
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	authn := NewAuthenticator(nil)
+	err := authn.LoadAPIKeys(strings.NewReader(`[{"key": "k1", "subject": "ops", "scopes": ["admin"]}]`))
+	if err != nil {
+		t.Fatalf("LoadAPIKeys failed: %v", err)
+	}
+	p, err := authn.authenticate("k1", "", nil)
+	if err != nil || p.Subject != "ops" || !p.CanAccess("anyone") {
+		t.Errorf("Unexpected principal %+v, err %v", p, err)
+	}
+
+	if err := authn.LoadAPIKeys(strings.NewReader(`[{"key": "k2"}]`)); err == nil {
+		t.Error("Expected error for an API key without subject")
+	}
+	if err := authn.LoadAPIKeys(strings.NewReader(`[{"key": "k3", "certSubject": "CN=ops", "subject": "ops"}]`)); err == nil {
+		t.Error("Expected error for an entry with both a key and a certSubject")
+	}
+	if err := authn.LoadAPIKeys(strings.NewReader(`[{"certSubject": "CN=shop-42,O=Acme", "subject": "shop-42"}]`)); err != nil {
+		t.Fatalf("LoadAPIKeys failed: %v", err)
+	}
+	if _, ok := authn.clientCerts["CN=shop-42,O=Acme"]; !ok {
+		t.Error("Expected the client certificate subject to be registered")
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "alice", 100)
+	authn, _ := newTestAuthenticator(t)
+	authn.AddClientCert("CN=alice-shop,O=Acme", Principal{Subject: "alice-shop", UserIDs: []string{"alice"}, Scopes: []string{ScopeDebit}})
+	handler := authn.Require(service.HandlePayment)
+
+	cert := func(cn string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn, Organization: []string{"Acme"}}}
+	}
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  int
+	}{
+		{"Known certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert("alice-shop")}}}, http.StatusOK},
+		{"Unknown certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert("mallory")}}}, http.StatusUnauthorized},
+		{"Unverified certificate", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert("alice-shop")}}, http.StatusUnauthorized},
+		{"No certificate", &tls.ConnectionState{}, http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(PaymentRequest{UserID: "alice", Amount: -1, TransactionID: fmt.Sprintf("txn-%d", i)})
+			r := httptest.NewRequest(http.MethodPost, "/pay", bytes.NewReader(body))
+			r.TLS = tt.state
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "alice", 100)
+	authn, _ := newTestAuthenticator(t)
+
+	client := newGRPCClientWithServer(t, NewGRPCServer(service, grpc.UnaryInterceptor(authn.UnaryInterceptor())))
+
+	_, err := client.GetBalance(context.Background(), &paymentpb.GetBalanceRequest{UserId: "alice"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated, got %v", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-alice")
+	if _, err := client.GetBalance(ctx, &paymentpb.GetBalanceRequest{UserId: "alice"}); err != nil {
+		t.Errorf("GetBalance failed: %v", err)
+	}
+	_, err = client.GetBalance(ctx, &paymentpb.GetBalanceRequest{UserId: "bob"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// checkpointInterval is how many of a user's transactions are recorded
+// between two balance checkpoints, which bounds how many BalanceAt sums up.
+const checkpointInterval = 100
+
+// balanceCheckpoint is a user's balance as of At, after the first Index
+// transactions of their history.
+type balanceCheckpoint struct {
+	At      time.Time `json:"at"`
+	Index   int       `json:"index"`
+	Balance float64   `json:"balance"`
+}
+
+// checkpoint records the user's balance after their latest transaction.
+// Must be called with s.mu held.
+func (s *PaymentService) checkpoint(userID string, at time.Time, balance float64) {
+	s.checkpoints[userID] = append(s.checkpoints[userID], balanceCheckpoint{At: at, Index: len(s.history[userID]), Balance: balance})
+}
+
+// maybeCheckpoint records a checkpoint once checkpointInterval transactions
+// have been recorded since the user's last one. Must be called with s.mu held.
+func (s *PaymentService) maybeCheckpoint(userID string, at time.Time, balance float64) {
+	last := 0
+	if cps := s.checkpoints[userID]; len(cps) > 0 {
+		last = cps[len(cps)-1].Index
+	}
+	if len(s.history[userID])-last >= checkpointInterval {
+		s.checkpoint(userID, at, balance)
+	}
+}
+
+// BalanceAt returns the user's balance as of at: the balance after every
+// transaction processed at or before it. It starts from the latest checkpoint
+// not after at, so it sums at most checkpointInterval transactions. SetBalance
+// counts as of the moment it was called.
+func (s *PaymentService) BalanceAt(ctx context.Context, userID string, at time.Time) (float64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.RUnlock()
+	balance, _ := s.balanceAt(userID, at)
+	return balance, nil
+}
+
+// balanceAt returns the user's balance as of at and the index in their
+// history of the first transaction after at. Must be called with s.mu held.
+func (s *PaymentService) balanceAt(userID string, at time.Time) (balance float64, next int) {
+	cps := s.checkpoints[userID]
+	if i := sort.Search(len(cps), func(i int) bool { return cps[i].At.After(at) }); i > 0 {
+		balance, next = cps[i-1].Balance, cps[i-1].Index
+	}
+	history := s.history[userID]
+	for ; next < len(history) && !history[next].ProcessedAt.After(at); next++ {
+		balance += history[next].Amount
+	}
+	return balance, next
+}
+
+// rebuildCheckpoints derives checkpoints from the transaction history alone,
+// for snapshots that don't carry them. Where a user's balance doesn't match
+// their transactions, a checkpoint dated at records the difference.
+func rebuildCheckpoints(history map[string][]*Transaction, balances map[string]float64, at time.Time) map[string][]balanceCheckpoint {
+	checkpoints := make(map[string][]balanceCheckpoint)
+	for userID, txns := range history {
+		var balance float64
+		for i, txn := range txns {
+			balance += txn.Amount
+			if (i+1)%checkpointInterval == 0 {
+				checkpoints[userID] = append(checkpoints[userID], balanceCheckpoint{At: txn.ProcessedAt, Index: i + 1, Balance: balance})
+			}
+		}
+		if balances[userID] != balance {
+			checkpoints[userID] = append(checkpoints[userID], balanceCheckpoint{At: at, Index: len(txns), Balance: balances[userID]})
+		}
+	}
+	for userID, balance := range balances {
+		if _, ok := history[userID]; !ok && balance != 0 {
+			checkpoints[userID] = []balanceCheckpoint{{At: at, Balance: balance}}
+		}
+	}
+	return checkpoints
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+var clockStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newClockedService() (*PaymentService, *fakeClock) {
+	clock := &fakeClock{t: clockStart}
+	service := NewPaymentService()
+	service.now = clock.now
+	return service, clock
+}
+
+// newHistoryService records 250 credits of 1 for alice, one per minute
+// from clockStart, then sets her balance to 1000 at minute 300 and credits 1
+// at minute 301.
+func newHistoryService(t *testing.T) *PaymentService {
+	t.Helper()
+	service, clock := newClockedService()
+	ctx := context.Background()
+	for i := 0; i < 250; i++ {
+		if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1, TransactionID: fmt.Sprintf("txn-%d", i)}); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+		clock.advance(time.Minute)
+	}
+	clock.t = clockStart.Add(300 * time.Minute)
+	service.SetBalance(ctx, "alice", 1000)
+	clock.advance(time.Minute)
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1, TransactionID: "txn-last"})
+	return service
+}
+
+func assertBalancesAt(t *testing.T, service *PaymentService) {
+	t.Helper()
+	tests := []struct {
+		at   time.Duration
+		want float64
+	}{
+		{-time.Second, 0},
+		{0, 1},
+		{99 * time.Minute, 100},
+		{99*time.Minute + 30*time.Second, 100},
+		{100 * time.Minute, 101},
+		{249 * time.Minute, 250},
+		{299 * time.Minute, 250},
+		{300 * time.Minute, 1000},
+		{301 * time.Minute, 1001},
+		{1000 * time.Hour, 1001},
+	}
+	for _, tt := range tests {
+		balance, err := service.BalanceAt(context.Background(), "alice", clockStart.Add(tt.at))
+		if err != nil {
+			t.Fatalf("BalanceAt failed: %v", err)
+		}
+		if balance != tt.want {
+			t.Errorf("Expected balance %.2f at +%v, got %.2f", tt.want, tt.at, balance)
+		}
+	}
+}
+
+func TestBalanceAt(t *testing.T) {
+	service := newHistoryService(t)
+	assertBalancesAt(t, service)
+
+	// Two periodic checkpoints and the one recorded by SetBalance.
+	if cps := service.checkpoints["alice"]; len(cps) != 3 || cps[0].Index != 100 || cps[1].Index != 200 || cps[2].Balance != 1000 {
+		t.Errorf("Unexpected checkpoints %+v", cps)
+	}
+	if balance, _ := service.BalanceAt(context.Background(), "nobody", clockStart); balance != 0 {
+		t.Errorf("Expected 0 for an unknown user, got %.2f", balance)
+	}
+}
+
+func TestBalanceAtSurvivesSnapshots(t *testing.T) {
+	service := newHistoryService(t)
+	ctx := context.Background()
+	var buf bytes.Buffer
+	if _, err := service.WriteSnapshot(ctx, &buf); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	snapshot := buf.String()
+
+	restored := NewPaymentService()
+	if _, err := restored.RestoreSnapshot(ctx, strings.NewReader(snapshot)); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	assertBalancesAt(t, restored)
+
+	// A version 1 snapshot has no checkpoints. The periodic ones are rebuilt
+	// and the SetBalance adjustment is dated at the snapshot.
+	var v1 []string
+	for _, line := range strings.Split(strings.TrimSpace(snapshot), "\n") {
+		switch {
+		case strings.HasPrefix(line, `{"format"`):
+			line = strings.Replace(line, `"version":2`, `"version":1`, 1)
+			line = strings.Replace(line, `,"checkpoints":3`, ``, 1)
+		case strings.HasPrefix(line, `{"checkpoint"`), strings.HasPrefix(line, `{"sha256"`):
+			continue
+		}
+		v1 = append(v1, line+"\n")
+	}
+	sum := sha256.Sum256([]byte(strings.Join(v1, "")))
+	v1 = append(v1, fmt.Sprintf(`{"sha256":%q}`+"\n", hex.EncodeToString(sum[:])))
+
+	restored = NewPaymentService()
+	info, err := restored.RestoreSnapshot(ctx, strings.NewReader(strings.Join(v1, "")))
+	if err != nil {
+		t.Fatalf("RestoreSnapshot of a version 1 snapshot failed: %v", err)
+	}
+	if info.Version != 1 {
+		t.Errorf("Expected version 1, got %d", info.Version)
+	}
+	for at, want := range map[time.Duration]float64{99 * time.Minute: 100, 300 * time.Minute: 250} {
+		if balance, _ := restored.BalanceAt(ctx, "alice", clockStart.Add(at)); balance != want {
+			t.Errorf("Expected balance %.2f at +%v, got %.2f", want, at, balance)
+		}
+	}
+	if balance, _ := restored.BalanceAt(ctx, "alice", info.TakenAt); balance != 1001 {
+		t.Errorf("Expected the balance at the snapshot to be 1001, got %.2f", balance)
+	}
+}
+
+func TestHandleGetBalanceAsOf(t *testing.T) {
+	service := newHistoryService(t)
+	handler := asAdmin(service.HandleGetBalance)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/{id}/balance", handler)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/alice/balance?asOf=2024-01-01T01:39:59Z", nil))
+	var resp BalanceResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response %d, %v", w.Code, err)
+	}
+	if resp.Balance != 100 || resp.AsOf == nil || !resp.AsOf.Equal(clockStart.Add(99*time.Minute+59*time.Second)) {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/alice/balance?asOf=last-month", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid asOf, got %d", w.Code)
+	}
+}
@@ -0,0 +1,308 @@
+// Package client is the Go SDK of the payment service's HTTP API.
+//
+// Payments are retried with exponential backoff when the service is
+// unavailable, times out or rate limits the caller. Every attempt carries the
+// same transactionID, so the service applies a payment at most once however
+// many attempts reach it.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PaymentRequest struct {
+	UserID string  `json:"userID"`
+	Amount float64 `json:"amount"`
+	// TransactionID makes the payment idempotent. Pay generates one when it
+	// is empty.
+	TransactionID string `json:"transactionID"`
+	RefundOf      string `json:"refundOf,omitempty"`
+	// Currency is the currency of Amount when it isn't the ledger currency.
+	// QuoteID books the payment at the rate of a quote from Client.Quote;
+	// Amount and Currency must then be the quote's.
+	Currency string `json:"currency,omitempty"`
+	QuoteID  string `json:"quoteID,omitempty"`
+}
+
+type PaymentResponse struct {
+	TraceID       string    `json:"traceID"`
+	TransactionID string    `json:"transactionID"`
+	UserID        string    `json:"userID"`
+	Amount        float64   `json:"amount"`
+	Status        string    `json:"status"`
+	Message       string    `json:"message"`
+	ProcessedAt   time.Time `json:"processedAt"`
+	// Fee is charged on top of Amount, nil if the payment is free.
+	Fee *Fee `json:"fee,omitempty"`
+	// Conversion is set when the payment was made in another currency;
+	// Amount is then in the ledger currency.
+	Conversion *Conversion `json:"conversion,omitempty"`
+}
+
+// Conversion is the amount a payment was made in and the rate it was
+// converted to the ledger currency at.
+type Conversion struct {
+	Currency string  `json:"currency"`
+	Amount   float64 `json:"amount"`
+	Rate     float64 `json:"rate"`
+	QuoteID  string  `json:"quoteID,omitempty"`
+}
+
+// Quote holds the rate of a conversion to the ledger currency until
+// ExpiresAt. It can pay for one payment.
+type Quote struct {
+	QuoteID   string    `json:"quoteID"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      float64   `json:"rate"`
+	Amount    float64   `json:"amount"`
+	Converted float64   `json:"converted"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Fee itemizes the fee charged on a payment. TransactionID is the fee's own
+// ledger entry.
+type Fee struct {
+	Tier          string  `json:"tier"`
+	Flat          float64 `json:"flat"`
+	Percentage    float64 `json:"percentage"`
+	Band          float64 `json:"band"`
+	Adjustment    float64 `json:"adjustment"`
+	Total         float64 `json:"total"`
+	TransactionID string  `json:"transactionID"`
+}
+
+type Transaction struct {
+	TransactionID string    `json:"transactionID"`
+	UserID        string    `json:"userID"`
+	Amount        float64   `json:"amount"`
+	Status        string    `json:"status"`
+	RefundOf      string    `json:"refundOf,omitempty"`
+	ProcessedAt   time.Time `json:"processedAt"`
+	// FeeOf is set on fee entries to the payment they were charged on.
+	FeeOf      string      `json:"feeOf,omitempty"`
+	Fee        *Fee        `json:"fee,omitempty"`
+	Conversion *Conversion `json:"conversion,omitempty"`
+	// InterestFor is set on interest entries to the month (2006-01) they pay for.
+	InterestFor string `json:"interestFor,omitempty"`
+}
+
+// Client calls one payment service. Its fields may be changed before the
+// first call.
+type Client struct {
+	BaseURL string
+	// APIKey is sent as X-API-Key. Token, if set instead, is sent as a
+	// bearer token. Other schemes, such as request signing, can be plugged
+	// in through HTTPClient's Transport.
+	APIKey     string
+	Token      string
+	HTTPClient *http.Client
+
+	// MaxRetries is how many times a failed payment is retried.
+	MaxRetries int
+	// MinBackoff is the delay before the first retry; it doubles on every
+	// retry up to MaxBackoff. A Retry-After from the service takes precedence.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: http.DefaultClient,
+		MaxRetries: 3,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 2 * time.Second,
+	}
+}
+
+// Pay processes a payment, retrying transient failures. When req has no
+// TransactionID, the generated one is in the response.
+func (c *Client) Pay(ctx context.Context, req PaymentRequest) (*PaymentResponse, error) {
+	if req.TransactionID == "" {
+		req.TransactionID = newTransactionID()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp PaymentResponse
+	for attempt := 0; ; attempt++ {
+		err = c.do(ctx, http.MethodPost, "/pay", body, &resp)
+		if err == nil {
+			return &resp, nil
+		}
+		if attempt >= c.MaxRetries || !retryable(err) {
+			return nil, err
+		}
+		if err := sleep(ctx, c.backoff(attempt, err)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Quote prices amount of currency in the ledger currency. Pay with the
+// quote's QuoteID before it expires to be booked at its rate.
+func (c *Client) Quote(ctx context.Context, currency string, amount float64) (*Quote, error) {
+	body, err := json.Marshal(map[string]any{"currency": currency, "amount": amount})
+	if err != nil {
+		return nil, err
+	}
+	var q Quote
+	if err := c.do(ctx, http.MethodPost, "/quotes", body, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// Balance returns the user's current balance.
+func (c *Client) Balance(ctx context.Context, userID string) (float64, error) {
+	var resp struct {
+		Balance float64 `json:"balance"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(userID)+"/balance", nil, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Balance, nil
+}
+
+// BalanceAt returns the user's balance as of at, after every transaction
+// processed at or before it.
+func (c *Client) BalanceAt(ctx context.Context, userID string, at time.Time) (float64, error) {
+	var resp struct {
+		Balance float64 `json:"balance"`
+	}
+	path := "/users/" + url.PathEscape(userID) + "/balance?asOf=" + url.QueryEscape(at.UTC().Format(time.RFC3339))
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Balance, nil
+}
+
+// Transaction looks up a transaction. Unknown IDs return an error matching
+// ErrNotFound.
+func (c *Client) Transaction(ctx context.Context, transactionID string) (*Transaction, error) {
+	var txn Transaction
+	if err := c.do(ctx, http.MethodGet, "/transactions/"+url.PathEscape(transactionID), nil, &txn); err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// Transactions returns the user's successful transactions, oldest first.
+func (c *Client) Transactions(ctx context.Context, userID string) ([]Transaction, error) {
+	var resp struct {
+		Transactions []Transaction `json:"transactions"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(userID)+"/transactions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Transactions, nil
+}
+
+// do sends one request and decodes a successful response into out. Failed
+// responses become an *Error.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out any) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// retryable reports whether a failed attempt may succeed if repeated: the
+// caller was rate limited or the service was unavailable or out of time.
+// Transport errors are retried too: the payment may or may not have been
+// applied, and the transactionID makes finding out safe.
+func retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// backoff returns the delay before retry number attempt+1: the service's
+// Retry-After if it sent one, otherwise exponential backoff with jitter so
+// clients failing together don't retry together.
+func (c *Client) backoff(attempt int, err error) time.Duration {
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+	d := time.Duration(float64(c.MinBackoff) * math.Pow(2, float64(attempt)))
+	if d > c.MaxBackoff || d <= 0 {
+		d = c.MaxBackoff
+	}
+	return d/2 + mathrand.N(d/2+1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func newTransactionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "txn-" + hex.EncodeToString(b)
+}
+
+func parseRetryAfter(v string) time.Duration {
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
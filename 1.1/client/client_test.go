@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	c := New(srv.URL, "test-key")
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 5 * time.Millisecond
+	return c
+}
+
+func TestPayRetriesWithSameTransactionID(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req PaymentRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		seen = append(seen, req.TransactionID)
+		attempt := len(seen)
+		mu.Unlock()
+
+		if r.Header.Get("X-API-Key") != "test-key" {
+			t.Errorf("Expected the API key to be sent, got %q", r.Header.Get("X-API-Key"))
+		}
+		switch attempt {
+		case 1:
+			http.Error(w, "lock busy", http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("X-Error-Code", "deadline_exceeded")
+			http.Error(w, "too slow", http.StatusGatewayTimeout)
+		default:
+			json.NewEncoder(w).Encode(PaymentResponse{TransactionID: req.TransactionID, Status: "success"})
+		}
+	})
+
+	resp, err := c.Pay(context.Background(), PaymentRequest{UserID: "user123", Amount: -10})
+	if err != nil {
+		t.Fatalf("Pay failed: %v", err)
+	}
+	if len(seen) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(seen))
+	}
+	if seen[0] == "" || seen[0] != seen[1] || seen[1] != seen[2] {
+		t.Errorf("Every attempt should reuse one generated transactionID, got %v", seen)
+	}
+	if resp.TransactionID != seen[0] {
+		t.Errorf("Expected the response to carry transactionID %s, got %s", seen[0], resp.TransactionID)
+	}
+}
+
+func TestPayTypedErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		code   string
+		want   error
+	}{
+		{"Insufficient funds", http.StatusBadRequest, "insufficient_funds", ErrInsufficientFunds},
+		{"Invalid request", http.StatusBadRequest, "invalid_request", ErrInvalidRequest},
+		{"Status without code", http.StatusForbidden, "", ErrForbidden},
+		{"Unauthenticated", http.StatusUnauthorized, "unauthenticated", ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if tt.code != "" {
+					w.Header().Set("X-Error-Code", tt.code)
+				}
+				http.Error(w, "nope", tt.status)
+			})
+
+			_, err := c.Pay(context.Background(), PaymentRequest{UserID: "user123", Amount: -10, TransactionID: "txn-001"})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status || apiErr.Message != "nope" {
+				t.Errorf("Expected an *Error with status %d and the message, got %#v", tt.status, err)
+			}
+			if attempts != 1 {
+				t.Errorf("Client errors should not be retried, got %d attempts", attempts)
+			}
+		})
+	}
+}
+
+func TestPayGivesUpAfterMaxRetries(t *testing.T) {
+	attempts := 0
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	})
+	c.MaxRetries = 2
+
+	_, err := c.Pay(context.Background(), PaymentRequest{UserID: "user123", Amount: -10})
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestPayStopsWhenContextDone(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Pay(ctx, PaymentRequest{UserID: "user123", Amount: -10})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Pay should stop waiting for Retry-After once the context is done")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := New("http://localhost", "")
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{5, 2 * time.Second},
+		{100, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		d := c.backoff(tt.attempt, errors.New("connection reset"))
+		if d < tt.max/2 || d > tt.max {
+			t.Errorf("Attempt %d: expected a backoff between %v and %v, got %v", tt.attempt, tt.max/2, tt.max, d)
+		}
+	}
+	if d := c.backoff(0, &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second}); d != 3*time.Second {
+		t.Errorf("Expected Retry-After to be honoured, got %v", d)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	processedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}/balance", func(w http.ResponseWriter, r *http.Request) {
+		balance := 42.5
+		if r.URL.Query().Get("asOf") == "2024-01-31T23:59:59Z" {
+			balance = 12
+		}
+		json.NewEncoder(w).Encode(map[string]any{"userID": r.PathValue("id"), "balance": balance})
+	})
+	mux.HandleFunc("GET /users/{id}/transactions", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"transactions": []Transaction{{TransactionID: "txn-001", UserID: r.PathValue("id"), Amount: -10, ProcessedAt: processedAt}}})
+	})
+	mux.HandleFunc("GET /transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Error-Code", "not_found")
+		http.Error(w, "transaction not found", http.StatusNotFound)
+	})
+	c := newTestClient(t, mux.ServeHTTP)
+
+	balance, err := c.Balance(context.Background(), "user 123")
+	if err != nil || balance != 42.5 {
+		t.Errorf("Expected balance 42.5, got %v, %v", balance, err)
+	}
+	endOfMonth := time.Date(2024, 2, 1, 0, 59, 59, 0, time.FixedZone("CET", 3600))
+	if balance, err := c.BalanceAt(context.Background(), "user123", endOfMonth); err != nil || balance != 12 {
+		t.Errorf("Expected balance 12 as of %v, got %v, %v", endOfMonth, balance, err)
+	}
+	txns, err := c.Transactions(context.Background(), "user123")
+	if err != nil || len(txns) != 1 || !txns[0].ProcessedAt.Equal(processedAt) {
+		t.Errorf("Unexpected transactions %+v, %v", txns, err)
+	}
+	if _, err := c.Transaction(context.Background(), "txn-404"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Currency string  `json:"currency"`
+			Amount   float64 `json:"amount"`
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/quotes" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if req.Currency == "CHF" {
+			w.Header().Set("X-Error-Code", "invalid_request")
+			http.Error(w, "no exchange rate: CHF/EUR", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(Quote{QuoteID: "quote-1", From: req.Currency, To: "EUR", Rate: 0.92, Amount: req.Amount, Converted: req.Amount * 0.92})
+	})
+
+	q, err := c.Quote(context.Background(), "USD", 50)
+	if err != nil || q.QuoteID != "quote-1" || q.Converted != 46 {
+		t.Errorf("Unexpected quote %+v, %v", q, err)
+	}
+	if _, err := c.Quote(context.Background(), "CHF", 50); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors returned by the service. Match them with errors.Is; the full
+// response is in the *Error.
+var (
+	ErrInvalidRequest    = &Error{Code: "invalid_request"}
+	ErrInsufficientFunds = &Error{Code: "insufficient_funds"}
+	ErrNotFound          = &Error{Code: "not_found"}
+	ErrUnauthenticated   = &Error{Code: "unauthenticated"}
+	ErrForbidden         = &Error{Code: "forbidden"}
+	ErrRateLimited       = &Error{Code: "rate_limited"}
+	ErrDeadlineExceeded  = &Error{Code: "deadline_exceeded"}
+	ErrCanceled          = &Error{Code: "canceled"}
+	ErrUnavailable       = &Error{Code: "unavailable"}
+	ErrQuoteNotFound     = &Error{Code: "quote_not_found"}
+	ErrQuoteExpired      = &Error{Code: "quote_expired"}
+)
+
+// Error is a failed response. Code is the service's X-Error-Code, or derived
+// from the status code for responses without one.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// RetryAfter is the delay the service asked for, if any.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("payment service: %s (%d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("payment service: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// Is matches errors by Code, so errors.Is(err, ErrInsufficientFunds) works
+// whatever the message.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+func newError(resp *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	code := resp.Header.Get("X-Error-Code")
+	if code == "" {
+		code = codeForStatus(resp.StatusCode)
+	}
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Code:       code,
+		Message:    strings.TrimSpace(string(body)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrUnauthenticated.Code
+	case http.StatusForbidden:
+		return ErrForbidden.Code
+	case http.StatusNotFound:
+		return ErrNotFound.Code
+	case http.StatusTooManyRequests:
+		return ErrRateLimited.Code
+	case http.StatusGatewayTimeout:
+		return ErrDeadlineExceeded.Code
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return ErrUnavailable.Code
+	case http.StatusBadRequest:
+		return ErrInvalidRequest.Code
+	default:
+		return fmt.Sprintf("http_%d", status)
+	}
+}
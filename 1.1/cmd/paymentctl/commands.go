@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"1.1/client"
+)
+
+// newFlagSet returns a FlagSet whose parse errors become usage errors.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	return nil
+}
+
+func runPay(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("pay")
+	var req client.PaymentRequest
+	fs.StringVar(&req.UserID, "user", "", "user ID")
+	fs.Float64Var(&req.Amount, "amount", 0, "amount; negative debits, positive credits")
+	fs.StringVar(&req.TransactionID, "txn", "", "transaction ID; generated when empty")
+	fs.StringVar(&req.RefundOf, "refund-of", "", "transaction ID this payment refunds")
+	fs.StringVar(&req.Currency, "currency", "", "currency of -amount when it isn't the ledger currency")
+	fs.StringVar(&req.QuoteID, "quote", "", "quote ID to book the payment at the quoted rate")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if req.UserID == "" || req.Amount == 0 {
+		return usageError{"-user and a non-zero -amount are required"}
+	}
+
+	resp, err := a.client.Pay(ctx, req)
+	if err != nil {
+		return err
+	}
+	return a.print(resp, table{
+		header: []string{"TRANSACTION", "USER", "AMOUNT", "STATUS", "PROCESSED_AT"},
+		rows:   [][]string{{resp.TransactionID, resp.UserID, formatAmount(resp.Amount), resp.Status, formatTime(resp.ProcessedAt)}},
+	})
+}
+
+// runBalance prints current balances, or with -as-of the balances as of an
+// RFC 3339 time.
+func runBalance(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("balance")
+	asOf := fs.String("as-of", "", "balance as of this RFC 3339 time instead of now")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError{"at least one user is required"}
+	}
+	var at time.Time
+	if *asOf != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, *asOf); err != nil {
+			return usageError{fmt.Sprintf("invalid time %q: %v", *asOf, err)}
+		}
+	}
+	type balance struct {
+		UserID  string  `json:"userID"`
+		Balance float64 `json:"balance"`
+	}
+	var balances []balance
+	t := table{header: []string{"USER", "BALANCE"}}
+	for _, userID := range fs.Args() {
+		var b float64
+		var err error
+		if at.IsZero() {
+			b, err = a.client.Balance(ctx, userID)
+		} else {
+			b, err = a.client.BalanceAt(ctx, userID, at)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", userID, err)
+		}
+		balances = append(balances, balance{userID, b})
+		t.rows = append(t.rows, []string{userID, formatAmount(b)})
+	}
+	return a.print(balances, t)
+}
+
+func runTransaction(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return usageError{"exactly one transaction ID is required"}
+	}
+	txn, err := a.client.Transaction(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return a.print(txn, transactionTable([]client.Transaction{*txn}))
+}
+
+func runHistory(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return usageError{"exactly one user is required"}
+	}
+	txns, err := a.client.Transactions(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return a.print(txns, transactionTable(txns))
+}
+
+// runExport writes the ledgers of several users as one list, optionally
+// restricted to transactions processed in [-from, -to).
+func runExport(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("export")
+	from := fs.String("from", "", "only transactions processed at or after this RFC 3339 time")
+	to := fs.String("to", "", "only transactions processed before this RFC 3339 time")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError{"at least one user is required"}
+	}
+	var fromTime, toTime time.Time
+	for _, bound := range []struct {
+		value string
+		dst   *time.Time
+	}{{*from, &fromTime}, {*to, &toTime}} {
+		if bound.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return usageError{fmt.Sprintf("invalid time %q: %v", bound.value, err)}
+		}
+		*bound.dst = parsed
+	}
+
+	txns := []client.Transaction{}
+	for _, userID := range fs.Args() {
+		userTxns, err := a.client.Transactions(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", userID, err)
+		}
+		for _, txn := range userTxns {
+			if (!fromTime.IsZero() && txn.ProcessedAt.Before(fromTime)) || (!toTime.IsZero() && !txn.ProcessedAt.Before(toTime)) {
+				continue
+			}
+			txns = append(txns, txn)
+		}
+	}
+	return a.print(txns, transactionTable(txns))
+}
+
+// importResult is the outcome of one row of an import.
+type importResult struct {
+	Row           int     `json:"row"`
+	TransactionID string  `json:"transactionID"`
+	UserID        string  `json:"userID"`
+	Amount        float64 `json:"amount"`
+	Result        string  `json:"result"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// importFailed reports that some rows of an import failed. The exit code is
+// the one of the first failing row.
+type importFailed struct {
+	failed, total int
+	code          int
+}
+
+func (e *importFailed) Error() string {
+	return fmt.Sprintf("%d of %d payments failed", e.failed, e.total)
+}
+
+// runImport posts every row of a CSV file with a header of userID, amount,
+// transactionID and optionally refundOf, currency and quoteID. Rows must
+// have a transactionID so a re-run after a partial failure skips the
+// payments already applied. With -dry-run the file is only validated. Each
+// payment gets the whole -timeout, so a large file isn't cut off halfway.
+func runImport(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("import")
+	dryRun := fs.Bool("dry-run", false, "validate the file without posting payments")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError{"exactly one file is required"}
+	}
+
+	in := a.stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	reqs, err := readImport(in)
+	if err != nil {
+		return fmt.Errorf("%w: %v", client.ErrInvalidRequest, err)
+	}
+
+	results := []importResult{}
+	t := table{header: []string{"ROW", "TRANSACTION", "USER", "AMOUNT", "RESULT", "ERROR"}}
+	failure := &importFailed{total: len(reqs)}
+	for i, req := range reqs {
+		res := importResult{Row: i + 2, TransactionID: req.TransactionID, UserID: req.UserID, Amount: req.Amount, Result: "valid"}
+		if !*dryRun {
+			res.Result = "posted"
+			payCtx, cancel := context.WithTimeout(ctx, a.timeout)
+			_, err := a.client.Pay(payCtx, req)
+			cancel()
+			if err != nil {
+				res.Result, res.Error = "failed", err.Error()
+				if failure.failed == 0 {
+					failure.code = exitCode(err)
+				}
+				failure.failed++
+			}
+		}
+		results = append(results, res)
+		t.rows = append(t.rows, []string{strconv.Itoa(res.Row), res.TransactionID, res.UserID, formatAmount(res.Amount), res.Result, res.Error})
+	}
+	if err := a.print(results, t); err != nil {
+		return err
+	}
+	if failure.failed > 0 {
+		return failure
+	}
+	return nil
+}
+
+// readImport parses and validates a whole import file before anything is
+// posted, so a malformed file changes nothing.
+func readImport(r io.Reader) ([]client.PaymentRequest, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty file")
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"userID", "amount", "transactionID"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing column %q", required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	seen := map[string]int{}
+	reqs := make([]client.PaymentRequest, 0, len(records)-1)
+	for i, record := range records[1:] {
+		row := i + 2
+		amount, err := strconv.ParseFloat(field(record, "amount"), 64)
+		if err != nil || amount == 0 {
+			return nil, fmt.Errorf("row %d: invalid amount %q", row, field(record, "amount"))
+		}
+		req := client.PaymentRequest{
+			UserID:        field(record, "userID"),
+			Amount:        amount,
+			TransactionID: field(record, "transactionID"),
+			RefundOf:      field(record, "refundOf"),
+			Currency:      field(record, "currency"),
+			QuoteID:       field(record, "quoteID"),
+		}
+		if req.UserID == "" || req.TransactionID == "" {
+			return nil, fmt.Errorf("row %d: userID and transactionID are required", row)
+		}
+		if prev, dup := seen[req.TransactionID]; dup {
+			return nil, fmt.Errorf("row %d: transactionID %s already used on row %d", row, req.TransactionID, prev)
+		}
+		seen[req.TransactionID] = row
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
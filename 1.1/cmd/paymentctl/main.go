@@ -0,0 +1,162 @@
+// Command paymentctl operates the payment service over its HTTP API: it posts
+// payments, queries balances and transactions, imports payments in bulk from
+// CSV and exports ledgers.
+//
+// Usage:
+//
+//	paymentctl [global flags] <command> [flags] [args]
+//
+// Run paymentctl -h for the list of commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"1.1/client"
+)
+
+// Exit codes. Scripts can tell a payment that was declined from one that was
+// malformed without parsing messages.
+const (
+	exitOK       = 0
+	exitError    = 1 // network, server or unexpected errors
+	exitUsage    = 2
+	exitInvalid  = 3 // the service rejected the request as invalid
+	exitDeclined = 4 // insufficient funds
+	exitAuth     = 5 // missing or insufficient credentials
+	exitNotFound = 6
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, app *app, args []string) error
+	// timeoutEach makes -timeout apply to each request the command sends
+	// rather than to the whole command.
+	timeoutEach bool
+}
+
+var commands = []command{
+	{"pay", "pay -user ID -amount N [-txn ID] [-refund-of ID] [-currency CODE] [-quote ID]", runPay, false},
+	{"balance", "balance [-as-of TIME] USER...", runBalance, false},
+	{"transaction", "transaction ID", runTransaction, false},
+	{"history", "history USER", runHistory, false},
+	{"import", "import [-dry-run] FILE.csv (- for stdin)", runImport, true},
+	{"export", "export [-from TIME] [-to TIME] USER...", runExport, false},
+}
+
+// app is what commands share: the API client, the per-request timeout of
+// commands with timeoutEach and where output goes.
+type app struct {
+	client  *client.Client
+	timeout time.Duration
+	format  string
+	stdin   io.Reader
+	stdout  io.Writer
+}
+
+// usageError is returned for bad arguments, so run exits with exitUsage.
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("paymentctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	baseURL := fs.String("url", envOr("PAYMENT_URL", "http://localhost:8080"), "payment service base URL")
+	apiKey := fs.String("api-key", os.Getenv("PAYMENT_API_KEY"), "API key")
+	token := fs.String("token", os.Getenv("PAYMENT_TOKEN"), "JWT bearer token, used when no API key is set")
+	format := fs.String("o", "table", "output format: table, json or csv")
+	timeout := fs.Duration("timeout", 30*time.Second, "deadline for the whole command, or for each payment of an import")
+	retries := fs.Int("retries", 3, "retries of a payment after transient failures")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: paymentctl [flags] <command> [args]\n\nCommands:")
+		for _, c := range commands {
+			fmt.Fprintf(stderr, "  %s\n", c.usage)
+		}
+		fmt.Fprintln(stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *format != "table" && *format != "json" && *format != "csv" {
+		fmt.Fprintf(stderr, "paymentctl: unknown output format %q\n", *format)
+		return exitUsage
+	}
+
+	name := fs.Arg(0)
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "paymentctl: unknown command %q\n", name)
+		fs.Usage()
+		return exitUsage
+	}
+
+	c := client.New(*baseURL, *apiKey)
+	c.Token = *token
+	c.MaxRetries = *retries
+	a := &app{client: c, timeout: *timeout, format: *format, stdin: stdin, stdout: stdout}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !cmd.timeoutEach {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	}
+	defer cancel()
+	if err := cmd.run(ctx, a, fs.Args()[1:]); err != nil {
+		fmt.Fprintf(stderr, "paymentctl %s: %v\n", name, err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+// exitCode maps an error to the process exit code.
+func exitCode(err error) int {
+	var usage usageError
+	var failed *importFailed
+	switch {
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.As(err, &failed):
+		return failed.code
+	case errors.Is(err, client.ErrInsufficientFunds):
+		return exitDeclined
+	case errors.Is(err, client.ErrInvalidRequest), errors.Is(err, client.ErrQuoteExpired):
+		return exitInvalid
+	case errors.Is(err, client.ErrUnauthenticated), errors.Is(err, client.ErrForbidden):
+		return exitAuth
+	case errors.Is(err, client.ErrNotFound), errors.Is(err, client.ErrQuoteNotFound):
+		return exitNotFound
+	default:
+		return exitError
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"1.1/client"
+)
+
+// fakeService mimics the payment service's HTTP API: debits below -100 are
+// declined, user "bad" is rejected as invalid, quotes "quote-expired" and
+// "quote-unknown" can't be paid with and payments of user "slow" take 100ms.
+type fakeService struct {
+	mu     sync.Mutex
+	posted []client.PaymentRequest
+}
+
+func newFakeService(t *testing.T) (*fakeService, string) {
+	t.Helper()
+	f := &fakeService{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /pay", func(w http.ResponseWriter, r *http.Request) {
+		var req client.PaymentRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case req.UserID == "bad":
+			w.Header().Set("X-Error-Code", "invalid_request")
+			http.Error(w, "invalid request: bad user", http.StatusBadRequest)
+			return
+		case req.Amount < -100:
+			w.Header().Set("X-Error-Code", "insufficient_funds")
+			http.Error(w, "insufficient funds", http.StatusBadRequest)
+			return
+		case req.QuoteID == "quote-expired":
+			w.Header().Set("X-Error-Code", "quote_expired")
+			http.Error(w, "quote expired", http.StatusBadRequest)
+			return
+		case req.QuoteID == "quote-unknown":
+			w.Header().Set("X-Error-Code", "quote_not_found")
+			http.Error(w, "quote not found", http.StatusBadRequest)
+			return
+		case req.UserID == "slow":
+			time.Sleep(100 * time.Millisecond)
+		}
+		f.mu.Lock()
+		f.posted = append(f.posted, req)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(client.PaymentResponse{TransactionID: req.TransactionID, UserID: req.UserID, Amount: req.Amount, Status: "success", ProcessedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)})
+	})
+	mux.HandleFunc("GET /users/{id}/balance", func(w http.ResponseWriter, r *http.Request) {
+		balance := 12.5
+		if r.URL.Query().Get("asOf") != "" {
+			balance = 5
+		}
+		json.NewEncoder(w).Encode(map[string]any{"userID": r.PathValue("id"), "balance": balance})
+	})
+	mux.HandleFunc("GET /users/{id}/transactions", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"transactions": []client.Transaction{
+			{TransactionID: r.PathValue("id") + "-1", UserID: r.PathValue("id"), Amount: 50, Status: "success", ProcessedAt: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+			{TransactionID: r.PathValue("id") + "-2", UserID: r.PathValue("id"), Amount: -20, Status: "success", ProcessedAt: time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC),
+				Conversion: &client.Conversion{Currency: "USD", Amount: -21.74, Rate: 0.92, QuoteID: "quote-1"}, Fee: &client.Fee{Total: 0.6}},
+			{TransactionID: "sys:fee:" + r.PathValue("id") + "-2", UserID: r.PathValue("id"), Amount: -0.6, Status: "success", ProcessedAt: time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC), FeeOf: r.PathValue("id") + "-2"},
+		}})
+	})
+	mux.HandleFunc("GET /transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Error-Code", "not_found")
+		http.Error(w, "transaction not found", http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+func runCLI(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestPayExitCodes(t *testing.T) {
+	_, url := newFakeService(t)
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"Success", []string{"pay", "-user", "alice", "-amount", "-10", "-txn", "txn-1"}, exitOK},
+		{"Declined", []string{"pay", "-user", "alice", "-amount", "-500"}, exitDeclined},
+		{"Invalid", []string{"pay", "-user", "bad", "-amount", "-10"}, exitInvalid},
+		{"Missing amount", []string{"pay", "-user", "alice"}, exitUsage},
+		{"Unknown flag", []string{"pay", "-users", "alice"}, exitUsage},
+		{"Not found", []string{"transaction", "txn-404"}, exitNotFound},
+		{"Quote expired", []string{"pay", "-user", "alice", "-amount", "-10", "-currency", "USD", "-quote", "quote-expired"}, exitInvalid},
+		{"Quote not found", []string{"pay", "-user", "alice", "-amount", "-10", "-currency", "USD", "-quote", "quote-unknown"}, exitNotFound},
+		{"Unknown command", []string{"refund"}, exitUsage},
+		{"Unknown format", []string{"-o", "xml", "balance", "alice"}, exitUsage},
+		{"Invalid as-of", []string{"balance", "-as-of", "yesterday", "alice"}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := runCLI(t, "", append([]string{"-url", url}, tt.args...)...)
+			if code != tt.want {
+				t.Errorf("Expected exit code %d, got %d (stderr: %s)", tt.want, code, stderr)
+			}
+		})
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	_, url := newFakeService(t)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"table", "USER   BALANCE\nalice  12.50\nbob    12.50\n"},
+		{"csv", "USER,BALANCE\nalice,12.50\nbob,12.50\n"},
+		{"json", `[
+  {
+    "userID": "alice",
+    "balance": 12.5
+  },
+  {
+    "userID": "bob",
+    "balance": 12.5
+  }
+]
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			code, stdout, stderr := runCLI(t, "", "-url", url, "-o", tt.format, "balance", "alice", "bob")
+			if code != exitOK {
+				t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("Expected output\n%s\ngot\n%s", tt.want, stdout)
+			}
+		})
+	}
+}
+
+func TestBalanceAsOf(t *testing.T) {
+	_, url := newFakeService(t)
+	code, stdout, stderr := runCLI(t, "", "-url", url, "-o", "csv", "balance", "-as-of", "2024-01-31T23:59:59Z", "alice")
+	if code != exitOK {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+	}
+	if want := "USER,BALANCE\nalice,5.00\n"; stdout != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, stdout)
+	}
+}
+
+func TestImport(t *testing.T) {
+	csvFile := "userID,amount,transactionID\nalice,100,imp-1\nbob,-500,imp-2\ncarol,25,imp-3\n"
+
+	t.Run("Dry run", func(t *testing.T) {
+		f, url := newFakeService(t)
+		code, stdout, stderr := runCLI(t, csvFile, "-url", url, "-o", "csv", "import", "-dry-run", "-")
+		if code != exitOK {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+		}
+		if len(f.posted) != 0 {
+			t.Errorf("A dry run should not post payments, posted %v", f.posted)
+		}
+		if !strings.Contains(stdout, "3,imp-2,bob,-500.00,valid,") {
+			t.Errorf("Expected every row to be reported as valid, got\n%s", stdout)
+		}
+	})
+
+	t.Run("Partial failure", func(t *testing.T) {
+		f, url := newFakeService(t)
+		code, stdout, _ := runCLI(t, csvFile, "-url", url, "-o", "csv", "import", "-")
+		if code != exitDeclined {
+			t.Errorf("Expected exit code %d for a declined row, got %d", exitDeclined, code)
+		}
+		if len(f.posted) != 2 {
+			t.Errorf("Expected the other rows to be posted, got %v", f.posted)
+		}
+		if !strings.Contains(stdout, "3,imp-2,bob,-500.00,failed,") || !strings.Contains(stdout, "4,imp-3,carol,25.00,posted,") {
+			t.Errorf("Unexpected report\n%s", stdout)
+		}
+	})
+
+	t.Run("Currency columns", func(t *testing.T) {
+		f, url := newFakeService(t)
+		file := "userID,amount,transactionID,currency,quoteID\nalice,100,imp-1,USD,quote-1\n"
+		if code, _, stderr := runCLI(t, file, "-url", url, "import", "-"); code != exitOK {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+		}
+		if len(f.posted) != 1 || f.posted[0].Currency != "USD" || f.posted[0].QuoteID != "quote-1" {
+			t.Errorf("Expected the currency and quote to be posted, got %+v", f.posted)
+		}
+	})
+
+	t.Run("Timeout per payment", func(t *testing.T) {
+		f, url := newFakeService(t)
+		file := "userID,amount,transactionID\nslow,1,imp-1\nslow,1,imp-2\nslow,1,imp-3\n"
+		if code, _, stderr := runCLI(t, file, "-url", url, "-timeout", "250ms", "import", "-"); code != exitOK {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+		}
+		if len(f.posted) != 3 {
+			t.Errorf("Expected every payment to be posted, got %+v", f.posted)
+		}
+	})
+
+	t.Run("Malformed file", func(t *testing.T) {
+		for _, file := range []string{
+			"userID,amount\nalice,10\n",
+			"userID,amount,transactionID\nalice,ten,imp-1\n",
+			"userID,amount,transactionID\nalice,10,imp-1\nbob,10,imp-1\n",
+			"userID,amount,transactionID\nalice,10,\n",
+		} {
+			f, url := newFakeService(t)
+			if code, _, _ := runCLI(t, file, "-url", url, "import", "-"); code != exitInvalid {
+				t.Errorf("Expected exit code %d for %q, got %d", exitInvalid, file, code)
+			}
+			if len(f.posted) != 0 {
+				t.Errorf("A malformed file should not post anything, posted %v", f.posted)
+			}
+		}
+	})
+}
+
+func TestExport(t *testing.T) {
+	_, url := newFakeService(t)
+	code, stdout, stderr := runCLI(t, "", "-url", url, "-o", "csv", "export", "-from", "2024-02-01T00:00:00Z", "alice", "bob")
+	if code != exitOK {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr)
+	}
+	want := "TRANSACTION,USER,AMOUNT,STATUS,REFUND_OF,PROCESSED_AT,CURRENCY,PAID,RATE,QUOTE,FEE,FEE_OF,INTEREST_FOR\n" +
+		"alice-2,alice,-20.00,success,,2024-02-15T00:00:00Z,USD,-21.74,0.92,quote-1,0.60,,\n" +
+		"sys:fee:alice-2,alice,-0.60,success,,2024-02-15T00:00:00Z,,,,,,alice-2,\n" +
+		"bob-2,bob,-20.00,success,,2024-02-15T00:00:00Z,USD,-21.74,0.92,quote-1,0.60,,\n" +
+		"sys:fee:bob-2,bob,-0.60,success,,2024-02-15T00:00:00Z,,,,,,bob-2,\n"
+	if stdout != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, stdout)
+	}
+}
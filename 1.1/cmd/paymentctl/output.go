@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"1.1/client"
+)
+
+// table is the tabular view of a result, used by the table and csv formats.
+// The json format encodes the result itself.
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+func (a *app) print(v any, t table) error {
+	switch a.format {
+	case "json":
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "csv":
+		w := csv.NewWriter(a.stdout)
+		w.Write(t.header)
+		w.WriteAll(t.rows)
+		return w.Error()
+	default:
+		w := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(t.header, "\t"))
+		for _, row := range t.rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	}
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// transactionHeader follows AMOUNT, in the ledger currency, with what a
+// converted payment was paid with (CURRENCY, PAID, RATE, QUOTE), the fee
+// charged on a payment, and the links of fee and interest entries.
+var transactionHeader = []string{"TRANSACTION", "USER", "AMOUNT", "STATUS", "REFUND_OF", "PROCESSED_AT",
+	"CURRENCY", "PAID", "RATE", "QUOTE", "FEE", "FEE_OF", "INTEREST_FOR"}
+
+func transactionRow(t client.Transaction) []string {
+	row := []string{t.TransactionID, t.UserID, formatAmount(t.Amount), t.Status, t.RefundOf, formatTime(t.ProcessedAt),
+		"", "", "", "", "", t.FeeOf, t.InterestFor}
+	if c := t.Conversion; c != nil {
+		row[6], row[7], row[8], row[9] = c.Currency, formatAmount(c.Amount), strconv.FormatFloat(c.Rate, 'f', -1, 64), c.QuoteID
+	}
+	if t.Fee != nil {
+		row[10] = formatAmount(t.Fee.Total)
+	}
+	return row
+}
+
+func transactionTable(txns []client.Transaction) table {
+	t := table{header: transactionHeader}
+	for _, txn := range txns {
+		t.rows = append(t.rows, transactionRow(txn))
+	}
+	return t
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type EventType string
+
+const (
+	EventPaymentSucceeded EventType = "payment.succeeded"
+	EventPaymentDeclined  EventType = "payment.declined"
+	EventRefundCreated    EventType = "refund.created"
+)
+
+type Event struct {
+	ID        string    `json:"id"`
+	Type      EventType `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Data      EventData `json:"data"`
+}
+
+// EventData describes the payment of an event. Balance is the user's
+// balance after the payment and its Fee, which is charged on top of Amount,
+// so the balance before was Balance - Amount + Fee.Total.
+type EventData struct {
+	TransactionID string        `json:"transactionID"`
+	UserID        string        `json:"userID"`
+	Amount        float64       `json:"amount"`
+	Status        string        `json:"status"`
+	RefundOf      string        `json:"refundOf,omitempty"`
+	Fee           *FeeBreakdown `json:"fee,omitempty"`
+	Balance       float64       `json:"balance"`
+	Reason        string        `json:"reason,omitempty"`
+	ProcessedAt   time.Time     `json:"processedAt"`
+}
+
+// emit records the event in the outbox. It must be called with s.mu held so the
+// event is written in the same critical section as the balance update.
+func (s *PaymentService) emit(eventType EventType, txn *Transaction, balance float64, reason string) {
+	s.outbox.append(Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: time.Now(),
+		Data: EventData{
+			TransactionID: txn.TransactionID,
+			UserID:        txn.UserID,
+			Amount:        txn.Amount,
+			Status:        txn.Status,
+			RefundOf:      txn.RefundOf,
+			Fee:           txn.Fee,
+			Balance:       balance,
+			Reason:        reason,
+			ProcessedAt:   txn.ProcessedAt,
+		},
+	})
+}
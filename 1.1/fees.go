@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// systemPrefix marks transaction and user IDs the service posts itself, such
+// as fees. Clients can't use it, so system entries never collide with theirs.
+const systemPrefix = "sys:"
+
+// FeeRevenueAccount is the account fees are credited to.
+const FeeRevenueAccount = systemPrefix + "fee-revenue"
+
+func isSystemID(id string) bool {
+	return strings.HasPrefix(id, systemPrefix)
+}
+
+// feeTransactionIDs returns the IDs of the debit of the payer and the credit
+// of FeeRevenueAccount for the fee on transactionID.
+func feeTransactionIDs(transactionID string) (debit, credit string) {
+	return systemPrefix + "fee:" + transactionID, systemPrefix + "fee-revenue:" + transactionID
+}
+
+// FeeBand is one band of a tiered schedule: debits up to UpTo pay Flat plus
+// Percent of the amount. The last band has no UpTo and covers the rest.
+type FeeBand struct {
+	UpTo    float64 `json:"upTo,omitempty"`
+	Flat    float64 `json:"flat,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// FeeSchedule prices a debit as Flat plus Percent of the amount plus the
+// band the amount falls in, clamped to [Min, Max]. A zero Max means no cap.
+type FeeSchedule struct {
+	Flat    float64   `json:"flat,omitempty"`
+	Percent float64   `json:"percent,omitempty"`
+	Bands   []FeeBand `json:"bands,omitempty"`
+	Min     float64   `json:"min,omitempty"`
+	Max     float64   `json:"max,omitempty"`
+}
+
+func (fs FeeSchedule) validate() error {
+	if fs.Flat < 0 || fs.Percent < 0 || fs.Min < 0 || fs.Max < 0 {
+		return errors.New("fees can't be negative")
+	}
+	if fs.Percent > 100 {
+		return fmt.Errorf("percent %.2f is above 100", fs.Percent)
+	}
+	if fs.Max > 0 && fs.Max < fs.Min {
+		return fmt.Errorf("max %.2f is below min %.2f", fs.Max, fs.Min)
+	}
+	for i, band := range fs.Bands {
+		if band.Flat < 0 || band.Percent < 0 {
+			return fmt.Errorf("band %d: fees can't be negative", i)
+		}
+		if band.Percent > 100 {
+			return fmt.Errorf("band %d: percent %.2f is above 100", i, band.Percent)
+		}
+		last := i == len(fs.Bands)-1
+		if band.UpTo == 0 && !last {
+			return fmt.Errorf("band %d: only the last band may omit upTo", i)
+		}
+		if i > 0 && band.UpTo != 0 && band.UpTo <= fs.Bands[i-1].UpTo {
+			return fmt.Errorf("band %d: upTo must increase", i)
+		}
+	}
+	return nil
+}
+
+// FeeBreakdown itemizes the fee charged on a payment. Adjustment is what the
+// min and max caps added or took away.
+type FeeBreakdown struct {
+	Tier          string  `json:"tier"`
+	Flat          float64 `json:"flat"`
+	Percentage    float64 `json:"percentage"`
+	Band          float64 `json:"band"`
+	Adjustment    float64 `json:"adjustment"`
+	Total         float64 `json:"total"`
+	TransactionID string  `json:"transactionID"`
+}
+
+// roundCents rounds half away from zero to the cent. Every fee component is
+// rounded on its own, so the components add up to the total. Like Convert, it
+// first snaps to a millionth of a cent so that 1.5% of 19.00, computed as
+// 28.499999999999996 cents, rounds up to 0.29.
+func roundCents(amount float64) float64 {
+	return math.Round(math.Round(amount*100*1e6)/1e6) / 100
+}
+
+// FeeEngine picks the fee schedule of a user's tier.
+type FeeEngine struct {
+	DefaultTier string                 `json:"defaultTier"`
+	Tiers       map[string]FeeSchedule `json:"tiers"`
+	Users       map[string]string      `json:"users"`
+}
+
+// LoadFeeEngine reads a JSON fee configuration:
+//
+//	{"defaultTier": "standard",
+//	 "tiers": {"standard": {"flat": 0.3, "percent": 1.5, "min": 0.5, "max": 10}},
+//	 "users": {"user123": "standard"}}
+func LoadFeeEngine(r io.Reader) (*FeeEngine, error) {
+	var e FeeEngine
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		return nil, fmt.Errorf("fee config: %w", err)
+	}
+	for name, schedule := range e.Tiers {
+		if err := schedule.validate(); err != nil {
+			return nil, fmt.Errorf("fee config: tier %s: %w", name, err)
+		}
+	}
+	if _, ok := e.Tiers[e.DefaultTier]; e.DefaultTier != "" && !ok {
+		return nil, fmt.Errorf("fee config: unknown default tier %q", e.DefaultTier)
+	}
+	for userID, tier := range e.Users {
+		if _, ok := e.Tiers[tier]; !ok {
+			return nil, fmt.Errorf("fee config: user %s has unknown tier %q", userID, tier)
+		}
+	}
+	return &e, nil
+}
+
+// Quote returns the fee on a payment, or nil if it is free: credits, refunds,
+// system transactions and users without a tier pay no fees.
+func (e *FeeEngine) Quote(req PaymentRequest) *FeeBreakdown {
+	if e == nil || req.Amount >= 0 || req.RefundOf != "" || isSystemID(req.UserID) {
+		return nil
+	}
+	tier, ok := e.Users[req.UserID]
+	if !ok {
+		tier = e.DefaultTier
+	}
+	schedule, ok := e.Tiers[tier]
+	if !ok {
+		return nil
+	}
+
+	amount := math.Abs(req.Amount)
+	fee := &FeeBreakdown{
+		Tier:       tier,
+		Flat:       roundCents(schedule.Flat),
+		Percentage: roundCents(amount * schedule.Percent / 100),
+	}
+	for _, band := range schedule.Bands {
+		if band.UpTo == 0 || amount <= band.UpTo {
+			fee.Band = roundCents(band.Flat + amount*band.Percent/100)
+			break
+		}
+	}
+	fee.Total = roundCents(fee.Flat + fee.Percentage + fee.Band)
+	capped := math.Max(fee.Total, schedule.Min)
+	if schedule.Max > 0 {
+		capped = math.Min(capped, schedule.Max)
+	}
+	fee.Adjustment = roundCents(capped - fee.Total)
+	fee.Total = roundCents(capped)
+	if fee.Total == 0 {
+		return nil
+	}
+	fee.TransactionID, _ = feeTransactionIDs(req.TransactionID)
+	return fee
+}
+
+// feeFor returns the fee on req: the one an imported ledger entry was booked
+// with, or else the one the user's tier charges.
+func (s *PaymentService) feeFor(req PaymentRequest) *FeeBreakdown {
+	b := req.booking
+	if b == nil {
+		return s.Fees.Quote(req)
+	}
+	if b.fee == nil {
+		return nil
+	}
+	fee := *b.fee
+	fee.TransactionID, _ = feeTransactionIDs(req.TransactionID)
+	return &fee
+}
+
+// postFee records fee as a debit of the payer, whose balance is then
+// balance, and a credit of FeeRevenueAccount, both linked to txn. Must be
+// called with s.mu held.
+func (s *PaymentService) postFee(txn *Transaction, fee *FeeBreakdown, balance float64) {
+	debitID, creditID := feeTransactionIDs(txn.TransactionID)
+	s.record(&Transaction{
+		TransactionID: debitID,
+		UserID:        txn.UserID,
+		Amount:        -fee.Total,
+		Status:        "success",
+		FeeOf:         txn.TransactionID,
+		ProcessedAt:   txn.ProcessedAt,
+	}, balance)
+
+	revenue := s.balances[FeeRevenueAccount] + fee.Total
+	s.balances[FeeRevenueAccount] = revenue
+	s.record(&Transaction{
+		TransactionID: creditID,
+		UserID:        FeeRevenueAccount,
+		Amount:        fee.Total,
+		Status:        "success",
+		FeeOf:         txn.TransactionID,
+		ProcessedAt:   txn.ProcessedAt,
+	}, revenue)
+}
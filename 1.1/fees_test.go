@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const feeConfig = `{
+	"defaultTier": "standard",
+	"tiers": {
+		"standard": {"flat": 0.3, "percent": 1.5, "min": 0.5, "max": 10},
+		"banded": {"bands": [{"upTo": 100, "flat": 1}, {"upTo": 1000, "percent": 1}, {"percent": 0.5}]},
+		"free": {}
+	},
+	"users": {"bob": "banded", "carol": "free"}
+}`
+
+func newFeeEngine(t *testing.T) *FeeEngine {
+	t.Helper()
+	e, err := LoadFeeEngine(strings.NewReader(feeConfig))
+	if err != nil {
+		t.Fatalf("LoadFeeEngine failed: %v", err)
+	}
+	return e
+}
+
+func TestLoadFeeEngineRejectsBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`{"tiers": {"t": {"flat": -1}}}`,
+		`{"tiers": {"t": {"min": 5, "max": 1}}}`,
+		`{"tiers": {"t": {"bands": [{"percent": 1}, {"upTo": 10}]}}}`,
+		`{"tiers": {"t": {"bands": [{"upTo": 10}, {"upTo": 5}]}}}`,
+		`{"defaultTier": "gold", "tiers": {}}`,
+		`{"tiers": {}, "users": {"alice": "gold"}}`,
+		`{"tiers": {"t": {"percentage": 1}}}`,
+		`{"tiers": {"t": {"percent": 100.5}}}`,
+		`{"tiers": {"t": {"bands": [{"percent": 101}]}}}`,
+	} {
+		if _, err := LoadFeeEngine(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected an error for %s", config)
+		}
+	}
+}
+
+func TestRoundCents(t *testing.T) {
+	tests := []struct {
+		amount float64
+		want   float64
+	}{
+		{19 * 1.5 / 100, 0.29},
+		{0.285, 0.29},
+		{1.005, 1.01},
+		{2.675, 2.68},
+		{0.125, 0.13},
+		{-0.285, -0.29},
+		{-1.005, -1.01},
+		{0.284999, 0.28},
+		{0.0049, 0},
+	}
+	for _, tt := range tests {
+		if got := roundCents(tt.amount); got != tt.want {
+			t.Errorf("Expected roundCents(%v) = %.2f, got %v", tt.amount, tt.want, got)
+		}
+	}
+}
+
+func TestFeeQuote(t *testing.T) {
+	e := newFeeEngine(t)
+	tests := []struct {
+		name       string
+		req        PaymentRequest
+		want       float64
+		adjustment float64
+	}{
+		{"Flat and percentage", PaymentRequest{UserID: "alice", Amount: -50}, 1.05, 0},
+		{"Rounded to the cent", PaymentRequest{UserID: "alice", Amount: -10.1}, 0.5, 0.05},
+		{"Half cent rounded up", PaymentRequest{UserID: "alice", Amount: -19}, 0.59, 0},
+		{"Min cap", PaymentRequest{UserID: "alice", Amount: -1}, 0.5, 0.18},
+		{"Max cap", PaymentRequest{UserID: "alice", Amount: -5000}, 10, -65.3},
+		{"First band", PaymentRequest{UserID: "bob", Amount: -100}, 1, 0},
+		{"Middle band", PaymentRequest{UserID: "bob", Amount: -250}, 2.5, 0},
+		{"Last band", PaymentRequest{UserID: "bob", Amount: -5000}, 25, 0},
+		{"Credit", PaymentRequest{UserID: "alice", Amount: 50}, 0, 0},
+		{"Refund", PaymentRequest{UserID: "alice", Amount: -50, RefundOf: "txn-0"}, 0, 0},
+		{"Free tier", PaymentRequest{UserID: "carol", Amount: -50}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fee := e.Quote(tt.req)
+			if tt.want == 0 {
+				if fee != nil {
+					t.Errorf("Expected no fee, got %+v", fee)
+				}
+				return
+			}
+			if fee == nil || fee.Total != tt.want || fee.Adjustment != tt.adjustment {
+				t.Fatalf("Expected fee %.2f with adjustment %.2f, got %+v", tt.want, tt.adjustment, fee)
+			}
+			if sum := roundCents(fee.Flat + fee.Percentage + fee.Band + fee.Adjustment); sum != fee.Total {
+				t.Errorf("Components add up to %.2f, not the total %.2f", sum, fee.Total)
+			}
+		})
+	}
+
+	var none *FeeEngine
+	if fee := none.Quote(PaymentRequest{UserID: "alice", Amount: -50}); fee != nil {
+		t.Errorf("Expected a nil engine to charge nothing, got %+v", fee)
+	}
+}
+
+func TestProcessPaymentChargesFee(t *testing.T) {
+	service := NewPaymentService()
+	service.Fees = newFeeEngine(t)
+	ctx := context.Background()
+	service.SetBalance(ctx, "alice", 100)
+
+	resp, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -50, TransactionID: "txn-1"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if resp.Amount != -50 || resp.Fee == nil || resp.Fee.Total != 1.05 || resp.Fee.TransactionID != "sys:fee:txn-1" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 48.95 {
+		t.Errorf("Expected alice's balance 48.95, got %.2f", balance)
+	}
+	if revenue := balanceOf(t, service, FeeRevenueAccount); revenue != 1.05 {
+		t.Errorf("Expected fee revenue 1.05, got %.2f", revenue)
+	}
+	for _, txnID := range []string{"sys:fee:txn-1", "sys:fee-revenue:txn-1"} {
+		if txn, err := service.GetTransaction(ctx, txnID); err != nil || txn.FeeOf != "txn-1" {
+			t.Errorf("Expected %s to be linked to txn-1, got %+v, %v", txnID, txn, err)
+		}
+	}
+
+	again, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -50, TransactionID: "txn-1"})
+	if err != nil || again.Fee == nil || *again.Fee != *resp.Fee {
+		t.Errorf("Expected the idempotent response to carry the same fee, got %+v, %v", again, err)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 48.95 {
+		t.Errorf("Expected the retry not to charge again, got balance %.2f", balance)
+	}
+
+	// The payment fits the balance but the fee doesn't.
+	_, err = service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -48.5, TransactionID: "txn-2"})
+	if !errors.Is(err, ErrInsufficientFunds) || !strings.Contains(err.Error(), "fee=1.03") {
+		t.Errorf("Expected a decline mentioning the fee, got %v", err)
+	}
+
+	// Refunds return the amount, not the fee, and are free themselves.
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 50, TransactionID: "txn-3", RefundOf: "txn-1"}); err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 98.95 {
+		t.Errorf("Expected alice's balance 98.95 after the refund, got %.2f", balance)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1.05, TransactionID: "txn-4", RefundOf: "sys:fee:txn-1"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected refunding a fee to be rejected, got %v", err)
+	}
+
+	// Fees show up as their own postings, and the history still adds up.
+	from, to, _ := StatementPeriod("day", resp.ProcessedAt.UTC().Format("2006-01-02"))
+	st, err := service.Statement(ctx, "alice", from, to)
+	if err != nil {
+		t.Fatalf("Statement failed: %v", err)
+	}
+	if len(st.Postings) != 4 || st.Postings[2].Type != postingFee || st.ClosingBalance != 98.95 {
+		t.Errorf("Unexpected statement %+v", st)
+	}
+	var csv strings.Builder
+	if err := st.WriteCSV(&csv); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	if !strings.Contains(csv.String(), ",sys:fee:txn-1,fee,,txn-1,-1.05,") {
+		t.Errorf("Expected the fee row to name its payment, got\n%s", csv.String())
+	}
+}
+
+func TestSystemIDsAreReserved(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	for _, req := range []PaymentRequest{
+		{UserID: "alice", Amount: 10, TransactionID: "sys:fee:txn-9"},
+		{UserID: FeeRevenueAccount, Amount: -10, TransactionID: "txn-9"},
+	} {
+		if _, err := service.ProcessPayment(ctx, req); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Expected %+v to be rejected, got %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoRate        = errors.New("no exchange rate")
+	ErrQuoteNotFound = errors.New("quote not found")
+	ErrQuoteExpired  = errors.New("quote expired")
+)
+
+// defaultQuoteTTL is how long a quote can be paid with.
+const defaultQuoteTTL = time.Minute
+
+// RateProvider returns how many units of to one unit of from buys.
+type RateProvider interface {
+	Rate(ctx context.Context, from, to string) (float64, error)
+}
+
+// StaticRates is a RateProvider with fixed rates keyed "FROM/TO". A pair
+// without a rate of its own is priced at the inverse of the opposite pair.
+type StaticRates map[string]float64
+
+// LoadStaticRates reads a JSON object of rates, such as {"EUR/USD": 1.0842}.
+func LoadStaticRates(r io.Reader) (StaticRates, error) {
+	var rates StaticRates
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&rates); err != nil {
+		return nil, fmt.Errorf("fx rates: %w", err)
+	}
+	for pair, rate := range rates {
+		from, to, ok := strings.Cut(pair, "/")
+		if !ok || !validCurrency(from) || !validCurrency(to) {
+			return nil, fmt.Errorf("fx rates: invalid pair %q, want e.g. EUR/USD", pair)
+		}
+		if !(rate > 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("fx rates: %s: rate must be positive", pair)
+		}
+	}
+	return rates, nil
+}
+
+func (r StaticRates) Rate(_ context.Context, from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if rate, ok := r[from+"/"+to]; ok {
+		return rate, nil
+	}
+	if rate, ok := r[to+"/"+from]; ok {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("%w: %s/%s", ErrNoRate, from, to)
+}
+
+// validCurrency reports whether code looks like an ISO 4217 code.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// minorUnits is the number of decimals of currencies that don't have two.
+var minorUnits = map[string]int{
+	"BHD": 3, "CLP": 0, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "OMR": 3, "TND": 3, "VND": 0,
+}
+
+func decimals(currency string) int {
+	if d, ok := minorUnits[currency]; ok {
+		return d
+	}
+	return 2
+}
+
+// RoundingMode says how a converted amount is rounded to the minor unit of
+// the target currency.
+type RoundingMode string
+
+const (
+	// RoundHalfEven rounds halves to the even minor unit (banker's rounding),
+	// so rounding doesn't drift one way over many conversions.
+	RoundHalfEven RoundingMode = "half-even"
+	// RoundHalfUp rounds halves away from zero.
+	RoundHalfUp RoundingMode = "half-up"
+	// RoundDown truncates toward zero, never crediting or debiting more than
+	// the exact amount.
+	RoundDown RoundingMode = "down"
+)
+
+// ParseRoundingMode accepts half-even, half-up and down.
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch mode := RoundingMode(s); mode {
+	case RoundHalfEven, RoundHalfUp, RoundDown:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown rounding mode %q, want half-even, half-up or down", s)
+}
+
+// Convert returns amount times rate rounded to the minor unit of currency.
+// The product is first snapped to a millionth of the minor unit so binary
+// noise, as in 0.285*100 = 28.499999999999996, doesn't decide the rounding.
+func Convert(amount, rate float64, currency string, mode RoundingMode) float64 {
+	scale := math.Pow10(decimals(currency))
+	units := math.Round(amount*rate*scale*1e6) / 1e6
+	switch mode {
+	case RoundHalfUp:
+		units = math.Round(units)
+	case RoundDown:
+		units = math.Trunc(units)
+	default:
+		units = math.RoundToEven(units)
+	}
+	return units / scale
+}
+
+// Quote fixes the rate of a conversion into the ledger currency until
+// ExpiresAt. A payment of Amount in From with QuoteID is booked as
+// Converted, whatever the rate is by then. Quotes can be paid with once.
+type Quote struct {
+	QuoteID   string    `json:"quoteID"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      float64   `json:"rate"`
+	Amount    float64   `json:"amount"`
+	Converted float64   `json:"converted"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Conversion records on a Transaction the amount the payment was made in
+// and the rate that turned it into the ledger amount.
+type Conversion struct {
+	Currency string  `json:"currency"`
+	Amount   float64 `json:"amount"`
+	Rate     float64 `json:"rate"`
+	QuoteID  string  `json:"quoteID,omitempty"`
+}
+
+// Converter books payments made in other currencies in the ledger currency.
+type Converter struct {
+	// Currency is the ledger currency all balances are kept in.
+	Currency string
+	Rates    RateProvider
+	Rounding RoundingMode
+	QuoteTTL time.Duration
+
+	mu     sync.Mutex
+	quotes map[string]*Quote
+	used   map[string]bool
+	now    func() time.Time
+}
+
+func NewConverter(currency string, rates RateProvider) *Converter {
+	return &Converter{
+		Currency: currency,
+		Rates:    rates,
+		Rounding: RoundHalfEven,
+		QuoteTTL: defaultQuoteTTL,
+		quotes:   make(map[string]*Quote),
+		used:     make(map[string]bool),
+		now:      time.Now,
+	}
+}
+
+// errFXDisabled is returned for payments in another currency when the
+// service has no Converter.
+var errFXDisabled = fmt.Errorf("%w: currency conversion is not enabled", ErrInvalidRequest)
+
+// NewQuote prices amount of currency in the ledger currency at the current
+// rate and holds that rate for QuoteTTL.
+func (c *Converter) NewQuote(ctx context.Context, currency string, amount float64) (*Quote, error) {
+	if c == nil {
+		return nil, errFXDisabled
+	}
+	if !validCurrency(currency) {
+		return nil, fmt.Errorf("%w: invalid currency %q", ErrInvalidRequest, currency)
+	}
+	if amount == 0 {
+		return nil, fmt.Errorf("%w: amount cannot be zero", ErrInvalidRequest)
+	}
+	rate, err := c.Rates.Rate(ctx, currency, c.Currency)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := c.now()
+	q := &Quote{
+		QuoteID:   "quote-" + hex.EncodeToString(b),
+		From:      currency,
+		To:        c.Currency,
+		Rate:      rate,
+		Amount:    amount,
+		Converted: Convert(amount, rate, c.Currency, c.Rounding),
+		ExpiresAt: now.Add(c.QuoteTTL),
+	}
+	if q.Converted == 0 {
+		return nil, c.roundedToZero(currency, amount)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Forget expired quotes here rather than in a goroutine of their own.
+	for id, old := range c.quotes {
+		if !now.Before(old.ExpiresAt) {
+			delete(c.quotes, id)
+			delete(c.used, id)
+		}
+	}
+	c.quotes[q.QuoteID] = q
+	return q, nil
+}
+
+// live converts a payment in another currency at the current rate. It
+// returns a nil Conversion for payments in the ledger currency and for
+// quoted payments, which are converted by quoted. Imported ledger entries
+// keep the conversion they were booked with.
+func (c *Converter) live(ctx context.Context, req PaymentRequest) (*Conversion, float64, error) {
+	if req.booking != nil {
+		return req.booking.conversion, req.booking.amount, nil
+	}
+	if c == nil {
+		if req.Currency != "" || req.QuoteID != "" {
+			return nil, 0, errFXDisabled
+		}
+		return nil, req.Amount, nil
+	}
+	if req.QuoteID != "" || req.Currency == "" || req.Currency == c.Currency {
+		return nil, req.Amount, nil
+	}
+	if !validCurrency(req.Currency) {
+		return nil, 0, fmt.Errorf("%w: invalid currency %q", ErrInvalidRequest, req.Currency)
+	}
+	rate, err := c.Rates.Rate(ctx, req.Currency, c.Currency)
+	if err != nil {
+		return nil, 0, err
+	}
+	amount := Convert(req.Amount, rate, c.Currency, c.Rounding)
+	if amount == 0 {
+		return nil, 0, c.roundedToZero(req.Currency, req.Amount)
+	}
+	return &Conversion{Currency: req.Currency, Amount: req.Amount, Rate: rate}, amount, nil
+}
+
+// quoted converts a payment at the rate of its quote, which must be unused,
+// unexpired and for the same currency and amount. It doesn't use the quote
+// up; redeem does once the payment is committed.
+func (c *Converter) quoted(req PaymentRequest) (*Conversion, float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, ok := c.quotes[req.QuoteID]
+	switch {
+	case !ok:
+		return nil, 0, fmt.Errorf("%w: %s", ErrQuoteNotFound, req.QuoteID)
+	case c.used[req.QuoteID]:
+		return nil, 0, fmt.Errorf("%w: quote %s was already used", ErrInvalidRequest, req.QuoteID)
+	case !c.now().Before(q.ExpiresAt):
+		return nil, 0, fmt.Errorf("%w: %s expired at %s", ErrQuoteExpired, req.QuoteID, q.ExpiresAt.Format(time.RFC3339))
+	case req.Currency != "" && req.Currency != q.From:
+		return nil, 0, fmt.Errorf("%w: quote %s is for %s, not %s", ErrInvalidRequest, req.QuoteID, q.From, req.Currency)
+	case req.Amount != q.Amount:
+		return nil, 0, fmt.Errorf("%w: quote %s is for %.2f %s, not %.2f", ErrInvalidRequest, req.QuoteID, q.Amount, q.From, req.Amount)
+	}
+	conv := &Conversion{Currency: q.From, Amount: q.Amount, Rate: q.Rate, QuoteID: q.QuoteID}
+	return conv, q.Converted, nil
+}
+
+func (c *Converter) roundedToZero(currency string, amount float64) error {
+	return fmt.Errorf("%w: %g %s is zero in %s", ErrInvalidRequest, amount, currency, c.Currency)
+}
+
+// redeem uses up the quote of a committed payment.
+func (c *Converter) redeem(conv *Conversion) {
+	if c == nil || conv == nil || conv.QuoteID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.markUsed(conv.QuoteID)
+}
+
+// markUsed must be called with c.mu held. Quotes that are unknown, or were
+// already forgotten, are left out, since they can't be paid with anyway.
+func (c *Converter) markUsed(quoteID string) {
+	if _, ok := c.quotes[quoteID]; ok {
+		c.used[quoteID] = true
+	}
+}
+
+// restore rebuilds the set of used quotes from the journal of a restored
+// snapshot: quotes that were only paid with after it was taken can be used
+// again.
+func (c *Converter) restore(journal []*Transaction) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.used = make(map[string]bool)
+	for _, txn := range journal {
+		if conv := txn.Conversion; conv != nil && conv.QuoteID != "" {
+			c.markUsed(conv.QuoteID)
+		}
+	}
+}
+
+type quoteRequest struct {
+	Currency string  `json:"currency"`
+	Amount   float64 `json:"amount"`
+}
+
+// HandleQuote serves POST /quotes with a {"currency", "amount"} body and
+// answers with the Quote.
+func (s *PaymentService) HandleQuote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req quoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	q, err := s.FX.NewQuote(r.Context(), req.Currency, req.Amount)
+	if err != nil {
+		slog.WarnContext(r.Context(), "quote failed", "currency", req.Currency, "error", err)
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
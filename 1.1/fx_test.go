@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		amount, rate float64
+		currency     string
+		mode         RoundingMode
+		want         float64
+	}{
+		{10, 0.0285, "EUR", RoundHalfEven, 0.28},
+		{10, 0.0285, "EUR", RoundHalfUp, 0.29},
+		{10, 0.0285, "EUR", RoundDown, 0.28},
+		{0.135, 1, "EUR", RoundHalfEven, 0.14},
+		{-10, 0.0285, "EUR", RoundHalfEven, -0.28},
+		{-10, 0.0285, "EUR", RoundHalfUp, -0.29},
+		{-10.55, 0.92, "EUR", RoundDown, -9.7},
+		{100, 151.237, "JPY", RoundHalfEven, 15124},
+		{100, 0.30771, "KWD", RoundHalfUp, 30.771},
+	}
+	for _, tt := range tests {
+		if got := Convert(tt.amount, tt.rate, tt.currency, tt.mode); got != tt.want {
+			t.Errorf("Convert(%g, %g, %s, %s): expected %g, got %g", tt.amount, tt.rate, tt.currency, tt.mode, tt.want, got)
+		}
+	}
+
+	if _, err := ParseRoundingMode("ceiling"); err == nil {
+		t.Error("Expected an error for an unknown rounding mode")
+	}
+}
+
+func TestStaticRates(t *testing.T) {
+	rates, err := LoadStaticRates(strings.NewReader(`{"USD/EUR": 0.8, "EUR/JPY": 160}`))
+	if err != nil {
+		t.Fatalf("LoadStaticRates failed: %v", err)
+	}
+	ctx := context.Background()
+	for _, tt := range []struct {
+		from, to string
+		want     float64
+	}{
+		{"USD", "EUR", 0.8},
+		{"EUR", "USD", 1.25},
+		{"EUR", "EUR", 1},
+		{"EUR", "JPY", 160},
+	} {
+		if rate, err := rates.Rate(ctx, tt.from, tt.to); err != nil || rate != tt.want {
+			t.Errorf("%s/%s: expected %g, got %g, %v", tt.from, tt.to, tt.want, rate, err)
+		}
+	}
+	if _, err := rates.Rate(ctx, "USD", "JPY"); !errors.Is(err, ErrNoRate) {
+		t.Errorf("Expected ErrNoRate without a direct rate, got %v", err)
+	}
+
+	for _, config := range []string{`{"USDEUR": 0.8}`, `{"usd/eur": 0.8}`, `{"USD/EUR": 0}`, `{"USD/EUR": -1}`, `[]`} {
+		if _, err := LoadStaticRates(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected an error for %s", config)
+		}
+	}
+}
+
+// newFXService keeps its ledger in EUR and converts USD at 0.92, with quotes
+// expiring on the service's fake clock.
+func newFXService() (*PaymentService, *fakeClock, StaticRates) {
+	service, clock := newClockedService()
+	rates := StaticRates{"USD/EUR": 0.92}
+	service.FX = NewConverter("EUR", rates)
+	service.FX.now = clock.now
+	return service, clock, rates
+}
+
+func TestProcessPaymentConverts(t *testing.T) {
+	service, _, _ := newFXService()
+	ctx := context.Background()
+
+	resp, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 100, Currency: "USD", TransactionID: "txn-1"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	want := Conversion{Currency: "USD", Amount: 100, Rate: 0.92}
+	if resp.Amount != 92 || resp.Conversion == nil || *resp.Conversion != want {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -10.55, Currency: "USD", TransactionID: "txn-2"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if txn, err := service.GetTransaction(ctx, "txn-2"); err != nil || txn.Amount != -9.71 || txn.Conversion.Rate != 0.92 {
+		t.Errorf("Expected txn-2 booked as -9.71 at 0.92, got %+v, %v", txn, err)
+	}
+	if balance := balanceOf(t, service, "alice"); roundCents(balance) != 82.29 {
+		t.Errorf("Expected alice's balance 82.29, got %.2f", balance)
+	}
+
+	// Ledger currency payments aren't converted.
+	resp, err = service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1, Currency: "EUR", TransactionID: "txn-3"})
+	if err != nil || resp.Conversion != nil || resp.Amount != 1 {
+		t.Errorf("Expected an unconverted payment, got %+v, %v", resp, err)
+	}
+
+	for _, req := range []PaymentRequest{
+		{UserID: "alice", Amount: 1, Currency: "GBP", TransactionID: "txn-4"},
+		{UserID: "alice", Amount: 1, Currency: "usd", TransactionID: "txn-4"},
+		{UserID: "alice", Amount: 0.001, Currency: "USD", TransactionID: "txn-4"},
+	} {
+		if _, err := service.ProcessPayment(ctx, req); err == nil {
+			t.Errorf("Expected %+v to be rejected", req)
+		}
+	}
+
+	plain := NewPaymentService()
+	if _, err := plain.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1, Currency: "USD", TransactionID: "txn-1"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected conversion to be rejected when disabled, got %v", err)
+	}
+}
+
+func TestProcessPaymentHonorsQuote(t *testing.T) {
+	service, clock, rates := newFXService()
+	ctx := context.Background()
+	service.SetBalance(ctx, "alice", 100)
+
+	q, err := service.FX.NewQuote(ctx, "USD", -20)
+	if err != nil {
+		t.Fatalf("NewQuote failed: %v", err)
+	}
+	if q.Converted != -18.4 || q.To != "EUR" || !q.ExpiresAt.Equal(clock.now().Add(defaultQuoteTTL)) {
+		t.Errorf("Unexpected quote %+v", q)
+	}
+
+	// The rate moves, but the quote holds.
+	rates["USD/EUR"] = 0.5
+	clock.advance(30 * time.Second)
+	resp, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -20, Currency: "USD", QuoteID: q.QuoteID, TransactionID: "txn-1"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if resp.Amount != -18.4 || resp.Conversion.Rate != 0.92 || resp.Conversion.QuoteID != q.QuoteID {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	// A retry is answered idempotently, but the quote can't pay for another.
+	if again, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -20, QuoteID: q.QuoteID, TransactionID: "txn-1"}); err != nil || *again.Conversion != *resp.Conversion {
+		t.Errorf("Expected an idempotent response, got %+v, %v", again, err)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -20, QuoteID: q.QuoteID, TransactionID: "txn-2"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected a used quote to be rejected, got %v", err)
+	}
+
+	q, err = service.FX.NewQuote(ctx, "USD", -20)
+	if err != nil {
+		t.Fatalf("NewQuote failed: %v", err)
+	}
+	for _, req := range []PaymentRequest{
+		{UserID: "alice", Amount: -21, QuoteID: q.QuoteID, TransactionID: "txn-3"},
+		{UserID: "alice", Amount: -20, Currency: "GBP", QuoteID: q.QuoteID, TransactionID: "txn-3"},
+	} {
+		if _, err := service.ProcessPayment(ctx, req); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Expected %+v not to match the quote, got %v", req, err)
+		}
+	}
+	clock.advance(defaultQuoteTTL)
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -20, QuoteID: q.QuoteID, TransactionID: "txn-3"}); !errors.Is(err, ErrQuoteExpired) {
+		t.Errorf("Expected ErrQuoteExpired, got %v", err)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -20, QuoteID: "quote-unknown", TransactionID: "txn-3"}); !errors.Is(err, ErrQuoteNotFound) {
+		t.Errorf("Expected ErrQuoteNotFound, got %v", err)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 81.6 {
+		t.Errorf("Expected only the first quote to be paid, got balance %.2f", balance)
+	}
+}
+
+func TestHandleQuote(t *testing.T) {
+	service, _, _ := newFXService()
+
+	w := httptest.NewRecorder()
+	service.HandleQuote(w, httptest.NewRequest(http.MethodPost, "/quotes", strings.NewReader(`{"currency": "USD", "amount": 50}`)))
+	var q Quote
+	if err := json.NewDecoder(w.Body).Decode(&q); err != nil || w.Code != http.StatusOK || q.Converted != 46 || q.QuoteID == "" {
+		t.Fatalf("Unexpected response %d %+v %v", w.Code, q, err)
+	}
+
+	w = httptest.NewRecorder()
+	service.HandleQuote(w, httptest.NewRequest(http.MethodPost, "/quotes", strings.NewReader(`{"currency": "CHF", "amount": 50}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a rate, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	NewPaymentService().HandleQuote(w, httptest.NewRequest(http.MethodPost, "/quotes", strings.NewReader(`{"currency": "USD", "amount": 50}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 with conversion disabled, got %d", w.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"1.1/paymentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer exposes PaymentService over gRPC. It shares the same
+// PaymentService instance as the HTTP handlers.
+type grpcServer struct {
+	paymentpb.UnimplementedPaymentServiceServer
+	service *PaymentService
+}
+
+func NewGRPCServer(service *PaymentService, opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	paymentpb.RegisterPaymentServiceServer(srv, &grpcServer{service: service})
+	return srv
+}
+
+func (g *grpcServer) ProcessPayment(ctx context.Context, req *paymentpb.ProcessPaymentRequest) (*paymentpb.ProcessPaymentResponse, error) {
+	payment := PaymentRequest{
+		UserID:        req.GetUserId(),
+		Amount:        req.GetAmount(),
+		TransactionID: req.GetTransactionId(),
+		RefundOf:      req.GetRefundOf(),
+		Currency:      req.GetCurrency(),
+		QuoteID:       req.GetQuoteId(),
+	}
+	if err := authorizePayment(ctx, payment); err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp, err := g.service.ProcessPayment(ctx, payment)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &paymentpb.ProcessPaymentResponse{
+		TraceId:       resp.TraceID,
+		TransactionId: resp.TransactionID,
+		UserId:        resp.UserID,
+		Amount:        resp.Amount,
+		Status:        resp.Status,
+		Message:       resp.Message,
+		ProcessedAt:   timestamppb.New(resp.ProcessedAt),
+		Fee:           toProtoFee(resp.Fee),
+		Conversion:    toProtoConversion(resp.Conversion),
+	}, nil
+}
+
+func (g *grpcServer) GetBalance(ctx context.Context, req *paymentpb.GetBalanceRequest) (*paymentpb.GetBalanceResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "userID is required")
+	}
+	if err := authorizeUser(ctx, req.GetUserId()); err != nil {
+		return nil, grpcError(err)
+	}
+	balance, err := g.service.GetBalance(ctx, req.GetUserId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &paymentpb.GetBalanceResponse{
+		UserId:  req.GetUserId(),
+		Balance: balance,
+	}, nil
+}
+
+func (g *grpcServer) GetTransaction(ctx context.Context, req *paymentpb.GetTransactionRequest) (*paymentpb.Transaction, error) {
+	if req.GetTransactionId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "transactionID is required")
+	}
+	txn, err := g.service.authorizedTransaction(ctx, req.GetTransactionId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toProtoTransaction(*txn), nil
+}
+
+func (g *grpcServer) ListTransactions(ctx context.Context, req *paymentpb.ListTransactionsRequest) (*paymentpb.ListTransactionsResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "userID is required")
+	}
+	if err := authorizeUser(ctx, req.GetUserId()); err != nil {
+		return nil, grpcError(err)
+	}
+	txns, err := g.service.ListTransactions(ctx, req.GetUserId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &paymentpb.ListTransactionsResponse{
+		Transactions: make([]*paymentpb.Transaction, 0, len(txns)),
+	}
+	for _, txn := range txns {
+		resp.Transactions = append(resp.Transactions, toProtoTransaction(txn))
+	}
+	return resp, nil
+}
+
+func toProtoTransaction(txn Transaction) *paymentpb.Transaction {
+	return &paymentpb.Transaction{
+		TransactionId: txn.TransactionID,
+		UserId:        txn.UserID,
+		Amount:        txn.Amount,
+		Status:        txn.Status,
+		RefundOf:      txn.RefundOf,
+		ProcessedAt:   timestamppb.New(txn.ProcessedAt),
+		FeeOf:         txn.FeeOf,
+		Fee:           toProtoFee(txn.Fee),
+		Conversion:    toProtoConversion(txn.Conversion),
+		InterestFor:   txn.InterestFor,
+	}
+}
+
+func toProtoFee(fee *FeeBreakdown) *paymentpb.FeeBreakdown {
+	if fee == nil {
+		return nil
+	}
+	return &paymentpb.FeeBreakdown{
+		Tier:          fee.Tier,
+		Flat:          fee.Flat,
+		Percentage:    fee.Percentage,
+		Band:          fee.Band,
+		Adjustment:    fee.Adjustment,
+		Total:         fee.Total,
+		TransactionId: fee.TransactionID,
+	}
+}
+
+func toProtoConversion(conv *Conversion) *paymentpb.Conversion {
+	if conv == nil {
+		return nil
+	}
+	return &paymentpb.Conversion{
+		Currency: conv.Currency,
+		Amount:   conv.Amount,
+		Rate:     conv.Rate,
+		QuoteId:  conv.QuoteID,
+	}
+}
+
+// grpcError maps domain errors from PaymentService to gRPC status codes. As
+// over HTTP, a request cut short by shutdown is Unavailable, so clients retry
+// it elsewhere.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrNoRate):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrInsufficientFunds):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrTransactionNotFound), errors.Is(err, ErrQuoteNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrQuoteExpired):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
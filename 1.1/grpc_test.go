@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"1.1/paymentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCClient serves service with every call authenticated as admin.
+func newGRPCClient(t *testing.T, service *PaymentService) paymentpb.PaymentServiceClient {
+	t.Helper()
+	return newGRPCClientWithServer(t, NewGRPCServer(service, grpc.UnaryInterceptor(adminInterceptor)))
+}
+
+func newGRPCClientWithServer(t *testing.T, srv *grpc.Server) paymentpb.PaymentServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return paymentpb.NewPaymentServiceClient(conn)
+}
+
+func TestGRPCProcessPaymentAndQueries(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 100.00)
+	client := newGRPCClient(t, service)
+	ctx := context.Background()
+
+	resp, err := client.ProcessPayment(ctx, &paymentpb.ProcessPaymentRequest{UserId: "user123", Amount: -40, TransactionId: "txn-001"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if resp.GetStatus() != "success" || resp.GetTraceId() == "" || resp.GetProcessedAt() == nil {
+		t.Errorf("Unexpected response: %v", resp)
+	}
+
+	balance, err := client.GetBalance(ctx, &paymentpb.GetBalanceRequest{UserId: "user123"})
+	if err != nil {
+		t.Fatalf("GetBalance failed: %v", err)
+	}
+	if balance.GetBalance() != 60.00 {
+		t.Errorf("Expected balance 60.00, got %.2f", balance.GetBalance())
+	}
+
+	txn, err := client.GetTransaction(ctx, &paymentpb.GetTransactionRequest{TransactionId: "txn-001"})
+	if err != nil {
+		t.Fatalf("GetTransaction failed: %v", err)
+	}
+	if txn.GetUserId() != "user123" || txn.GetAmount() != -40 {
+		t.Errorf("Unexpected transaction: %v", txn)
+	}
+
+	if _, err := client.ProcessPayment(ctx, &paymentpb.ProcessPaymentRequest{UserId: "user123", Amount: 10, TransactionId: "txn-002"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	history, err := client.ListTransactions(ctx, &paymentpb.ListTransactionsRequest{UserId: "user123"})
+	if err != nil {
+		t.Fatalf("ListTransactions failed: %v", err)
+	}
+	if len(history.GetTransactions()) != 2 || history.GetTransactions()[1].GetTransactionId() != "txn-002" {
+		t.Errorf("Unexpected history: %v", history.GetTransactions())
+	}
+}
+
+func TestGRPCErrorCodes(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 10.00)
+	client := newGRPCClient(t, service)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{
+			name: "Validation error",
+			call: func() error {
+				_, err := client.ProcessPayment(ctx, &paymentpb.ProcessPaymentRequest{UserId: "user123", Amount: 0, TransactionId: "txn-001"})
+				return err
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "Insufficient funds",
+			call: func() error {
+				_, err := client.ProcessPayment(ctx, &paymentpb.ProcessPaymentRequest{UserId: "user123", Amount: -50, TransactionId: "txn-002"})
+				return err
+			},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "Unknown transaction",
+			call: func() error {
+				_, err := client.GetTransaction(ctx, &paymentpb.GetTransactionRequest{TransactionId: "missing"})
+				return err
+			},
+			code: codes.NotFound,
+		},
+		{
+			name: "Missing userID",
+			call: func() error {
+				_, err := client.GetBalance(ctx, &paymentpb.GetBalanceRequest{})
+				return err
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if got := status.Code(err); got != tt.code {
+				t.Errorf("Expected code %s, got %s (%v)", tt.code, got, err)
+			}
+		})
+	}
+}
+
+func TestGRPCFeesAndConversion(t *testing.T) {
+	service, clock, _ := newFXService()
+	service.Fees = newFeeEngine(t)
+	service.SetBalance(context.Background(), "alice", 100)
+	client := newGRPCClient(t, service)
+	ctx := context.Background()
+
+	q, err := service.FX.NewQuote(ctx, "USD", -50)
+	if err != nil {
+		t.Fatalf("NewQuote failed: %v", err)
+	}
+	resp, err := client.ProcessPayment(ctx, &paymentpb.ProcessPaymentRequest{UserId: "alice", Amount: -50, Currency: "USD", QuoteId: q.QuoteID, TransactionId: "txn-1"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if resp.GetAmount() != -46 || resp.GetConversion().GetCurrency() != "USD" || resp.GetConversion().GetAmount() != -50 || resp.GetConversion().GetQuoteId() != q.QuoteID {
+		t.Errorf("Unexpected conversion in %v", resp)
+	}
+	if fee := resp.GetFee(); fee.GetTier() != "standard" || fee.GetTotal() == 0 || fee.GetTransactionId() != "sys:fee:txn-1" {
+		t.Errorf("Unexpected fee in %v", resp)
+	}
+
+	txn, err := client.GetTransaction(ctx, &paymentpb.GetTransactionRequest{TransactionId: "txn-1"})
+	if err != nil {
+		t.Fatalf("GetTransaction failed: %v", err)
+	}
+	if conv := txn.GetConversion(); conv.GetCurrency() != "USD" || conv.GetAmount() != -50 || conv.GetRate() != q.Rate || conv.GetQuoteId() != q.QuoteID {
+		t.Errorf("Expected the conversion to be read back, got %v", txn)
+	}
+	if txn.GetFee().GetTotal() != resp.GetFee().GetTotal() {
+		t.Errorf("Expected the fee to be read back, got %v", txn)
+	}
+	list, err := client.ListTransactions(ctx, &paymentpb.ListTransactionsRequest{UserId: "alice"})
+	if err != nil {
+		t.Fatalf("ListTransactions failed: %v", err)
+	}
+	var feeOf string
+	for _, txn := range list.GetTransactions() {
+		if txn.GetTransactionId() == "sys:fee:txn-1" {
+			feeOf = txn.GetFeeOf()
+		}
+	}
+	if feeOf != "txn-1" {
+		t.Errorf("Expected the fee entry to link to txn-1, got %v", list)
+	}
+
+	q, err = service.FX.NewQuote(ctx, "USD", -1)
+	if err != nil {
+		t.Fatalf("NewQuote failed: %v", err)
+	}
+	clock.advance(defaultQuoteTTL)
+	for _, tt := range []struct {
+		req  *paymentpb.ProcessPaymentRequest
+		code codes.Code
+	}{
+		{&paymentpb.ProcessPaymentRequest{UserId: "alice", Amount: -1, QuoteId: "quote-unknown", TransactionId: "txn-2"}, codes.NotFound},
+		{&paymentpb.ProcessPaymentRequest{UserId: "alice", Amount: -1, QuoteId: q.QuoteID, TransactionId: "txn-2"}, codes.FailedPrecondition},
+		{&paymentpb.ProcessPaymentRequest{UserId: "alice", Amount: -1, Currency: "GBP", TransactionId: "txn-2"}, codes.InvalidArgument},
+	} {
+		if _, err := client.ProcessPayment(ctx, tt.req); status.Code(err) != tt.code {
+			t.Errorf("%v: expected code %s, got %v", tt.req, tt.code, err)
+		}
+	}
+}
+
+func TestGRPCErrorCanceledIsUnavailable(t *testing.T) {
+	err := grpcError(fmt.Errorf("acquire lock: %w", context.Canceled))
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable, got %v", err)
+	}
+}
+
+func TestGRPCDeadlinePropagates(t *testing.T) {
+	service := NewPaymentService()
+	client := newGRPCClient(t, service)
+
+	service.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.ProcessPayment(ctx, &paymentpb.ProcessPaymentRequest{UserId: "user123", Amount: 10, TransactionId: "txn-001"})
+	service.mu.Unlock()
+
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// InterestExpenseAccount is the account interest is paid out of.
+const InterestExpenseAccount = systemPrefix + "interest-expense"
+
+// interestTransactionIDs returns the IDs of the credit of the user and the
+// debit of InterestExpenseAccount for the user's interest for month
+// (2006-01). A month's interest can only be posted once per user.
+func interestTransactionIDs(userID, month string) (credit, debit string) {
+	return systemPrefix + "interest:" + month + ":" + userID, systemPrefix + "interest-expense:" + month + ":" + userID
+}
+
+// DayCount is the day-count convention that turns an annual rate into a
+// daily one.
+type DayCount string
+
+const (
+	// DayCountActual365 divides the annual rate by 365, in leap years too.
+	DayCountActual365 DayCount = "act/365"
+	// DayCountActual360 divides the annual rate by 360, so a year of daily
+	// interest pays a little more than the annual rate.
+	DayCountActual360 DayCount = "act/360"
+	// DayCountActualActual divides the annual rate by the length of the
+	// day's year, 365 or 366.
+	DayCountActualActual DayCount = "act/act"
+)
+
+// yearDays returns the number of days the annual rate is spread over on day.
+func (dc DayCount) yearDays(day time.Time) float64 {
+	switch dc {
+	case DayCountActual360:
+		return 360
+	case DayCountActualActual:
+		return float64(time.Date(day.Year(), 12, 31, 0, 0, 0, 0, time.UTC).YearDay())
+	default:
+		return 365
+	}
+}
+
+// InterestSchedule pays AnnualRate percent a year on positive balances. An
+// empty DayCount means act/365.
+type InterestSchedule struct {
+	AnnualRate float64  `json:"annualRate"`
+	DayCount   DayCount `json:"dayCount,omitempty"`
+}
+
+func (is InterestSchedule) validate() error {
+	if is.AnnualRate < 0 {
+		return errors.New("annualRate can't be negative")
+	}
+	switch is.DayCount {
+	case "", DayCountActual365, DayCountActual360, DayCountActualActual:
+		return nil
+	}
+	return fmt.Errorf("unknown dayCount %q, want act/365, act/360 or act/act", is.DayCount)
+}
+
+// InterestEngine picks the interest schedule of a user's tier.
+type InterestEngine struct {
+	DefaultTier string                      `json:"defaultTier"`
+	Tiers       map[string]InterestSchedule `json:"tiers"`
+	Users       map[string]string           `json:"users"`
+}
+
+// LoadInterestEngine reads a JSON interest configuration:
+//
+//	{"tiers": {"savings": {"annualRate": 2.5, "dayCount": "act/365"}},
+//	 "users": {"user123": "savings"}}
+//
+// Without a defaultTier, only the listed users earn interest.
+func LoadInterestEngine(r io.Reader) (*InterestEngine, error) {
+	var e InterestEngine
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		return nil, fmt.Errorf("interest config: %w", err)
+	}
+	for name, schedule := range e.Tiers {
+		if err := schedule.validate(); err != nil {
+			return nil, fmt.Errorf("interest config: tier %s: %w", name, err)
+		}
+	}
+	if _, ok := e.Tiers[e.DefaultTier]; e.DefaultTier != "" && !ok {
+		return nil, fmt.Errorf("interest config: unknown default tier %q", e.DefaultTier)
+	}
+	for userID, tier := range e.Users {
+		if _, ok := e.Tiers[tier]; !ok {
+			return nil, fmt.Errorf("interest config: user %s has unknown tier %q", userID, tier)
+		}
+	}
+	return &e, nil
+}
+
+// tier returns the user's tier, or false if they earn no interest.
+func (e *InterestEngine) tier(userID string) (string, bool) {
+	if isSystemID(userID) {
+		return "", false
+	}
+	tier, ok := e.Users[userID]
+	if !ok {
+		tier = e.DefaultTier
+	}
+	_, ok = e.Tiers[tier]
+	return tier, ok
+}
+
+// Accrual statuses.
+const (
+	accrualPending = "pending"
+	accrualPosted  = "posted"
+	accrualExists  = "already posted"
+)
+
+// DailyAccrual is one day's interest on the balance at the end of the day,
+// before rounding.
+type DailyAccrual struct {
+	Date     string  `json:"date"`
+	Balance  float64 `json:"balance"`
+	Interest float64 `json:"interest"`
+}
+
+// InterestAccrual is a user's interest for one month: the sum of the daily
+// accruals, rounded half away from zero to the cent.
+type InterestAccrual struct {
+	UserID        string         `json:"userID"`
+	Tier          string         `json:"tier"`
+	Interest      float64        `json:"interest"`
+	TransactionID string         `json:"transactionID"`
+	Status        string         `json:"status"`
+	Days          []DailyAccrual `json:"days,omitempty"`
+}
+
+// InterestReport lists the accounts that earned interest in Month.
+type InterestReport struct {
+	Month    string            `json:"month"`
+	Posted   int               `json:"posted"`
+	Accruals []InterestAccrual `json:"accruals"`
+}
+
+var errInterestDisabled = fmt.Errorf("%w: interest is not configured", ErrInvalidRequest)
+
+// AccrueInterest computes the interest earned in the UTC month containing
+// month from the balance at the end of each day, and with post set credits
+// it to each account as of now, debiting InterestExpenseAccount. Months that
+// haven't ended are rejected. Posting is idempotent: an account whose
+// interest for the month is already posted is reported as such and left
+// alone, so running it again after a partial failure is safe. The accruals
+// are computed under the read lock; the write lock is only taken to post.
+func (s *PaymentService) AccrueInterest(ctx context.Context, month time.Time, post bool) (*InterestReport, error) {
+	if s.Interest == nil {
+		return nil, errInterestDisabled
+	}
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	label := from.Format("2006-01")
+	if to.After(s.now()) {
+		return nil, fmt.Errorf("%w: month %s hasn't ended", ErrInvalidRequest, label)
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(s.balances))
+	for userID := range s.balances {
+		if _, ok := s.Interest.tier(userID); ok {
+			users = append(users, userID)
+		}
+	}
+	sort.Strings(users)
+
+	report := &InterestReport{Month: label, Accruals: []InterestAccrual{}}
+	for _, userID := range users {
+		tier, _ := s.Interest.tier(userID)
+		creditID, _ := interestTransactionIDs(userID, label)
+		if existing, ok := s.transactions[creditID]; ok {
+			report.Accruals = append(report.Accruals, InterestAccrual{
+				UserID: userID, Tier: tier, Interest: existing.Amount, TransactionID: creditID, Status: accrualExists,
+			})
+			continue
+		}
+		accrual := s.accrue(userID, tier, from, to)
+		accrual.TransactionID = creditID
+		if accrual.Interest != 0 {
+			report.Accruals = append(report.Accruals, accrual)
+		}
+	}
+	s.mu.RUnlock()
+	if !post {
+		return report, nil
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	for i := range report.Accruals {
+		accrual := &report.Accruals[i]
+		if accrual.Status != accrualPending {
+			continue
+		}
+		// Another run may have posted it since the read lock was released.
+		if existing, ok := s.transactions[accrual.TransactionID]; ok {
+			accrual.Interest = existing.Amount
+			accrual.Status = accrualExists
+			continue
+		}
+		_, debitID := interestTransactionIDs(accrual.UserID, label)
+		s.postInterest(accrual.UserID, label, accrual.TransactionID, debitID, accrual.Interest)
+		accrual.Status = accrualPosted
+		report.Posted++
+	}
+	return report, nil
+}
+
+// accrue sums the user's daily interest in [from, to). Must be called with
+// s.mu held, for reading at least.
+func (s *PaymentService) accrue(userID, tier string, from, to time.Time) InterestAccrual {
+	schedule := s.Interest.Tiers[tier]
+	accrual := InterestAccrual{UserID: userID, Tier: tier, Status: accrualPending}
+	var total float64
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		balance, _ := s.balanceAt(userID, day.AddDate(0, 0, 1).Add(-time.Nanosecond))
+		daily := DailyAccrual{Date: day.Format(time.DateOnly), Balance: balance}
+		if balance > 0 {
+			daily.Interest = balance * schedule.AnnualRate / 100 / schedule.DayCount.yearDays(day)
+		}
+		total += daily.Interest
+		accrual.Days = append(accrual.Days, daily)
+	}
+	accrual.Interest = roundCents(total)
+	return accrual
+}
+
+// postInterest credits the user with interest and debits
+// InterestExpenseAccount. Must be called with s.mu held.
+func (s *PaymentService) postInterest(userID, month, creditID, debitID string, interest float64) {
+	now := s.now()
+	balance := s.balances[userID] + interest
+	s.balances[userID] = balance
+	s.record(&Transaction{
+		TransactionID: creditID,
+		UserID:        userID,
+		Amount:        interest,
+		Status:        "success",
+		InterestFor:   month,
+		ProcessedAt:   now,
+	}, balance)
+
+	expense := s.balances[InterestExpenseAccount] - interest
+	s.balances[InterestExpenseAccount] = expense
+	s.record(&Transaction{
+		TransactionID: debitID,
+		UserID:        InterestExpenseAccount,
+		Amount:        -interest,
+		Status:        "success",
+		InterestFor:   month,
+		ProcessedAt:   now,
+	}, expense)
+
+	s.hub.publish(userID, creditID, interest, balance, now)
+}
+
+// RunInterest posts the previous month's interest now and then every
+// interval until ctx is done. Once a month has been posted it isn't
+// recomputed on later ticks, only when the next month ends; a failed run is
+// retried on the next tick.
+func (s *PaymentService) RunInterest(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var done string
+	for {
+		if month := previousMonth(s.now()); month.Format("2006-01") != done {
+			report, err := s.AccrueInterest(ctx, month, true)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				slog.ErrorContext(ctx, "interest accrual failed", "error", err)
+			case err == nil:
+				done = report.Month
+				if report.Posted > 0 {
+					slog.InfoContext(ctx, "interest posted", "month", report.Month, "accounts", report.Posted)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// previousMonth returns a time in the UTC month before t's.
+func previousMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return t.AddDate(0, 0, -t.Day())
+}
+
+// HandleInterest serves /admin/interest?month=2006-01, the previous month
+// by default. GET previews the month's accruals; POST posts them.
+func (s *PaymentService) HandleInterest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	month := previousMonth(s.now())
+	if v := r.URL.Query().Get("month"); v != "" {
+		var err error
+		if month, err = time.Parse("2006-01", v); err != nil {
+			writeError(w, fmt.Errorf("%w: invalid month %q", ErrInvalidRequest, v))
+			return
+		}
+	}
+	report, err := s.AccrueInterest(r.Context(), month, r.Method == http.MethodPost)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
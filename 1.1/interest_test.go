@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Both tiers accrue 0.01% a day: 3.65/365 and 3.6/360.
+const interestConfig = `{
+	"tiers": {
+		"savings": {"annualRate": 3.65},
+		"business": {"annualRate": 3.6, "dayCount": "act/360"}
+	},
+	"users": {"alice": "savings", "bob": "savings", "dave": "business"}
+}`
+
+// newInterestService starts on Jan 1 2024. Alice holds 1000 until she pays
+// in another 1000 at noon on Jan 16, bob's balance is set below zero, dave
+// holds 500 all month and carol has no tier.
+func newInterestService(t *testing.T) (*PaymentService, *fakeClock) {
+	t.Helper()
+	service, clock := newClockedService()
+	engine, err := LoadInterestEngine(strings.NewReader(interestConfig))
+	if err != nil {
+		t.Fatalf("LoadInterestEngine failed: %v", err)
+	}
+	service.Interest = engine
+	ctx := context.Background()
+	for _, req := range []PaymentRequest{
+		{UserID: "alice", Amount: 1000, TransactionID: "txn-1"},
+		{UserID: "dave", Amount: 500, TransactionID: "txn-2"},
+		{UserID: "carol", Amount: 500, TransactionID: "txn-3"},
+	} {
+		if _, err := service.ProcessPayment(ctx, req); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+	}
+	service.SetBalance(ctx, "bob", -50)
+	clock.t = time.Date(2024, 1, 16, 12, 0, 0, 0, time.UTC)
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1000, TransactionID: "txn-4"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	return service, clock
+}
+
+func TestLoadInterestEngineRejectsBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`{"tiers": {"t": {"annualRate": -1}}}`,
+		`{"tiers": {"t": {"annualRate": 1, "dayCount": "30/360"}}}`,
+		`{"defaultTier": "gold", "tiers": {}}`,
+		`{"tiers": {}, "users": {"alice": "gold"}}`,
+		`{"tiers": {"t": {"rate": 1}}}`,
+	} {
+		if _, err := LoadInterestEngine(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected an error for %s", config)
+		}
+	}
+}
+
+func TestDayCount(t *testing.T) {
+	leap, plain := time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		dc   DayCount
+		day  time.Time
+		want float64
+	}{
+		{DayCountActual365, leap, 365},
+		{DayCountActual360, leap, 360},
+		{DayCountActualActual, leap, 366},
+		{DayCountActualActual, plain, 365},
+		{"", leap, 365},
+	} {
+		if got := tt.dc.yearDays(tt.day); got != tt.want {
+			t.Errorf("%q on %s: expected %g days, got %g", tt.dc, tt.day.Format(time.DateOnly), tt.want, got)
+		}
+	}
+}
+
+func TestAccrueInterest(t *testing.T) {
+	service, clock := newInterestService(t)
+	ctx := context.Background()
+	january := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if _, err := service.AccrueInterest(ctx, january, true); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected January to be rejected before it ends, got %v", err)
+	}
+
+	clock.t = time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC)
+	preview, err := service.AccrueInterest(ctx, january, false)
+	if err != nil {
+		t.Fatalf("AccrueInterest failed: %v", err)
+	}
+	// Alice: 15 days on 1000 and 16 on 2000. Dave: 31 days on 500. Bob is
+	// overdrawn and carol has no tier, so neither earns anything.
+	want := map[string]float64{"alice": 4.7, "dave": 1.55}
+	if len(preview.Accruals) != 2 || preview.Posted != 0 {
+		t.Fatalf("Unexpected preview %+v", preview)
+	}
+	for _, a := range preview.Accruals {
+		if a.Interest != want[a.UserID] || a.Status != accrualPending || len(a.Days) != 31 {
+			t.Errorf("Unexpected accrual %+v", a)
+		}
+	}
+	if day := preview.Accruals[0].Days[15]; day.Date != "2024-01-16" || day.Balance != 2000 {
+		t.Errorf("Expected alice's end of day balance on Jan 16 to be 2000, got %+v", day)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 2000 {
+		t.Errorf("Expected the preview not to post, got balance %.2f", balance)
+	}
+
+	report, err := service.AccrueInterest(ctx, january, true)
+	if err != nil || report.Posted != 2 {
+		t.Fatalf("Unexpected report %+v, %v", report, err)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 2004.7 {
+		t.Errorf("Expected alice's balance 2004.70, got %.2f", balance)
+	}
+	if expense := balanceOf(t, service, InterestExpenseAccount); expense != -6.25 {
+		t.Errorf("Expected interest expense -6.25, got %.2f", expense)
+	}
+	txn, err := service.GetTransaction(ctx, "sys:interest:2024-01:alice")
+	if err != nil || txn.InterestFor != "2024-01" || !txn.ProcessedAt.Equal(clock.t) {
+		t.Errorf("Unexpected interest transaction %+v, %v", txn, err)
+	}
+
+	// Running again, e.g. on the next tick, posts nothing more.
+	clock.advance(time.Hour)
+	again, err := service.AccrueInterest(ctx, january, true)
+	if err != nil || again.Posted != 0 || len(again.Accruals) != 2 || again.Accruals[0].Status != accrualExists || again.Accruals[0].Interest != 4.7 {
+		t.Errorf("Unexpected rerun %+v, %v", again, err)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 2004.7 {
+		t.Errorf("Expected the rerun not to post again, got balance %.2f", balance)
+	}
+
+	from, to, _ := StatementPeriod("month", "2024-02")
+	st, err := service.Statement(ctx, "alice", from, to)
+	if err != nil || len(st.Postings) != 1 || st.Postings[0].Type != postingInterest {
+		t.Errorf("Expected an interest posting on alice's statement, got %+v, %v", st, err)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -4.7, TransactionID: "txn-5", RefundOf: "sys:interest:2024-01:alice"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected refunding interest to be rejected, got %v", err)
+	}
+}
+
+func TestAccrueInterestRoundsHalfCentUp(t *testing.T) {
+	service, clock := newClockedService()
+	engine, err := LoadInterestEngine(strings.NewReader(interestConfig))
+	if err != nil {
+		t.Fatalf("LoadInterestEngine failed: %v", err)
+	}
+	service.Interest = engine
+	ctx := context.Background()
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "dave", Amount: 215, TransactionID: "txn-1"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	clock.t = time.Date(2024, 5, 1, 1, 0, 0, 0, time.UTC)
+
+	// 30 days of 0.01% on 215 is exactly 0.645, which sums to
+	// 0.6449999999999999 in floating point.
+	report, err := service.AccrueInterest(ctx, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), false)
+	if err != nil {
+		t.Fatalf("AccrueInterest failed: %v", err)
+	}
+	if len(report.Accruals) != 1 || report.Accruals[0].Interest != 0.65 {
+		t.Errorf("Expected dave to accrue 0.65, got %+v", report.Accruals)
+	}
+}
+
+func TestAccrueInterestConcurrentRunsPostOnce(t *testing.T) {
+	service, clock := newInterestService(t)
+	clock.t = time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC)
+	january := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	posted := make([]int, 4)
+	for i := range posted {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report, err := service.AccrueInterest(context.Background(), january, true)
+			if err != nil {
+				t.Errorf("AccrueInterest failed: %v", err)
+				return
+			}
+			posted[i] = report.Posted
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range posted {
+		total += n
+	}
+	if total != 2 {
+		t.Errorf("Expected 2 accounts posted across all runs, got %d", total)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 2004.7 {
+		t.Errorf("Expected alice's balance 2004.70, got %.2f", balance)
+	}
+}
+
+func TestRunInterest(t *testing.T) {
+	service, clock := newInterestService(t)
+	clock.t = time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		service.RunInterest(ctx, time.Hour)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for balanceOf(t, service, "alice") != 2004.7 {
+		if time.Now().After(deadline) {
+			t.Fatal("RunInterest didn't post January's interest")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestHandleInterest(t *testing.T) {
+	service, clock := newInterestService(t)
+	clock.t = time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC)
+	handler := asAdmin(requireAdmin(service.HandleInterest))
+
+	// The month defaults to the previous one.
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/interest", nil))
+	var report InterestReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil || w.Code != http.StatusOK || report.Month != "2024-01" || report.Posted != 2 {
+		t.Fatalf("Unexpected response %d %+v %v", w.Code, report, err)
+	}
+
+	for _, target := range []string{"/admin/interest?month=2024-02", "/admin/interest?month=January"} {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	asAdmin(requireAdmin(NewPaymentService().HandleInterest))(w, httptest.NewRequest(http.MethodGet, "/admin/interest", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without an interest config, got %d", w.Code)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const importCSV = `userID,amount,transactionID,refundOf
+alice,100,imp-1,
+alice,-30,imp-2,
+bob,-50,imp-3,
+alice,ten,imp-4,
+alice,30,imp-5,imp-2
+`
+
+func TestImportCSV(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+
+	report, err := service.Import(ctx, strings.NewReader(importCSV), FormatCSV, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if report.Total != 5 || report.Applied != 3 || report.Declined != 1 || report.Invalid != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if len(report.Rows) != 2 || report.Rows[0].Line != 4 || report.Rows[0].Result != importDeclined || report.Rows[1].Line != 5 {
+		t.Errorf("Expected the declined and invalid rows to be listed with their lines, got %+v", report.Rows)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 100 {
+		t.Errorf("Expected alice's balance 100, got %.2f", balance)
+	}
+
+	// Re-running the import must not apply anything twice.
+	report, err = service.Import(ctx, strings.NewReader(importCSV), FormatCSV, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if report.Applied != 0 || report.Duplicates != 3 {
+		t.Errorf("Expected 3 duplicates on re-import, got %+v", report)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 100 {
+		t.Errorf("Expected alice's balance to stay 100, got %.2f", balance)
+	}
+}
+
+func TestImportDryRunPredictsImport(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	service.SetBalance(ctx, "bob", 20)
+
+	dryRun, err := service.Import(ctx, strings.NewReader(importCSV), FormatCSV, true)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(service.journal) != 0 || balanceOf(t, service, "alice") != 0 {
+		t.Fatal("A dry run must not apply payments")
+	}
+
+	report, err := service.Import(ctx, strings.NewReader(importCSV), FormatCSV, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	dryRun.DryRun = false
+	got, _ := json.Marshal(dryRun)
+	want, _ := json.Marshal(report)
+	if string(got) != string(want) {
+		t.Errorf("Dry run report\n%s\ndoesn't match the import\n%s", got, want)
+	}
+}
+
+func TestImportCSVConverts(t *testing.T) {
+	csvFile := `userID,amount,transactionID,currency
+alice,100,fx-1,USD
+alice,5,fx-2,EUR
+alice,100,fx-1,USD
+alice,100,fx-2,USD
+alice,1,fx-3,GBP
+`
+	service, _, _ := newFXService()
+	ctx := context.Background()
+	dryRun, err := service.Import(ctx, strings.NewReader(csvFile), FormatCSV, true)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	report, err := service.Import(ctx, strings.NewReader(csvFile), FormatCSV, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	// A retried USD payment is a duplicate, even though it was booked as 92 EUR.
+	if report.Applied != 2 || report.Duplicates != 1 || report.Invalid != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 97 {
+		t.Errorf("Expected alice's balance 97, got %.2f", balance)
+	}
+	dryRun.DryRun = false
+	got, _ := json.Marshal(dryRun)
+	want, _ := json.Marshal(report)
+	if string(got) != string(want) {
+		t.Errorf("Dry run report\n%s\ndoesn't match the import\n%s", got, want)
+	}
+
+	report, err = service.Import(ctx, strings.NewReader(csvFile), FormatCSV, false)
+	if err != nil || report.Duplicates != 3 || report.Invalid != 2 {
+		t.Errorf("Expected both payments to be duplicates on re-import, got %+v, %v", report, err)
+	}
+}
+
+func TestImportJSONL(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	service.SetBalance(ctx, "alice", 50)
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -10, TransactionID: "txn-1"})
+
+	jsonl := `{"userID": "alice", "amount": -5, "transactionID": "txn-2"}
+
+{"userID": "alice", "amount": -10, "transactionID": "txn-1"}
+{"userID": "bob", "amount": -10, "transactionID": "txn-1"}
+{"userID": "alice", "amount": -1, "txnID": "typo"}
+{"userID": "alice",
+`
+	report, err := service.Import(ctx, strings.NewReader(jsonl), FormatJSONL, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if report.Applied != 1 || report.Duplicates != 1 || report.Invalid != 3 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if report.Rows[1].Line != 4 || !strings.Contains(report.Rows[1].Error, "already used") {
+		t.Errorf("A reused transactionID with a different payment should be invalid, got %+v", report.Rows[1])
+	}
+}
+
+func TestImportRejectsBadHeader(t *testing.T) {
+	service := NewPaymentService()
+	if _, err := service.Import(context.Background(), strings.NewReader("user,amount\nalice,10\n"), FormatCSV, false); err == nil {
+		t.Error("Expected an error for a CSV without the required columns")
+	}
+}
+
+func TestExportTransactions(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := 2*exportPageSize + 10
+	for i := 0; i < n; i++ {
+		service.ProcessPayment(ctx, PaymentRequest{UserID: fmt.Sprintf("user-%d", i%3), Amount: 1, TransactionID: fmt.Sprintf("txn-%04d", i)})
+		service.journal[i].ProcessedAt = start.Add(time.Duration(i) * time.Minute)
+	}
+
+	var out strings.Builder
+	from, to := start.Add(100*time.Minute), start.Add(time.Duration(n-5)*time.Minute)
+	if err := service.ExportTransactions(ctx, &out, FormatCSV, from, to); err != nil {
+		t.Fatalf("ExportTransactions failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if lines[0] != "transactionID,userID,amount,status,refundOf,processedAt,currency,originalAmount,rate,quoteID,fee,feeOf,interestFor" {
+		t.Errorf("Unexpected header %q", lines[0])
+	}
+	if len(lines)-1 != n-105 {
+		t.Fatalf("Expected %d transactions, got %d", n-105, len(lines)-1)
+	}
+	if lines[1] != "txn-0100,user-1,1,success,,2024-01-01T01:40:00Z,,,,,,," {
+		t.Errorf("Unexpected first record %q", lines[1])
+	}
+
+	out.Reset()
+	if err := service.ExportTransactions(ctx, &out, FormatJSONL, time.Time{}, start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("ExportTransactions failed: %v", err)
+	}
+	want := `{"transactionID":"txn-0000","userID":"user-0","amount":1,"status":"success","processedAt":"2024-01-01T00:00:00Z"}
+{"transactionID":"txn-0001","userID":"user-1","amount":1,"status":"success","processedAt":"2024-01-01T00:01:00Z"}
+`
+	if out.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestExportTransactionsConverted(t *testing.T) {
+	service, clock, _ := newFXService()
+	ctx := context.Background()
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 100, Currency: "USD", TransactionID: "fx-1"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	q, err := service.FX.NewQuote(ctx, "USD", -10.55)
+	if err != nil {
+		t.Fatalf("NewQuote failed: %v", err)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -10.55, QuoteID: q.QuoteID, TransactionID: "fx-2"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+
+	var out strings.Builder
+	if err := service.ExportTransactions(ctx, &out, FormatCSV, time.Time{}, time.Time{}); err != nil {
+		t.Fatalf("ExportTransactions failed: %v", err)
+	}
+	processedAt := clock.now().Format(time.RFC3339Nano)
+	want := "transactionID,userID,amount,status,refundOf,processedAt,currency,originalAmount,rate,quoteID,fee,feeOf,interestFor\n" +
+		"fx-1,alice,92,success,," + processedAt + ",USD,100,0.92,,,,\n" +
+		"fx-2,alice,-9.71,success,," + processedAt + ",USD,-10.55,0.92," + q.QuoteID + ",,,\n"
+	if out.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source, clock, _ := newFXService()
+	source.Fees = newFeeEngine(t)
+	engine, err := LoadInterestEngine(strings.NewReader(interestConfig))
+	if err != nil {
+		t.Fatalf("LoadInterestEngine failed: %v", err)
+	}
+	source.Interest = engine
+	ctx := context.Background()
+	q, err := source.FX.NewQuote(ctx, "USD", -20)
+	if err != nil {
+		t.Fatalf("NewQuote failed: %v", err)
+	}
+	for _, req := range []PaymentRequest{
+		{UserID: "alice", Amount: 1000, TransactionID: "txn-1"},
+		{UserID: "alice", Amount: -50, TransactionID: "txn-2"},
+		{UserID: "alice", Amount: 20, RefundOf: "txn-2", TransactionID: "txn-3"},
+		{UserID: "bob", Amount: 100, Currency: "USD", TransactionID: "txn-4"},
+		{UserID: "bob", Amount: -20, QuoteID: q.QuoteID, TransactionID: "txn-5"},
+	} {
+		if _, err := source.ProcessPayment(ctx, req); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+	}
+	clock.t = time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC)
+	if _, err := source.AccrueInterest(ctx, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true); err != nil {
+		t.Fatalf("AccrueInterest failed: %v", err)
+	}
+	var balances strings.Builder
+	if err := source.ExportBalances(ctx, &balances, FormatCSV); err != nil {
+		t.Fatalf("ExportBalances failed: %v", err)
+	}
+
+	for _, format := range []LedgerFormat{FormatCSV, FormatJSONL} {
+		t.Run(string(format), func(t *testing.T) {
+			var exported strings.Builder
+			if err := source.ExportTransactions(ctx, &exported, format, time.Time{}, time.Time{}); err != nil {
+				t.Fatalf("ExportTransactions failed: %v", err)
+			}
+			// Today's rate and fees differ from those the ledger was booked with.
+			target, _, rates := newFXService()
+			rates["USD/EUR"] = 0.5
+
+			dryRun, err := target.Import(ctx, strings.NewReader(exported.String()), format, true)
+			if err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			report, err := target.Import(ctx, strings.NewReader(exported.String()), format, false)
+			if err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			// Five payments and two interest credits; four fee and two
+			// interest expense entries come with them.
+			if report.Applied != 7 || report.Skipped != 6 || report.Total != 13 {
+				t.Errorf("Unexpected report %+v", report)
+			}
+			dryRun.DryRun = false
+			got, _ := json.Marshal(dryRun)
+			want, _ := json.Marshal(report)
+			if string(got) != string(want) {
+				t.Errorf("Dry run report\n%s\ndoesn't match the import\n%s", got, want)
+			}
+
+			var imported strings.Builder
+			if err := target.ExportBalances(ctx, &imported, FormatCSV); err != nil {
+				t.Fatalf("ExportBalances failed: %v", err)
+			}
+			if imported.String() != balances.String() {
+				t.Errorf("Expected balances\n%s\ngot\n%s", balances.String(), imported.String())
+			}
+			for _, id := range []string{"txn-4", "txn-5"} {
+				want, _ := source.GetTransaction(ctx, id)
+				got, err := target.GetTransaction(ctx, id)
+				if err != nil || *got.Conversion != *want.Conversion || got.Amount != want.Amount {
+					t.Errorf("Expected %s booked as %+v, got %+v, %v", id, want, got, err)
+				}
+			}
+
+			report, err = target.Import(ctx, strings.NewReader(exported.String()), format, false)
+			if err != nil || report.Applied != 0 || report.Duplicates != 7 || report.Skipped != 6 {
+				t.Errorf("Expected a re-import to apply nothing, got %+v, %v", report, err)
+			}
+		})
+	}
+}
+
+// paymentWriter makes a payment on every write, which deadlocks if the
+// export holds the service lock while writing.
+type paymentWriter struct {
+	t       *testing.T
+	service *PaymentService
+	writes  int
+}
+
+func (w *paymentWriter) Write(p []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	w.writes++
+	if _, err := w.service.ProcessPayment(ctx, PaymentRequest{UserID: "writer", Amount: 1, TransactionID: fmt.Sprintf("during-export-%d", w.writes)}); err != nil {
+		w.t.Errorf("Payment during export failed: %v", err)
+	}
+	return len(p), nil
+}
+
+func TestExportDoesNotBlockPayments(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	for i := 0; i < exportPageSize+1; i++ {
+		service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1, TransactionID: fmt.Sprintf("txn-%d", i)})
+	}
+
+	w := &paymentWriter{t: t, service: service}
+	if err := service.ExportTransactions(ctx, w, FormatJSONL, time.Time{}, time.Time{}); err != nil {
+		t.Fatalf("ExportTransactions failed: %v", err)
+	}
+	if err := service.ExportBalances(ctx, w, FormatCSV); err != nil {
+		t.Fatalf("ExportBalances failed: %v", err)
+	}
+	if w.writes == 0 {
+		t.Fatal("Expected the export to write")
+	}
+}
+
+// restoreWriter restores snapshot into service on the first write.
+type restoreWriter struct {
+	t        *testing.T
+	service  *PaymentService
+	snapshot string
+	restored bool
+}
+
+func (w *restoreWriter) Write(p []byte) (int, error) {
+	if !w.restored {
+		w.restored = true
+		if _, err := w.service.RestoreSnapshot(context.Background(), strings.NewReader(w.snapshot)); err != nil {
+			w.t.Errorf("RestoreSnapshot failed: %v", err)
+		}
+	}
+	return len(p), nil
+}
+
+func TestExportSurvivesRestore(t *testing.T) {
+	var empty strings.Builder
+	if _, err := NewPaymentService().WriteSnapshot(context.Background(), &empty); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	service := NewPaymentService()
+	ctx := context.Background()
+	for i := 0; i < 2*exportPageSize+1; i++ {
+		service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 1, TransactionID: fmt.Sprintf("txn-%d", i)})
+	}
+
+	// The export keeps paging over the journal it started with.
+	var out strings.Builder
+	w := &restoreWriter{t: t, service: service, snapshot: empty.String()}
+	if err := service.ExportTransactions(ctx, io.MultiWriter(w, &out), FormatJSONL, time.Time{}, time.Time{}); err != nil {
+		t.Fatalf("ExportTransactions failed: %v", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 2*exportPageSize+1 {
+		t.Errorf("Expected %d transactions, got %d", 2*exportPageSize+1, n)
+	}
+}
+
+func TestExportBalances(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	service.SetBalance(ctx, "bob", 20.5)
+	service.SetBalance(ctx, "alice", 100)
+
+	var out strings.Builder
+	if err := service.ExportBalances(ctx, &out, FormatCSV); err != nil {
+		t.Fatalf("ExportBalances failed: %v", err)
+	}
+	if want := "userID,balance\nalice,100\nbob,20.5\n"; out.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestHandleImportAndExport(t *testing.T) {
+	service := NewPaymentService()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/import", asAdmin(requireAdmin(service.HandleImport)))
+	mux.HandleFunc("/admin/export/{kind}", asAdmin(requireAdmin(service.HandleExport)))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/import?format=csv", strings.NewReader(importCSV)))
+	var report ImportReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil || w.Code != http.StatusOK || report.Applied != 3 {
+		t.Fatalf("Unexpected import response %d %+v %v", w.Code, report, err)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/export/balances?format=jsonl", nil))
+	if w.Header().Get("Content-Type") != "application/x-ndjson" || !strings.Contains(w.Body.String(), `{"userID":"alice","balance":100}`) {
+		t.Errorf("Unexpected balances export %q", w.Body.String())
+	}
+
+	for _, target := range []string{"/admin/export/transactions?format=xml", "/admin/export/transactions?from=yesterday", "/admin/import?format=xml"} {
+		method := http.MethodGet
+		if strings.HasPrefix(target, "/admin/import") {
+			method = http.MethodPost
+		}
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader("")))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/export/secrets", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown export, got %d", w.Code)
+	}
+}
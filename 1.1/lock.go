@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// lock acquires the write lock unless ctx is done first, and records how long
+// it waited.
+func (s *PaymentService) lock(ctx context.Context) error {
+	start := time.Now()
+	err := acquire(ctx, s.mu.TryLock, s.mu.Lock, s.mu.Unlock)
+	s.metrics.lockWait.WithLabelValues("write").Observe(time.Since(start).Seconds())
+	return err
+}
+
+// rlock acquires the read lock unless ctx is done first, and records how long
+// it waited.
+func (s *PaymentService) rlock(ctx context.Context) error {
+	start := time.Now()
+	err := acquire(ctx, s.mu.TryRLock, s.mu.RLock, s.mu.RUnlock)
+	s.metrics.lockWait.WithLabelValues("read").Observe(time.Since(start).Seconds())
+	return err
+}
+
+// acquire makes a sync.RWMutex acquisition cancellable. The mutex itself can't
+// be interrupted, so a contended acquisition runs in a goroutine; if ctx wins,
+// that goroutine releases the lock as soon as it gets it.
+func acquire(ctx context.Context, tryLock func() bool, lock, unlock func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tryLock() {
+		return nil
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
@@ -1,20 +1,53 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"sgh-assignment/pkg/health"
+	"sgh-assignment/pkg/logging"
+	"sgh-assignment/pkg/ratelimit"
+	"sgh-assignment/pkg/server"
+	"sgh-assignment/pkg/signing"
+	"sgh-assignment/pkg/tracing"
+)
+
+const defaultRequestTimeout = 5 * time.Second
+
+var (
+	ErrInvalidRequest      = errors.New("invalid request")
+	ErrInsufficientFunds   = errors.New("insufficient funds")
+	ErrTransactionNotFound = errors.New("transaction not found")
 )
 
 type PaymentRequest struct {
 	UserID        string  `json:"userID"`
 	Amount        float64 `json:"amount"`
 	TransactionID string  `json:"transactionID"`
+	RefundOf      string  `json:"refundOf,omitempty"`
+	// Currency is the currency of Amount when it isn't the ledger currency.
+	// QuoteID books the payment at the rate of a quote from POST /quotes.
+	Currency string `json:"currency,omitempty"`
+	QuoteID  string `json:"quoteID,omitempty"`
+
+	// booking is set for transactions imported from an exported ledger,
+	// which are booked as they were the first time.
+	booking *booking
 }
 
 type PaymentResponse struct {
@@ -25,50 +58,159 @@ type PaymentResponse struct {
 	Status        string    `json:"status"`
 	Message       string    `json:"message"`
 	ProcessedAt   time.Time `json:"processedAt"`
+	// Fee is charged on top of Amount, nil if the payment is free.
+	Fee *FeeBreakdown `json:"fee,omitempty"`
+	// Conversion is set when the payment was made in another currency;
+	// Amount is then in the ledger currency.
+	Conversion *Conversion `json:"conversion,omitempty"`
 }
 
 type Transaction struct {
-	TransactionID string
-	UserID        string
-	Amount        float64
-	Status        string
-	ProcessedAt   time.Time
+	TransactionID string    `json:"transactionID"`
+	UserID        string    `json:"userID"`
+	Amount        float64   `json:"amount"`
+	Status        string    `json:"status"`
+	RefundOf      string    `json:"refundOf,omitempty"`
+	ProcessedAt   time.Time `json:"processedAt"`
+	// FeeOf links a fee entry to the payment it was charged on; Fee is set
+	// on that payment.
+	FeeOf      string        `json:"feeOf,omitempty"`
+	Fee        *FeeBreakdown `json:"fee,omitempty"`
+	Conversion *Conversion   `json:"conversion,omitempty"`
+	// InterestFor is the month (2006-01) an interest entry pays for.
+	InterestFor string `json:"interestFor,omitempty"`
 }
 
 type PaymentService struct {
 	mu           sync.RWMutex
 	transactions map[string]*Transaction
 	balances     map[string]float64
+	refunded     map[string]float64
+	history      map[string][]*Transaction
+	checkpoints  map[string][]balanceCheckpoint
+	outbox       *Outbox
+	hub          *BalanceHub
+	metrics      *Metrics
+
+	// journal holds every committed transaction in commit order. It is only
+	// appended to, so exports can page through it taking the lock per page.
+	journal []*Transaction
+
+	// RequestTimeout bounds how long HandlePayment lets a payment run,
+	// including the wait for the lock. Zero means no deadline.
+	RequestTimeout time.Duration
+
+	// SnapshotFile is where POST /admin/snapshot saves snapshots. Empty
+	// disables saving.
+	SnapshotFile string
+
+	// Fees prices debits. Nil charges no fees.
+	Fees *FeeEngine
+
+	// FX converts payments made in other currencies. Nil accepts payments
+	// in the ledger currency only.
+	FX *Converter
+
+	// Interest pays interest on positive balances. Nil pays none.
+	Interest *InterestEngine
+
+	now func() time.Time
 }
 
 func NewPaymentService() *PaymentService {
-	return &PaymentService{
+	s := &PaymentService{
 		transactions: make(map[string]*Transaction),
 		balances:     make(map[string]float64),
+		refunded:     make(map[string]float64),
+		history:      make(map[string][]*Transaction),
+		checkpoints:  make(map[string][]balanceCheckpoint),
+		outbox:       NewOutbox(),
+		hub:          NewBalanceHub(),
+		metrics:      NewMetrics(),
+
+		RequestTimeout: defaultRequestTimeout,
+		now:            time.Now,
 	}
+	s.registerGauges()
+	return s
 }
 
-func (s *PaymentService) ProcessPayment(req PaymentRequest) (*PaymentResponse, error) {
-	traceID := uuid.New().String()
-
+func validatePayment(req PaymentRequest) error {
 	if req.TransactionID == "" {
-		log.Printf("[%s] ERROR: transactionID is required", traceID)
-		return nil, fmt.Errorf("transactionID is required")
+		return fmt.Errorf("%w: transactionID is required", ErrInvalidRequest)
 	}
 	if req.UserID == "" {
-		log.Printf("[%s] ERROR: userID is required", traceID)
-		return nil, fmt.Errorf("userID is required")
+		return fmt.Errorf("%w: userID is required", ErrInvalidRequest)
+	}
+	if isSystemID(req.TransactionID) || isSystemID(req.UserID) {
+		return fmt.Errorf("%w: IDs starting with %s are reserved", ErrInvalidRequest, systemPrefix)
 	}
 	if req.Amount == 0 {
-		log.Printf("[%s] ERROR: amount cannot be zero", traceID)
-		return nil, fmt.Errorf("amount cannot be zero")
+		return fmt.Errorf("%w: amount cannot be zero", ErrInvalidRequest)
+	}
+	if b := req.booking; b != nil {
+		if b.amount == 0 {
+			return fmt.Errorf("%w: amount cannot be zero", ErrInvalidRequest)
+		}
+		if b.conversion != nil && !(b.conversion.Rate > 0) {
+			return fmt.Errorf("%w: rate must be positive", ErrInvalidRequest)
+		}
+		if b.fee != nil && !(b.fee.Total > 0) {
+			return fmt.Errorf("%w: fee must be positive", ErrInvalidRequest)
+		}
 	}
+	return nil
+}
+
+// ProcessPayment applies req to the user's balance. Log lines and the response
+// carry the context's trace ID; one is generated if it has none. If ctx is done
+// while waiting for the lock or before the balance change is committed, the
+// payment is not applied and ctx.Err() is returned (wrapped).
+func (s *PaymentService) ProcessPayment(ctx context.Context, req PaymentRequest) (*PaymentResponse, error) {
+	ctx, span := tracer().Start(ctx, "PaymentService.ProcessPayment", trace.WithAttributes(
+		attribute.String("payment.user_hash", hashUserID(req.UserID)),
+		attribute.String("payment.amount_sign", amountSign(req.Amount)),
+	))
+	defer span.End()
+
+	ctx, traceID := logging.EnsureTraceID(ctx)
+	logger := slog.With("transactionID", req.TransactionID, "userID", req.UserID)
 
-	s.mu.Lock()
+	_, validateSpan := tracer().Start(ctx, "validate")
+	err := validatePayment(req)
+	validateSpan.End()
+	if err != nil {
+		logger.WarnContext(ctx, "payment rejected", "error", err)
+		s.recordOutcome(span, outcomeInvalid, err)
+		return nil, err
+	}
+
+	// Rates may come from elsewhere, so fetch them before taking the lock.
+	conv, amount, err := s.FX.live(ctx, req)
+	if err != nil {
+		logger.WarnContext(ctx, "currency conversion failed", "currency", req.Currency, "error", err)
+		s.recordOutcome(span, outcomeInvalid, err)
+		return nil, err
+	}
+
+	_, lockSpan := tracer().Start(ctx, "lock.acquire")
+	err = s.lock(ctx)
+	lockSpan.End()
+	if err != nil {
+		logger.WarnContext(ctx, "payment abandoned while waiting for lock", "error", err)
+		s.recordOutcome(span, outcomeCanceled, err)
+		return nil, fmt.Errorf("acquire lock: %w", err)
+	}
 	defer s.mu.Unlock()
 
-	if existingTxn, exists := s.transactions[req.TransactionID]; exists {
-		log.Printf("[%s] IDEMPOTENT: Transaction %s already processed", traceID, req.TransactionID)
+	_, lookupSpan := tracer().Start(ctx, "idempotency.lookup")
+	existingTxn, exists := s.transactions[req.TransactionID]
+	lookupSpan.SetAttributes(attribute.Bool("payment.idempotent_hit", exists))
+	lookupSpan.End()
+	if exists {
+		logger.InfoContext(ctx, "transaction already processed, returning idempotent response")
+		s.metrics.idempotentHits.Inc()
+		span.SetAttributes(attribute.String("payment.outcome", "idempotent"))
 		return &PaymentResponse{
 			TraceID:       traceID,
 			TransactionID: existingTxn.TransactionID,
@@ -77,23 +219,71 @@ func (s *PaymentService) ProcessPayment(req PaymentRequest) (*PaymentResponse, e
 			Status:        existingTxn.Status,
 			Message:       "Transaction already processed (idempotent response)",
 			ProcessedAt:   existingTxn.ProcessedAt,
+			Fee:           existingTxn.Fee,
+			Conversion:    existingTxn.Conversion,
 		}, nil
 	}
 
+	if req.QuoteID != "" && req.booking == nil {
+		conv, amount, err = s.FX.quoted(req)
+		if err != nil {
+			logger.WarnContext(ctx, "quote rejected", "quoteID", req.QuoteID, "error", err)
+			s.recordOutcome(span, outcomeInvalid, err)
+			return nil, err
+		}
+	}
+	// From here on, amounts are in the ledger currency.
+	req.Amount = amount
+
+	if req.RefundOf != "" {
+		_, refundSpan := tracer().Start(ctx, "validate.refund")
+		err := s.validateRefund(req)
+		refundSpan.End()
+		if err != nil {
+			logger.WarnContext(ctx, "refund rejected", "refundOf", req.RefundOf, "error", err)
+			s.recordOutcome(span, outcomeInvalid, err)
+			return nil, err
+		}
+	}
+
 	balance, exists := s.balances[req.UserID]
 	if !exists {
 		// user doesn't exist, create new user with 0 balance
 		balance = 0
 		s.balances[req.UserID] = 0
 	}
+	fee := s.feeFor(req)
 	newBalance := balance + req.Amount
+	if fee != nil {
+		newBalance -= fee.Total
+	}
 
 	if newBalance < 0 {
-		log.Printf("[%s] ERROR: insufficient funds for user %s: balance=%.2f, amount=%.2f, resulting=%.2f",
-			traceID, req.UserID, balance, req.Amount, newBalance)
-		return nil, fmt.Errorf("insufficient funds: balance=%.2f, amount=%.2f, resulting=%.2f", balance, req.Amount, newBalance)
+		logger.WarnContext(ctx, "payment declined: insufficient funds",
+			"balance", balance, "amount", req.Amount, "resulting", newBalance)
+		err := insufficientFunds(balance, req.Amount, fee, newBalance)
+		s.emit(EventPaymentDeclined, &Transaction{
+			TransactionID: req.TransactionID,
+			UserID:        req.UserID,
+			Amount:        req.Amount,
+			Status:        "declined",
+			RefundOf:      req.RefundOf,
+			ProcessedAt:   s.now(),
+			Conversion:    conv,
+		}, balance, err.Error())
+		s.recordOutcome(span, outcomeDeclined, err)
+		return nil, err
+	}
+
+	// Last point at which the payment can be abandoned; past here the change is
+	// committed even if the caller goes away.
+	if err := ctx.Err(); err != nil {
+		logger.WarnContext(ctx, "payment abandoned before commit", "error", err)
+		s.recordOutcome(span, outcomeCanceled, err)
+		return nil, err
 	}
 
+	_, writeSpan := tracer().Start(ctx, "storage.write")
 	s.balances[req.UserID] = newBalance
 
 	txn := &Transaction{
@@ -101,17 +291,38 @@ func (s *PaymentService) ProcessPayment(req PaymentRequest) (*PaymentResponse, e
 		UserID:        req.UserID,
 		Amount:        req.Amount,
 		Status:        "success",
-		ProcessedAt:   time.Now(),
+		RefundOf:      req.RefundOf,
+		ProcessedAt:   s.now(),
+		Fee:           fee,
+		Conversion:    conv,
+	}
+	s.record(txn, balance+req.Amount)
+	s.FX.redeem(conv)
+	if fee != nil {
+		s.postFee(txn, fee, newBalance)
 	}
-	s.transactions[req.TransactionID] = txn
+
+	if txn.RefundOf != "" {
+		s.refunded[txn.RefundOf] += math.Abs(txn.Amount)
+		s.emit(EventRefundCreated, txn, newBalance, "")
+	} else {
+		s.emit(EventPaymentSucceeded, txn, newBalance, "")
+	}
+	writeSpan.End()
+
+	s.hub.publish(txn.UserID, txn.TransactionID, txn.Amount, balance+req.Amount, txn.ProcessedAt)
+	if fee != nil {
+		s.hub.publish(txn.UserID, fee.TransactionID, -fee.Total, newBalance, txn.ProcessedAt)
+	}
+	s.recordOutcome(span, outcomeSucceeded, nil)
 
 	operation := "deducted"
 	if req.Amount > 0 {
 		operation = "added"
 	}
 
-	log.Printf("[%s] SUCCESS: Processed payment %s for user %s, amount %.2f (%s), new balance %.2f",
-		traceID, req.TransactionID, req.UserID, req.Amount, operation, newBalance)
+	logger.InfoContext(ctx, "payment processed",
+		"amount", req.Amount, "operation", operation, "newBalance", newBalance)
 
 	return &PaymentResponse{
 		TraceID:       traceID,
@@ -121,33 +332,123 @@ func (s *PaymentService) ProcessPayment(req PaymentRequest) (*PaymentResponse, e
 		Status:        txn.Status,
 		Message:       "Payment processed successfully",
 		ProcessedAt:   txn.ProcessedAt,
+		Fee:           txn.Fee,
+		Conversion:    txn.Conversion,
 	}, nil
 }
 
-func (s *PaymentService) GetBalance(userID string) float64 {
-	s.mu.RLock()
+// record adds a committed transaction to the ledger; balance is the user's
+// balance right after it. Must be called with s.mu held.
+func (s *PaymentService) record(txn *Transaction, balance float64) {
+	s.transactions[txn.TransactionID] = txn
+	s.history[txn.UserID] = append(s.history[txn.UserID], txn)
+	s.journal = append(s.journal, txn)
+	s.maybeCheckpoint(txn.UserID, txn.ProcessedAt, balance)
+}
+
+// insufficientFunds describes a declined payment.
+func insufficientFunds(balance, amount float64, fee *FeeBreakdown, resulting float64) error {
+	if fee != nil {
+		return fmt.Errorf("%w: balance=%.2f, amount=%.2f, fee=%.2f, resulting=%.2f", ErrInsufficientFunds, balance, amount, fee.Total, resulting)
+	}
+	return fmt.Errorf("%w: balance=%.2f, amount=%.2f, resulting=%.2f", ErrInsufficientFunds, balance, amount, resulting)
+}
+
+// validateRefund checks a refund against the transaction it reverses.
+// Must be called with s.mu held.
+func (s *PaymentService) validateRefund(req PaymentRequest) error {
+	original, exists := s.transactions[req.RefundOf]
+	if !exists {
+		return fmt.Errorf("%w: refund target %s not found", ErrInvalidRequest, req.RefundOf)
+	}
+	if original.UserID != req.UserID {
+		return fmt.Errorf("%w: refund target %s belongs to another user", ErrInvalidRequest, req.RefundOf)
+	}
+	if original.RefundOf != "" {
+		return fmt.Errorf("%w: cannot refund refund %s", ErrInvalidRequest, req.RefundOf)
+	}
+	if isSystemID(original.TransactionID) {
+		return fmt.Errorf("%w: %s was posted by the service and is not refundable", ErrInvalidRequest, req.RefundOf)
+	}
+	if (original.Amount > 0) == (req.Amount > 0) {
+		return fmt.Errorf("%w: refund amount must have the opposite sign of the original amount", ErrInvalidRequest)
+	}
+	remaining := math.Abs(original.Amount) - s.refunded[req.RefundOf]
+	if math.Abs(req.Amount) > remaining {
+		return fmt.Errorf("%w: refund amount %.2f exceeds refundable amount %.2f", ErrInvalidRequest, math.Abs(req.Amount), remaining)
+	}
+	return nil
+}
+
+func (s *PaymentService) GetBalance(ctx context.Context, userID string) (float64, error) {
+	if err := s.rlock(ctx); err != nil {
+		return 0, err
+	}
 	defer s.mu.RUnlock()
-	return s.balances[userID]
+	return s.balances[userID], nil
 }
 
-func (s *PaymentService) SetBalance(userID string, balance float64) {
-	s.mu.Lock()
+// SetBalance sets the user's balance directly, outside of any transaction.
+// Balance streams see the change as a posting without a transactionID.
+func (s *PaymentService) SetBalance(ctx context.Context, userID string, balance float64) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
 	defer s.mu.Unlock()
+	now := s.now()
+	previous := s.balances[userID]
 	s.balances[userID] = balance
+	s.checkpoint(userID, now, balance)
+	s.hub.publish(userID, "", balance-previous, balance, now)
+	return nil
 }
 
-func (s *PaymentService) GetTransaction(transactionID string) (*Transaction, bool) {
-	s.mu.RLock()
+// GetTransaction returns ErrTransactionNotFound for an unknown transactionID.
+func (s *PaymentService) GetTransaction(ctx context.Context, transactionID string) (*Transaction, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
 	defer s.mu.RUnlock()
 	txn, exists := s.transactions[transactionID]
-	return txn, exists
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTransactionNotFound, transactionID)
+	}
+	return txn, nil
+}
+
+// Ping checks that the storage can be read, i.e. that the lock is not wedged.
+func (s *PaymentService) Ping(ctx context.Context) error {
+	if err := s.rlock(ctx); err != nil {
+		return fmt.Errorf("storage lock not acquired: %w", err)
+	}
+	s.mu.RUnlock()
+	return nil
+}
+
+// ListTransactions returns the user's successful transactions, oldest first.
+func (s *PaymentService) ListTransactions(ctx context.Context, userID string) ([]Transaction, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	txns := make([]Transaction, 0, len(s.history[userID]))
+	for _, txn := range s.history[userID] {
+		txns = append(txns, *txn)
+	}
+	return txns, nil
 }
 
 func (s *PaymentService) HandlePayment(w http.ResponseWriter, r *http.Request) {
-	traceID := uuid.New().String()
+	ctx, _ := logging.EnsureTraceID(r.Context())
+	if s.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.RequestTimeout)
+		defer cancel()
+	}
 
 	if r.Method != http.MethodPost {
-		log.Printf("[%s] ERROR: Method not allowed: %s", traceID, r.Method)
+		slog.WarnContext(ctx, "method not allowed", "method", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -155,17 +456,23 @@ func (s *PaymentService) HandlePayment(w http.ResponseWriter, r *http.Request) {
 	var req PaymentRequest
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&req); err != nil {
-		log.Printf("[%s] ERROR: Invalid request body: %v", traceID, err)
+		slog.WarnContext(ctx, "invalid request body", "error", err)
 		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("[%s] INFO: Received payment request for user %s, amount %.2f", traceID, req.UserID, req.Amount)
+	slog.InfoContext(ctx, "received payment request", "userID", req.UserID, "amount", req.Amount)
 
-	resp, err := s.ProcessPayment(req)
+	if err := authorizePayment(ctx, req); err != nil {
+		slog.WarnContext(ctx, "payment not authorized", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	resp, err := s.ProcessPayment(ctx, req)
 	if err != nil {
-		log.Printf("[%s] ERROR: Payment processing failed: %v", traceID, err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(ctx, "payment processing failed", "error", err)
+		writeError(w, err)
 		return
 	}
 
@@ -173,12 +480,381 @@ func (s *PaymentService) HandlePayment(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(resp); err != nil {
-		log.Printf("[%s] ERROR: Failed to encode response: %v", traceID, err)
+		slog.ErrorContext(ctx, "failed to encode response", "error", err)
+	}
+}
+
+// httpStatus maps a ProcessPayment or authorization error to a response
+// status. Running out of time is the server's fault, not the client's, so it
+// is not a 400.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrTransactionNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// ErrorCodeHeader carries a stable name for the error of a failed request,
+// so clients can tell e.g. insufficient funds from other 400s without
+// parsing the message.
+const ErrorCodeHeader = "X-Error-Code"
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return "unauthenticated"
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrTransactionNotFound):
+		return "not_found"
+	case errors.Is(err, ErrInsufficientFunds):
+		return "insufficient_funds"
+	case errors.Is(err, ErrQuoteNotFound):
+		return "quote_not_found"
+	case errors.Is(err, ErrQuoteExpired):
+		return "quote_expired"
+	default:
+		return "invalid_request"
 	}
 }
 
+// writeError answers with err's status, code and message.
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set(ErrorCodeHeader, errorCode(err))
+	http.Error(w, err.Error(), httpStatus(err))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func envDurationOr(key string, fallback time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// loadAuthenticator builds the Authenticator from AUTH_JWT_* variables and
+// the API keys file. Refusing to start without any credentials avoids
+// silently running an open service.
+func loadAuthenticator(apiKeysFile string, disabled bool) (*Authenticator, error) {
+	authn := NewAuthenticator([]byte(os.Getenv("AUTH_JWT_SECRET")))
+	authn.Issuer = os.Getenv("AUTH_JWT_ISSUER")
+	authn.Audience = os.Getenv("AUTH_JWT_AUDIENCE")
+	if disabled {
+		slog.Warn("authentication is disabled, every request acts as admin")
+		authn.Disabled = true
+		return authn, nil
+	}
+
+	if apiKeysFile != "" {
+		f, err := os.Open(apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := authn.LoadAPIKeys(f); err != nil {
+			return nil, err
+		}
+	}
+	if len(authn.JWTSecret) == 0 && len(authn.apiKeys) == 0 && len(authn.clientCerts) == 0 {
+		return nil, errors.New("no credentials configured: set AUTH_JWT_SECRET or -auth-api-keys, or pass -auth-disabled")
+	}
+	return authn, nil
+}
+
+// loadVerifier returns nil when no keyring is configured, leaving /pay unsigned.
+func loadVerifier(keyringFile string) (*signing.Verifier, error) {
+	if keyringFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(keyringFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyring, err := signing.LoadKeyring(f)
+	if err != nil {
+		return nil, err
+	}
+	return signing.NewVerifier(keyring), nil
+}
+
+// loadFeeEngine returns nil when no fee config is given, charging no fees.
+func loadFeeEngine(configFile string) (*FeeEngine, error) {
+	if configFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadFeeEngine(f)
+}
+
+// loadConverter returns nil when no rates file is given, accepting payments
+// in the ledger currency only.
+func loadConverter(currency, ratesFile, rounding string, quoteTTL time.Duration) (*Converter, error) {
+	if ratesFile == "" {
+		return nil, nil
+	}
+	if !validCurrency(currency) {
+		return nil, fmt.Errorf("invalid ledger currency %q", currency)
+	}
+	mode, err := ParseRoundingMode(rounding)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(ratesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rates, err := LoadStaticRates(f)
+	if err != nil {
+		return nil, err
+	}
+	c := NewConverter(currency, rates)
+	c.Rounding = mode
+	c.QuoteTTL = quoteTTL
+	return c, nil
+}
+
+// loadInterestEngine returns nil when no interest config is given, paying no
+// interest.
+func loadInterestEngine(configFile string) (*InterestEngine, error) {
+	if configFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadInterestEngine(f)
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
+	cfg := server.DefaultConfig()
+	if err := cfg.LoadEnv(); err != nil {
+		fatal("config error", err)
+	}
+	cfg.RegisterFlags(flag.CommandLine)
+	traceCfg := tracing.DefaultConfig("payment-service")
+	if err := traceCfg.LoadEnv(); err != nil {
+		fatal("config error", err)
+	}
+	traceCfg.RegisterFlags(flag.CommandLine)
+	grpcAddr := flag.String("grpc-addr", envOr("GRPC_ADDR", ":9090"), "gRPC listen address")
+	requestTimeout, err := envDurationOr("REQUEST_TIMEOUT", defaultRequestTimeout)
+	if err != nil {
+		fatal("config error", err)
+	}
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "deadline for processing a single payment request")
+	logLevel := flag.String("log-level", envOr("LOG_LEVEL", "info"), "log level: debug, info, warn or error")
+	apiKeysFile := flag.String("auth-api-keys", envOr("AUTH_API_KEYS_FILE", ""), "JSON file of API keys and client certificate subjects, and the principals they authenticate")
+	feeConfigFile := flag.String("fee-config", envOr("FEE_CONFIG_FILE", ""), "JSON file of fee schedules by user tier; unset charges no fees")
+	interestConfigFile := flag.String("interest-config", envOr("INTEREST_CONFIG_FILE", ""), "JSON file of interest rates by user tier; unset pays no interest")
+	currency := flag.String("currency", envOr("LEDGER_CURRENCY", "EUR"), "currency balances are kept in")
+	fxRatesFile := flag.String("fx-rates", envOr("FX_RATES_FILE", ""), `JSON file of exchange rates such as {"USD/EUR": 0.92}; unset accepts payments in the ledger currency only`)
+	fxRounding := flag.String("fx-rounding", envOr("FX_ROUNDING", string(RoundHalfEven)), "rounding of converted amounts: half-even, half-up or down")
+	quoteTTL, err := envDurationOr("FX_QUOTE_TTL", defaultQuoteTTL)
+	if err != nil {
+		fatal("config error", err)
+	}
+	flag.DurationVar(&quoteTTL, "fx-quote-ttl", quoteTTL, "how long a quote from POST /quotes can be paid with")
+	signingKeysFile := flag.String("signing-keys", envOr("SIGNING_KEYS_FILE", ""), "JSON keyring of shared secrets; when set, POST /pay must be HMAC signed")
+	authDisabled := flag.Bool("auth-disabled", envOr("AUTH_DISABLED", "") == "true", "accept unauthenticated requests as admin (development only)")
+	snapshotFile := flag.String("snapshot-file", envOr("SNAPSHOT_FILE", ""), "snapshot restored on startup, if it exists, and saved by POST /admin/snapshot")
+	rateLimits := flag.String("rate-limits", envOr("RATE_LIMITS", defaultRateLimits), `per-client limits as "route=rate:burst,..."; "*" sets the default, empty disables`)
+	flag.Parse()
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fatal("config error", err)
+	}
+	slog.SetDefault(logging.New(os.Stderr, level))
+
+	authn, err := loadAuthenticator(*apiKeysFile, *authDisabled)
+	if err != nil {
+		fatal("auth config error", err)
+	}
+	verifier, err := loadVerifier(*signingKeysFile)
+	if err != nil {
+		fatal("signing config error", err)
+	}
+	fees, err := loadFeeEngine(*feeConfigFile)
+	if err != nil {
+		fatal("fee config error", err)
+	}
+	interest, err := loadInterestEngine(*interestConfigFile)
+	if err != nil {
+		fatal("interest config error", err)
+	}
+	fx, err := loadConverter(*currency, *fxRatesFile, *fxRounding, quoteTTL)
+	if err != nil {
+		fatal("fx config error", err)
+	}
+	limits, err := ratelimit.ParseLimits(*rateLimits)
+	if err != nil {
+		fatal("config error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownTracing, err := tracing.Setup(ctx, traceCfg)
+	if err != nil {
+		fatal("tracing setup error", err)
+	}
+
 	service := NewPaymentService()
-	http.HandleFunc("/pay", service.HandlePayment)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	service.RequestTimeout = requestTimeout
+	service.SnapshotFile = *snapshotFile
+	service.Fees = fees
+	service.FX = fx
+	service.Interest = interest
+	if *snapshotFile != "" {
+		if _, err := service.LoadSnapshot(ctx, *snapshotFile); errors.Is(err, fs.ErrNotExist) {
+			slog.Info("no snapshot to restore, starting empty", "path", *snapshotFile)
+		} else if err != nil {
+			fatal("snapshot restore error", err)
+		}
+	}
+
+	if service.Interest != nil {
+		go service.RunInterest(ctx, time.Hour)
+	}
+
+	dispatcher := NewWebhookDispatcher()
+	dispatcher.Start(ctx)
+
+	relay := NewOutboxRelay(service.Outbox(), dispatcher)
+	relayDone := make(chan struct{})
+	go func() {
+		relay.Run(ctx)
+		close(relayDone)
+	}()
+
+	checker := health.New()
+	checker.AddLivenessCheck("webhookWorkers", dispatcher.Healthy)
+	checker.AddLivenessCheck("outboxRelay", relay.Healthy)
+	checker.AddReadinessCheck("storage", service.Ping)
+
+	metrics := service.Metrics()
+	// tracing.Route names each request's span after its route, which only
+	// the mux knows.
+	handle := func(pattern string, h http.HandlerFunc) {
+		http.Handle(pattern, tracing.Route(metrics.Instrument(pattern, h)))
+	}
+	// limit sits in front of authn.Require, so floods of requests with bad
+	// credentials are limited by remote IP. Health probes and /metrics are
+	// left unlimited.
+	limit := func(pattern string, h http.HandlerFunc) http.HandlerFunc {
+		if l, ok := routeLimit(limits, pattern); ok {
+			return metrics.rateLimit(pattern, l, authn.clientKey, h)
+		}
+		return h
+	}
+	handle("/healthz", checker.HandleLiveness)
+	handle("/readyz", checker.HandleReadiness)
+	pay := authn.Require(service.HandlePayment)
+	if verifier != nil {
+		pay = verifier.Middleware(pay).ServeHTTP
+	}
+	handle("/pay", limit("/pay", pay))
+	handle("/quotes", limit("/quotes", authn.Require(service.HandleQuote)))
+	handle("/users/{id}/balance", limit("/users/{id}/balance", authn.Require(service.HandleGetBalance)))
+	handle("/users/{id}/transactions", limit("/users/{id}/transactions", authn.Require(service.HandleListTransactions)))
+	handle("/transactions/{id}", limit("/transactions/{id}", authn.Require(service.HandleGetTransaction)))
+	handle("/users/{id}/statement", limit("/users/{id}/statement", authn.Require(service.HandleStatement)))
+	handle("/users/{id}/balance/stream", limit("/users/{id}/balance/stream", authn.Require(server.WithoutTimeouts(service.HandleBalanceStream))))
+	handle("/webhooks", limit("/webhooks", authn.Require(requireAdmin(dispatcher.HandleEndpoints))))
+	handle("/webhooks/dead-letters", limit("/webhooks/dead-letters", authn.Require(requireAdmin(dispatcher.HandleDeadLetters))))
+	handle("/webhooks/dead-letters/{id}/replay", limit("/webhooks/dead-letters/{id}/replay", authn.Require(requireAdmin(dispatcher.HandleReplay))))
+	handle("/admin/import", limit("/admin/import", authn.Require(requireAdmin(server.WithoutTimeouts(service.HandleImport)))))
+	handle("/admin/export/{kind}", limit("/admin/export/{kind}", authn.Require(requireAdmin(server.WithoutTimeouts(service.HandleExport)))))
+	handle("/admin/snapshot", limit("/admin/snapshot", authn.Require(requireAdmin(server.WithoutTimeouts(service.HandleSnapshot)))))
+	handle("/admin/interest", limit("/admin/interest", authn.Require(requireAdmin(service.HandleInterest))))
+	handle("/admin/reconcile", limit("/admin/reconcile", authn.Require(requireAdmin(server.WithoutTimeouts(service.HandleReconcile)))))
+	http.Handle("/metrics", tracing.Route(metrics.Handler()))
+
+	// The gRPC API shares the HTTP server's certificates and client CA.
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		fatal("TLS config error", err)
+	}
+	grpcOpts := []grpc.ServerOption{grpc.UnaryInterceptor(authn.UnaryInterceptor())}
+	if tlsConfig != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := NewGRPCServer(service, grpcOpts...)
+	lis, err := net.Listen("tcp", *grpcAddr)
+	if err != nil {
+		fatal("gRPC listen error", err)
+	}
+	go func() {
+		slog.Info("gRPC server listening", "addr", lis.Addr().String())
+		if err := grpcServer.Serve(lis); err != nil {
+			slog.Error("gRPC server stopped", "error", err)
+		}
+	}()
+
+	httpServer := server.New(cfg, tracing.Middleware(logging.Middleware(http.DefaultServeMux)))
+	httpServer.RegisterOnShutdown(checker.SetShuttingDown)
+	// SSE streams never end on their own, so close them once the server
+	// stops accepting connections instead of waiting for the shutdown
+	// timeout; closing them earlier would just have clients reconnect.
+	httpServer.RegisterOnDrain(service.hub.Close)
+	if err := httpServer.Run(ctx); err != nil {
+		slog.Error("HTTP server stopped", "error", err)
+	}
+
+	grpcServer.GracefulStop()
+	cancel()
+	<-relayDone
+	dispatcher.Stop()
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
 }
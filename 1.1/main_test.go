@@ -2,15 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"sgh-assignment/pkg/logging"
 )
 
+func balanceOf(t *testing.T, service *PaymentService, userID string) float64 {
+	t.Helper()
+	balance, err := service.GetBalance(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("GetBalance failed: %v", err)
+	}
+	return balance
+}
+
 func TestProcessPaymentSuccess(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 1000.00)
+	service.SetBalance(context.Background(), "user123", 1000.00)
 
 	req := PaymentRequest{
 		UserID:        "user123",
@@ -18,7 +32,7 @@ func TestProcessPaymentSuccess(t *testing.T) {
 		TransactionID: "txn-001",
 	}
 
-	resp, err := service.ProcessPayment(req)
+	resp, err := service.ProcessPayment(context.Background(), req)
 	if err != nil {
 		t.Fatalf("ProcessPayment failed: %v", err)
 	}
@@ -36,7 +50,7 @@ func TestProcessPaymentSuccess(t *testing.T) {
 		t.Error("TraceID should not be empty")
 	}
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	if balance != 900.00 {
 		t.Errorf("Expected balance 900.00 (1000 - 100), got %.2f", balance)
 	}
@@ -44,7 +58,7 @@ func TestProcessPaymentSuccess(t *testing.T) {
 
 func TestProcessPaymentIdempotency(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 1000.00)
+	service.SetBalance(context.Background(), "user123", 1000.00)
 
 	req := PaymentRequest{
 		UserID:        "user123",
@@ -52,12 +66,12 @@ func TestProcessPaymentIdempotency(t *testing.T) {
 		TransactionID: "txn-001",
 	}
 
-	resp1, err := service.ProcessPayment(req)
+	resp1, err := service.ProcessPayment(context.Background(), req)
 	if err != nil {
 		t.Fatalf("First payment failed: %v", err)
 	}
 
-	resp2, err := service.ProcessPayment(req)
+	resp2, err := service.ProcessPayment(context.Background(), req)
 	if err != nil {
 		t.Fatalf("Second payment failed: %v", err)
 	}
@@ -66,7 +80,7 @@ func TestProcessPaymentIdempotency(t *testing.T) {
 		t.Errorf("Transaction IDs should match: %s != %s", resp1.TransactionID, resp2.TransactionID)
 	}
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	if balance != 900.00 {
 		t.Errorf("Balance should be 900.00 (1000 - 100) after idempotent request, got %.2f", balance)
 	}
@@ -74,7 +88,7 @@ func TestProcessPaymentIdempotency(t *testing.T) {
 
 func TestProcessPaymentInsufficientFunds(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 50.00)
+	service.SetBalance(context.Background(), "user123", 50.00)
 
 	req := PaymentRequest{
 		UserID:        "user123",
@@ -82,12 +96,12 @@ func TestProcessPaymentInsufficientFunds(t *testing.T) {
 		TransactionID: "txn-001",
 	}
 
-	_, err := service.ProcessPayment(req)
+	_, err := service.ProcessPayment(context.Background(), req)
 	if err == nil {
 		t.Error("Expected error for insufficient funds")
 	}
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	if balance != 50.00 {
 		t.Errorf("Balance should remain 50.00, got %.2f", balance)
 	}
@@ -95,7 +109,7 @@ func TestProcessPaymentInsufficientFunds(t *testing.T) {
 
 func TestProcessPaymentValidation(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 1000.00)
+	service.SetBalance(context.Background(), "user123", 1000.00)
 
 	tests := []struct {
 		name string
@@ -127,7 +141,7 @@ func TestProcessPaymentValidation(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := service.ProcessPayment(tt.req)
+			_, err := service.ProcessPayment(context.Background(), tt.req)
 			if err == nil {
 				t.Errorf("Expected error for %s", tt.name)
 			}
@@ -137,7 +151,7 @@ func TestProcessPaymentValidation(t *testing.T) {
 
 func TestProcessPaymentPositiveAmount(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 100.00)
+	service.SetBalance(context.Background(), "user123", 100.00)
 
 	req := PaymentRequest{
 		UserID:        "user123",
@@ -145,7 +159,7 @@ func TestProcessPaymentPositiveAmount(t *testing.T) {
 		TransactionID: "txn-add-001",
 	}
 
-	resp, err := service.ProcessPayment(req)
+	resp, err := service.ProcessPayment(context.Background(), req)
 	if err != nil {
 		t.Fatalf("ProcessPayment failed: %v", err)
 	}
@@ -154,7 +168,7 @@ func TestProcessPaymentPositiveAmount(t *testing.T) {
 		t.Errorf("Expected status 'success', got '%s'", resp.Status)
 	}
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	expectedBalance := 150.00
 	if balance != expectedBalance {
 		t.Errorf("Expected balance %.2f (100 + 50), got %.2f", expectedBalance, balance)
@@ -163,7 +177,7 @@ func TestProcessPaymentPositiveAmount(t *testing.T) {
 
 func TestProcessPaymentNegativeAmount(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 100.00)
+	service.SetBalance(context.Background(), "user123", 100.00)
 
 	req := PaymentRequest{
 		UserID:        "user123",
@@ -171,7 +185,7 @@ func TestProcessPaymentNegativeAmount(t *testing.T) {
 		TransactionID: "txn-deduct-001",
 	}
 
-	resp, err := service.ProcessPayment(req)
+	resp, err := service.ProcessPayment(context.Background(), req)
 	if err != nil {
 		t.Fatalf("ProcessPayment failed: %v", err)
 	}
@@ -180,7 +194,7 @@ func TestProcessPaymentNegativeAmount(t *testing.T) {
 		t.Errorf("Expected status 'success', got '%s'", resp.Status)
 	}
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	expectedBalance := 70.00
 	if balance != expectedBalance {
 		t.Errorf("Expected balance %.2f (100 - 30), got %.2f", expectedBalance, balance)
@@ -189,7 +203,7 @@ func TestProcessPaymentNegativeAmount(t *testing.T) {
 
 func TestProcessPaymentNegativeAmountInsufficientFunds(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 50.00)
+	service.SetBalance(context.Background(), "user123", 50.00)
 
 	req := PaymentRequest{
 		UserID:        "user123",
@@ -197,12 +211,12 @@ func TestProcessPaymentNegativeAmountInsufficientFunds(t *testing.T) {
 		TransactionID: "txn-deduct-fail",
 	}
 
-	_, err := service.ProcessPayment(req)
+	_, err := service.ProcessPayment(context.Background(), req)
 	if err == nil {
 		t.Error("Expected error for insufficient funds with negative amount")
 	}
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	if balance != 50.00 {
 		t.Errorf("Balance should remain 50.00, got %.2f", balance)
 	}
@@ -210,9 +224,9 @@ func TestProcessPaymentNegativeAmountInsufficientFunds(t *testing.T) {
 
 func TestGetBalanceSuccess(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 500.00)
+	service.SetBalance(context.Background(), "user123", 500.00)
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	if balance != 500.00 {
 		t.Errorf("Expected balance 500.00, got %.2f", balance)
 	}
@@ -221,7 +235,7 @@ func TestGetBalanceSuccess(t *testing.T) {
 func TestGetBalanceNonExistent(t *testing.T) {
 	service := NewPaymentService()
 
-	balance := service.GetBalance("nonexistent")
+	balance := balanceOf(t, service, "nonexistent")
 	if balance != 0 {
 		t.Errorf("Expected balance 0 for nonexistent user, got %.2f", balance)
 	}
@@ -230,14 +244,14 @@ func TestGetBalanceNonExistent(t *testing.T) {
 func TestSetBalanceSuccess(t *testing.T) {
 	service := NewPaymentService()
 
-	service.SetBalance("user123", 1000.00)
-	balance := service.GetBalance("user123")
+	service.SetBalance(context.Background(), "user123", 1000.00)
+	balance := balanceOf(t, service, "user123")
 	if balance != 1000.00 {
 		t.Errorf("Expected balance 1000.00, got %.2f", balance)
 	}
 
-	service.SetBalance("user123", 500.00)
-	balance = service.GetBalance("user123")
+	service.SetBalance(context.Background(), "user123", 500.00)
+	balance = balanceOf(t, service, "user123")
 	if balance != 500.00 {
 		t.Errorf("Expected balance 500.00 after update, got %.2f", balance)
 	}
@@ -246,24 +260,24 @@ func TestSetBalanceSuccess(t *testing.T) {
 func TestSetBalanceMultipleUsers(t *testing.T) {
 	service := NewPaymentService()
 
-	service.SetBalance("user1", 100.00)
-	service.SetBalance("user2", 200.00)
-	service.SetBalance("user3", 300.00)
+	service.SetBalance(context.Background(), "user1", 100.00)
+	service.SetBalance(context.Background(), "user2", 200.00)
+	service.SetBalance(context.Background(), "user3", 300.00)
 
-	if service.GetBalance("user1") != 100.00 {
+	if balanceOf(t, service, "user1") != 100.00 {
 		t.Error("user1 balance mismatch")
 	}
-	if service.GetBalance("user2") != 200.00 {
+	if balanceOf(t, service, "user2") != 200.00 {
 		t.Error("user2 balance mismatch")
 	}
-	if service.GetBalance("user3") != 300.00 {
+	if balanceOf(t, service, "user3") != 300.00 {
 		t.Error("user3 balance mismatch")
 	}
 }
 
 func TestGetTransactionSuccess(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 1000.00)
+	service.SetBalance(context.Background(), "user123", 1000.00)
 
 	req := PaymentRequest{
 		UserID:        "user123",
@@ -271,14 +285,14 @@ func TestGetTransactionSuccess(t *testing.T) {
 		TransactionID: "txn-001",
 	}
 
-	_, err := service.ProcessPayment(req)
+	_, err := service.ProcessPayment(context.Background(), req)
 	if err != nil {
 		t.Fatalf("ProcessPayment failed: %v", err)
 	}
 
-	txn, exists := service.GetTransaction("txn-001")
-	if !exists {
-		t.Error("Transaction should exist")
+	txn, err := service.GetTransaction(context.Background(), "txn-001")
+	if err != nil {
+		t.Fatalf("GetTransaction failed: %v", err)
 	}
 	if txn.TransactionID != "txn-001" {
 		t.Errorf("Expected transactionID 'txn-001', got '%s'", txn.TransactionID)
@@ -297,9 +311,9 @@ func TestGetTransactionSuccess(t *testing.T) {
 func TestGetTransactionNonExistent(t *testing.T) {
 	service := NewPaymentService()
 
-	txn, exists := service.GetTransaction("nonexistent")
-	if exists {
-		t.Error("Transaction should not exist")
+	txn, err := service.GetTransaction(context.Background(), "nonexistent")
+	if !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("Expected ErrTransactionNotFound, got %v", err)
 	}
 	if txn != nil {
 		t.Error("Transaction should be nil")
@@ -310,7 +324,7 @@ func TestGetTransactionNonExistent(t *testing.T) {
 // But I added it to present the integration test in reality
 func TestHandlePaymentSuccess(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 1000.00)
+	service.SetBalance(context.Background(), "user123", 1000.00)
 
 	reqBody := PaymentRequest{
 		UserID:        "user123",
@@ -323,7 +337,7 @@ func TestHandlePaymentSuccess(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
-	service.HandlePayment(w, req)
+	asAdmin(service.HandlePayment)(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
@@ -349,7 +363,7 @@ func TestHandlePaymentInvalidMethod(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/pay", nil)
 	w := httptest.NewRecorder()
 
-	service.HandlePayment(w, req)
+	asAdmin(service.HandlePayment)(w, req)
 
 	if w.Code != http.StatusMethodNotAllowed {
 		t.Errorf("Expected status 405, got %d", w.Code)
@@ -363,16 +377,50 @@ func TestHandlePaymentInvalidJSON(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
-	service.HandlePayment(w, req)
+	asAdmin(service.HandlePayment)(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("Expected status 400, got %d", w.Code)
 	}
 }
 
+func TestHandlePaymentTraceID(t *testing.T) {
+	service := NewPaymentService()
+	handler := logging.Middleware(asAdmin(service.HandlePayment))
+
+	pay := func(transactionID, requestID string) (*httptest.ResponseRecorder, PaymentResponse) {
+		jsonBody, _ := json.Marshal(PaymentRequest{UserID: "user123", Amount: 10, TransactionID: transactionID})
+		req := httptest.NewRequest(http.MethodPost, "/pay", bytes.NewBuffer(jsonBody))
+		if requestID != "" {
+			req.Header.Set(logging.RequestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var resp PaymentResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return w, resp
+	}
+
+	w, resp := pay("txn-001", "")
+	if got := w.Header().Get(logging.RequestIDHeader); got == "" || got != resp.TraceID {
+		t.Errorf("Expected X-Request-ID to match TraceID %s, got %s", resp.TraceID, got)
+	}
+
+	w, resp = pay("txn-002", "req-abc-123")
+	if resp.TraceID != "req-abc-123" {
+		t.Errorf("Expected TraceID req-abc-123, got %s", resp.TraceID)
+	}
+	if got := w.Header().Get(logging.RequestIDHeader); got != "req-abc-123" {
+		t.Errorf("Expected X-Request-ID req-abc-123, got %s", got)
+	}
+}
+
 func TestHandlePaymentIdempotency(t *testing.T) {
 	service := NewPaymentService()
-	service.SetBalance("user123", 1000.00)
+	service.SetBalance(context.Background(), "user123", 1000.00)
 
 	reqBody := PaymentRequest{
 		UserID:        "user123",
@@ -385,7 +433,7 @@ func TestHandlePaymentIdempotency(t *testing.T) {
 	req1.Header.Set("Content-Type", "application/json")
 	w1 := httptest.NewRecorder()
 
-	service.HandlePayment(w1, req1)
+	asAdmin(service.HandlePayment)(w1, req1)
 
 	var resp1 PaymentResponse
 	decoder1 := json.NewDecoder(w1.Body)
@@ -397,7 +445,7 @@ func TestHandlePaymentIdempotency(t *testing.T) {
 	req2.Header.Set("Content-Type", "application/json")
 	w2 := httptest.NewRecorder()
 
-	service.HandlePayment(w2, req2)
+	asAdmin(service.HandlePayment)(w2, req2)
 
 	var resp2 PaymentResponse
 	decoder2 := json.NewDecoder(w2.Body)
@@ -409,8 +457,75 @@ func TestHandlePaymentIdempotency(t *testing.T) {
 		t.Error("Idempotent requests should return same transaction ID")
 	}
 
-	balance := service.GetBalance("user123")
+	balance := balanceOf(t, service, "user123")
 	if balance != 900.00 {
 		t.Errorf("Expected balance 900.00 (1000 - 100), got %.2f", balance)
 	}
 }
+
+func TestPing(t *testing.T) {
+	service := NewPaymentService()
+
+	if err := service.Ping(context.Background()); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := service.Ping(ctx); err == nil {
+		t.Error("Ping should fail while the storage lock is held")
+	}
+}
+
+func TestProcessPaymentCanceledWhileWaitingForLock(t *testing.T) {
+	service := NewPaymentService()
+
+	service.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "user123", Amount: 100, TransactionID: "txn-001"})
+	service.mu.Unlock()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	// the abandoned acquisition must release the lock again
+	if balance := balanceOf(t, service, "user123"); balance != 0 {
+		t.Errorf("Expected balance 0, got %.2f", balance)
+	}
+	if _, err := service.GetTransaction(context.Background(), "txn-001"); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("Expected the abandoned payment not to be recorded, got %v", err)
+	}
+}
+
+func TestProcessPaymentCanceledContext(t *testing.T) {
+	service := NewPaymentService()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "user123", Amount: 100, TransactionID: "txn-001"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if service.Outbox().Len() != 0 {
+		t.Error("A canceled payment should not emit events")
+	}
+}
+
+func TestHandlePaymentDeadline(t *testing.T) {
+	service := NewPaymentService()
+	service.RequestTimeout = 20 * time.Millisecond
+
+	jsonBody, _ := json.Marshal(PaymentRequest{UserID: "user123", Amount: 100, TransactionID: "txn-001"})
+	req := httptest.NewRequest(http.MethodPost, "/pay", bytes.NewBuffer(jsonBody))
+	w := httptest.NewRecorder()
+
+	service.mu.Lock()
+	asAdmin(service.HandlePayment)(w, req)
+	service.mu.Unlock()
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d", w.Code)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"sgh-assignment/pkg/ratelimit"
+	"sgh-assignment/pkg/server"
+)
+
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeDeclined  = "declined"
+	outcomeInvalid   = "invalid"
+	outcomeCanceled  = "canceled"
+)
+
+// Metrics holds the Prometheus collectors of one PaymentService. Each service
+// has its own registry so tests don't share counters.
+type Metrics struct {
+	registry       *prometheus.Registry
+	httpRequests   *prometheus.CounterVec
+	httpDuration   *prometheus.HistogramVec
+	payments       *prometheus.CounterVec
+	idempotentHits prometheus.Counter
+	lockWait       *prometheus.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "payment",
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "payment",
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		payments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "payment",
+			Name:      "payments_total",
+			Help:      "Payments processed by outcome (succeeded, declined, invalid, canceled).",
+		}, []string{"outcome"}),
+		idempotentHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "payment",
+			Name:      "idempotent_hits_total",
+			Help:      "Payments answered from an already processed transaction.",
+		}),
+		lockWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "payment",
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent waiting for the PaymentService lock by mode (read, write).",
+			Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, []string{"mode"}),
+	}
+	m.registry.MustRegister(
+		m.httpRequests,
+		m.httpDuration,
+		m.payments,
+		m.idempotentHits,
+		m.lockWait,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Instrument records request count and latency for route. route should be
+// the registered pattern, not the raw path, to keep label cardinality bounded.
+func (m *Metrics) Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := server.NewStatusRecorder(w)
+		next(rec, r)
+
+		status := strconv.Itoa(rec.Status)
+		m.httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		m.httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Metrics exposes the service's collectors for the /metrics endpoint and HTTP middleware.
+func (s *PaymentService) Metrics() *Metrics {
+	return s.metrics
+}
+
+func (s *PaymentService) registerGauges() {
+	s.metrics.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "payment",
+		Name:      "transactions",
+		Help:      "Number of transactions held by PaymentService.",
+	}, func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(len(s.transactions))
+	}))
+}
+
+// registerLimiter exports the decisions and tracked clients of the limiter
+// guarding route.
+func (m *Metrics) registerLimiter(route string, l *ratelimit.Limiter) {
+	labels := prometheus.Labels{"route": route}
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "payment",
+			Name:        "rate_limit_allowed_total",
+			Help:        "Requests admitted by the per-client rate limiter by route.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(l.Allowed()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "payment",
+			Name:        "rate_limit_rejected_total",
+			Help:        "Requests rejected with 429 by the per-client rate limiter by route.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(l.Rejected()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "payment",
+			Name:        "rate_limit_clients",
+			Help:        "Clients tracked by the per-client rate limiter by route.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(l.Clients()) }),
+	)
+}
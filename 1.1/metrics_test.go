@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	return string(body)
+}
+
+func TestPaymentMetrics(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 100.00)
+
+	_, _ = service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -10, TransactionID: "txn-001"})
+	_, _ = service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -10, TransactionID: "txn-001"})
+	_, _ = service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -1000, TransactionID: "txn-002"})
+	_, _ = service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 0, TransactionID: "txn-003"})
+
+	body := scrape(t, service.Metrics())
+	for _, want := range []string{
+		`payment_payments_total{outcome="succeeded"} 1`,
+		`payment_payments_total{outcome="declined"} 1`,
+		`payment_payments_total{outcome="invalid"} 1`,
+		`payment_idempotent_hits_total 1`,
+		`payment_transactions 1`,
+		`payment_lock_wait_seconds_count{mode="write"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestInstrumentHTTP(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 100.00)
+	m := service.Metrics()
+	handler := m.Instrument("/pay", asAdmin(service.HandlePayment))
+
+	jsonBody, _ := json.Marshal(PaymentRequest{UserID: "user123", Amount: -10, TransactionID: "txn-001"})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/pay", bytes.NewReader(jsonBody)))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/pay", nil))
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`payment_http_requests_total{method="POST",route="/pay",status="200"} 1`,
+		`payment_http_requests_total{method="GET",route="/pay",status="405"} 1`,
+		`payment_http_request_duration_seconds_count{method="POST",route="/pay",status="200"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestInstrumentFlushes(t *testing.T) {
+	w := httptest.NewRecorder()
+	handler := NewPaymentService().Metrics().Instrument("/stream", func(rw http.ResponseWriter, r *http.Request) {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			t.Fatal("Instrument's writer should implement http.Flusher for SSE")
+		}
+		flusher.Flush()
+	})
+	handler(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if !w.Flushed {
+		t.Error("Flush should reach the underlying writer")
+	}
+}
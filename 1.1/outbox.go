@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Publisher delivers outbox events downstream. Delivery is at-least-once:
+// an event may be published again if the relay fails before acknowledging it,
+// so consumers should deduplicate on Event.ID.
+type Publisher interface {
+	Publish(ctx context.Context, evt Event) error
+}
+
+type PublisherFunc func(ctx context.Context, evt Event) error
+
+func (f PublisherFunc) Publish(ctx context.Context, evt Event) error {
+	return f(ctx, evt)
+}
+
+type OutboxRecord struct {
+	Seq       uint64    `json:"seq"`
+	Event     Event     `json:"event"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Outbox is an append-only log of events waiting to be published.
+// PaymentService appends to it while holding its own lock, so an event is
+// recorded if and only if the balance change that produced it is.
+type Outbox struct {
+	mu      sync.Mutex
+	records []*OutboxRecord
+	nextSeq uint64
+	notify  chan struct{}
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{
+		nextSeq: 1,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (o *Outbox) append(evt Event) {
+	o.mu.Lock()
+	o.records = append(o.records, &OutboxRecord{
+		Seq:       o.nextSeq,
+		Event:     evt,
+		CreatedAt: time.Now(),
+	})
+	o.nextSeq++
+	o.mu.Unlock()
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns up to limit unacknowledged records in sequence order.
+// A non-positive limit returns all of them.
+func (o *Outbox) Pending(limit int) []OutboxRecord {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n := len(o.records)
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	pending := make([]OutboxRecord, n)
+	for i := 0; i < n; i++ {
+		pending[i] = *o.records[i]
+	}
+	return pending
+}
+
+// Ack removes a published record from the outbox.
+func (o *Outbox) Ack(seq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, rec := range o.records {
+		if rec.Seq == seq {
+			o.records = append(o.records[:i], o.records[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o *Outbox) fail(seq uint64, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, rec := range o.records {
+		if rec.Seq == seq {
+			rec.Attempts++
+			rec.LastError = err.Error()
+			return
+		}
+	}
+}
+
+// discard drops every pending record and returns how many there were.
+// Sequence numbers carry on, so an in-flight record can't be confused with a
+// later one.
+func (o *Outbox) discard() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := len(o.records)
+	o.records = nil
+	return n
+}
+
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.records)
+}
+
+// OutboxRelay drains the outbox to a Publisher in sequence order. A record is
+// only acknowledged after Publish succeeds; on failure the relay waits
+// RetryDelay and tries the same record again, so events are never skipped.
+type OutboxRelay struct {
+	Outbox       *Outbox
+	Publisher    Publisher
+	BatchSize    int
+	PollInterval time.Duration
+	RetryDelay   time.Duration
+
+	running atomic.Bool
+}
+
+func NewOutboxRelay(outbox *Outbox, publisher Publisher) *OutboxRelay {
+	return &OutboxRelay{
+		Outbox:       outbox,
+		Publisher:    publisher,
+		BatchSize:    100,
+		PollInterval: time.Second,
+		RetryDelay:   time.Second,
+	}
+}
+
+// Run drains the outbox until ctx is cancelled.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	r.running.Store(true)
+	defer r.running.Store(false)
+
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Drain(ctx); err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.RetryDelay):
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Outbox.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Healthy reports an error if Run is not active.
+func (r *OutboxRelay) Healthy(context.Context) error {
+	if !r.running.Load() {
+		return fmt.Errorf("outbox relay not running (%d pending)", r.Outbox.Len())
+	}
+	return nil
+}
+
+// Drain publishes pending records until the outbox is empty or a publish fails.
+func (r *OutboxRelay) Drain(ctx context.Context) error {
+	for {
+		batch := r.Outbox.Pending(r.BatchSize)
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, rec := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := r.Publisher.Publish(ctx, rec.Event); err != nil {
+				slog.ErrorContext(ctx, "failed to publish outbox record",
+					"eventID", rec.Event.ID, "seq", rec.Seq, "type", rec.Event.Type, "error", err)
+				r.Outbox.fail(rec.Seq, err)
+				return err
+			}
+			r.Outbox.Ack(rec.Seq)
+		}
+	}
+}
+
+// Outbox exposes the service's event outbox so a relay can drain it.
+func (s *PaymentService) Outbox() *Outbox {
+	return s.outbox
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboxWrittenWithBalanceUpdate(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 100.00)
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -40, TransactionID: "txn-001"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "", Amount: -40, TransactionID: "txn-002"}); err == nil {
+		t.Fatal("Expected validation error")
+	}
+
+	pending := service.Outbox().Pending(0)
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 outbox record, got %d", len(pending))
+	}
+	if pending[0].Seq != 1 || pending[0].Event.Data.Balance != 60.00 {
+		t.Errorf("Unexpected outbox record: %+v", pending[0])
+	}
+}
+
+func TestOutboxRelayAtLeastOnce(t *testing.T) {
+	service := NewPaymentService()
+	for _, id := range []string{"txn-001", "txn-002", "txn-003"} {
+		if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 10, TransactionID: id}); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var published []string
+	failures := 1
+	publisher := PublisherFunc(func(ctx context.Context, evt Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, evt.Data.TransactionID)
+		if evt.Data.TransactionID == "txn-002" && failures > 0 {
+			failures--
+			return errors.New("broker unavailable")
+		}
+		return nil
+	})
+
+	relay := NewOutboxRelay(service.Outbox(), publisher)
+	if err := relay.Drain(context.Background()); err == nil {
+		t.Fatal("Expected first drain to stop at the failing record")
+	}
+	pending := service.Outbox().Pending(0)
+	if len(pending) != 2 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("Failed record should stay pending with attempt recorded, got %+v", pending)
+	}
+
+	if err := relay.Drain(context.Background()); err != nil {
+		t.Fatalf("Second drain failed: %v", err)
+	}
+	if n := service.Outbox().Len(); n != 0 {
+		t.Errorf("Expected empty outbox, got %d records", n)
+	}
+
+	want := []string{"txn-001", "txn-002", "txn-002", "txn-003"}
+	if len(published) != len(want) {
+		t.Fatalf("Expected publishes %v, got %v", want, published)
+	}
+	for i := range want {
+		if published[i] != want[i] {
+			t.Errorf("publish %d: expected %s, got %s", i, want[i], published[i])
+		}
+	}
+}
+
+func TestOutboxRelayRun(t *testing.T) {
+	service := NewPaymentService()
+	got := make(chan Event, 10)
+	relay := NewOutboxRelay(service.Outbox(), PublisherFunc(func(ctx context.Context, evt Event) error {
+		got <- evt
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		relay.Run(ctx)
+		close(done)
+	}()
+
+	resp, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 10, TransactionID: "txn-001"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+
+	select {
+	case evt := <-got:
+		if evt.Data.TransactionID != resp.TransactionID {
+			t.Errorf("Expected event for %s, got %s", resp.TransactionID, evt.Data.TransactionID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not publish the event")
+	}
+
+	if err := relay.Healthy(context.Background()); err != nil {
+		t.Errorf("Running relay should be healthy: %v", err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not stop after cancel")
+	}
+	if err := relay.Healthy(context.Background()); err == nil {
+		t.Error("Stopped relay should be unhealthy")
+	}
+}
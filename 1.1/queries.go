@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type BalanceResponse struct {
+	UserID  string     `json:"userID"`
+	Balance float64    `json:"balance"`
+	AsOf    *time.Time `json:"asOf,omitempty"`
+}
+
+type TransactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+}
+
+// queryContext bounds a read by RequestTimeout, like HandlePayment.
+func (s *PaymentService) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.RequestTimeout > 0 {
+		return context.WithTimeout(r.Context(), s.RequestTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// HandleGetBalance serves GET /users/{id}/balance, or with ?asOf= an RFC 3339
+// time, the balance as of then.
+func (s *PaymentService) HandleGetBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	userID := r.PathValue("id")
+	if err := authorizeUser(ctx, userID); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := BalanceResponse{UserID: userID}
+	var err error
+	if v := r.URL.Query().Get("asOf"); v != "" {
+		asOf, parseErr := time.Parse(time.RFC3339, v)
+		if parseErr != nil {
+			writeError(w, fmt.Errorf("%w: invalid asOf: %v", ErrInvalidRequest, parseErr))
+			return
+		}
+		resp.AsOf = &asOf
+		resp.Balance, err = s.BalanceAt(ctx, userID, asOf)
+	} else {
+		resp.Balance, err = s.GetBalance(ctx, userID)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// HandleListTransactions serves GET /users/{id}/transactions, oldest first.
+func (s *PaymentService) HandleListTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	userID := r.PathValue("id")
+	if err := authorizeUser(ctx, userID); err != nil {
+		writeError(w, err)
+		return
+	}
+	txns, err := s.ListTransactions(ctx, userID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, TransactionsResponse{Transactions: txns})
+}
+
+// HandleGetTransaction serves GET /transactions/{id}.
+func (s *PaymentService) HandleGetTransaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	txn, err := s.authorizedTransaction(ctx, r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, txn)
+}
+
+// authorizedTransaction returns the transaction if the caller may act for
+// its user. Another user's transaction is reported as not found, like one
+// that doesn't exist, so callers can't probe for transaction IDs.
+func (s *PaymentService) authorizedTransaction(ctx context.Context, transactionID string) (*Transaction, error) {
+	if _, ok := PrincipalFrom(ctx); !ok {
+		return nil, ErrUnauthenticated
+	}
+	txn, err := s.GetTransaction(ctx, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeUser(ctx, txn.UserID); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTransactionNotFound, transactionID)
+	}
+	return txn, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"1.1/client"
+)
+
+func newSDKServer(t *testing.T, service *PaymentService, authn *Authenticator) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pay", authn.Require(service.HandlePayment))
+	mux.HandleFunc("/users/{id}/balance", authn.Require(service.HandleGetBalance))
+	mux.HandleFunc("/users/{id}/transactions", authn.Require(service.HandleListTransactions))
+	mux.HandleFunc("/transactions/{id}", authn.Require(service.HandleGetTransaction))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClientSDK(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "alice", 100)
+	service.SetBalance(context.Background(), "bob", 100)
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "bob", Amount: -10, TransactionID: "txn-bob"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	authn, _ := newTestAuthenticator(t)
+	srv := newSDKServer(t, service, authn)
+	c := client.New(srv.URL, "key-alice")
+	ctx := context.Background()
+
+	resp, err := c.Pay(ctx, client.PaymentRequest{UserID: "alice", Amount: -30})
+	if err != nil {
+		t.Fatalf("Pay failed: %v", err)
+	}
+	if resp.TransactionID == "" || resp.Status != "success" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	balance, err := c.Balance(ctx, "alice")
+	if err != nil || balance != 70 {
+		t.Errorf("Expected balance 70, got %v, %v", balance, err)
+	}
+	txn, err := c.Transaction(ctx, resp.TransactionID)
+	if err != nil || txn.UserID != "alice" || txn.Amount != -30 {
+		t.Errorf("Unexpected transaction %+v, %v", txn, err)
+	}
+	txns, err := c.Transactions(ctx, "alice")
+	if err != nil || len(txns) != 1 || txns[0].TransactionID != resp.TransactionID {
+		t.Errorf("Unexpected transactions %+v, %v", txns, err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"Insufficient funds", func() error {
+			_, err := c.Pay(ctx, client.PaymentRequest{UserID: "alice", Amount: -1000})
+			return err
+		}, client.ErrInsufficientFunds},
+		{"Invalid request", func() error {
+			_, err := c.Pay(ctx, client.PaymentRequest{UserID: "alice", Amount: 0})
+			return err
+		}, client.ErrInvalidRequest},
+		{"Other user's balance", func() error {
+			_, err := c.Balance(ctx, "bob")
+			return err
+		}, client.ErrForbidden},
+		{"Unknown transaction", func() error {
+			_, err := c.Transaction(ctx, "txn-missing")
+			return err
+		}, client.ErrNotFound},
+		{"Other user's transaction", func() error {
+			_, err := c.Transaction(ctx, "txn-bob")
+			return err
+		}, client.ErrNotFound},
+		{"Unknown API key", func() error {
+			_, err := client.New(srv.URL, "key-mallory").Balance(ctx, "alice")
+			return err
+		}, client.ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestQueryHandlersRejectOtherMethods(t *testing.T) {
+	service := NewPaymentService()
+	for _, h := range []http.HandlerFunc{service.HandleGetBalance, service.HandleListTransactions, service.HandleGetTransaction} {
+		w := httptest.NewRecorder()
+		asAdmin(h)(w, httptest.NewRequest(http.MethodPost, "/users/alice/balance", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", w.Code)
+		}
+	}
+}
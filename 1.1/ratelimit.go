@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"sgh-assignment/pkg/ratelimit"
+)
+
+// defaultRateLimits keeps one client from monopolising the PaymentService
+// lock while leaving plenty of headroom for normal traffic.
+const defaultRateLimits = "/pay=50:100"
+
+// clientKey identifies who a request is counted against: the principal its
+// credentials authenticate, so every API key or token subject gets its own
+// bucket, or the remote IP when they don't. It runs before Require, so
+// requests with missing or bad credentials are limited too.
+// X-Forwarded-For is ignored because clients could set it to dodge their
+// limit.
+func (a *Authenticator) clientKey(r *http.Request) string {
+	if p, err := a.authenticateRequest(r); err == nil && p.Subject != anonymousSubject {
+		return "principal:" + p.Subject
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit returns next limited to limit per client, as told apart by key,
+// with the limiter's stats exported under route.
+func (m *Metrics) rateLimit(route string, limit ratelimit.Limit, key ratelimit.KeyFunc, next http.HandlerFunc) http.HandlerFunc {
+	l := ratelimit.NewLimiter(limit)
+	m.registerLimiter(route, l)
+	return ratelimit.Middleware(l, key, next).ServeHTTP
+}
+
+// routeLimit picks the limit of route, falling back to the "*" entry.
+func routeLimit(limits map[string]ratelimit.Limit, route string) (ratelimit.Limit, bool) {
+	if limit, ok := limits[route]; ok {
+		return limit, true
+	}
+	limit, ok := limits["*"]
+	return limit, ok
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sgh-assignment/pkg/ratelimit"
+)
+
+func TestRateLimitPerClient(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "alice", 100.00)
+	service.SetBalance(context.Background(), "bob", 100.00)
+	authn, _ := newTestAuthenticator(t)
+	authn.AddAPIKey("key-bob", Principal{Subject: "bob", UserIDs: []string{"bob"}, Scopes: []string{ScopeDebit}})
+	m := service.Metrics()
+	handler := m.rateLimit("/pay", ratelimit.Limit{Rate: 0.1, Burst: 2}, authn.clientKey, authn.Require(service.HandlePayment))
+
+	alice := map[string]string{APIKeyHeader: "key-alice"}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := postPayment(t, handler, PaymentRequest{UserID: "alice", Amount: -1, TransactionID: fmt.Sprintf("txn-a%d", i)}, alice)
+		if w.Code != want {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, want, w.Code)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+			t.Errorf("Expected Retry-After 10, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+
+	w := postPayment(t, handler, PaymentRequest{UserID: "bob", Amount: -1, TransactionID: "txn-b0"}, map[string]string{APIKeyHeader: "key-bob"})
+	if w.Code != http.StatusOK {
+		t.Errorf("Another client should not be limited, got status %d", w.Code)
+	}
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`payment_rate_limit_allowed_total{route="/pay"} 3`,
+		`payment_rate_limit_rejected_total{route="/pay"} 1`,
+		`payment_rate_limit_clients{route="/pay"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestRateLimitBadCredentials(t *testing.T) {
+	service := NewPaymentService()
+	authn, _ := newTestAuthenticator(t)
+	handler := service.Metrics().rateLimit("/pay", ratelimit.Limit{Rate: 0.1, Burst: 2}, authn.clientKey, authn.Require(service.HandlePayment))
+
+	// Every request guesses another key, but they all come from one IP.
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		w := postPayment(t, handler, PaymentRequest{UserID: "alice", Amount: -1, TransactionID: "txn-1"}, map[string]string{APIKeyHeader: fmt.Sprintf("guess-%d", i)})
+		if w.Code != want {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, want, w.Code)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	authn, _ := newTestAuthenticator(t)
+	r := httptest.NewRequest(http.MethodPost, "/pay", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := authn.clientKey(r); got != "ip:203.0.113.7" {
+		t.Errorf("Expected the remote IP, got %q", got)
+	}
+
+	r.Header.Set(APIKeyHeader, "nope")
+	if got := authn.clientKey(r); got != "ip:203.0.113.7" {
+		t.Errorf("Bad credentials should fall back to the remote IP, got %q", got)
+	}
+
+	r.Header.Set(APIKeyHeader, "key-alice")
+	if got := authn.clientKey(r); got != "principal:alice" {
+		t.Errorf("Expected the principal, got %q", got)
+	}
+
+	authn.Disabled = true
+	if got := authn.clientKey(r); got != "ip:203.0.113.7" {
+		t.Errorf("Anonymous requests should fall back to the remote IP, got %q", got)
+	}
+}
+
+func TestRouteLimit(t *testing.T) {
+	limits := map[string]ratelimit.Limit{"/pay": {Rate: 5, Burst: 10}, "*": {Rate: 50, Burst: 100}}
+	if l, _ := routeLimit(limits, "/pay"); l.Rate != 5 {
+		t.Errorf("Expected the /pay limit, got %v", l)
+	}
+	if l, _ := routeLimit(limits, "/webhooks"); l.Rate != 50 {
+		t.Errorf("Expected the default limit, got %v", l)
+	}
+	if _, ok := routeLimit(map[string]ratelimit.Limit{}, "/pay"); ok {
+		t.Error("Routes without a limit should be unlimited")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReconciliationItem is a transaction that didn't match. Amounts are nil on
+// the side the transaction is missing from; Line is the settlement file line.
+// The ledger amount of a converted payment is the amount it was paid with,
+// and Currency is set to its currency.
+type ReconciliationItem struct {
+	TransactionID string   `json:"transactionID"`
+	UserID        string   `json:"userID,omitempty"`
+	Line          int      `json:"line,omitempty"`
+	LedgerAmount  *float64 `json:"ledgerAmount,omitempty"`
+	SettledAmount *float64 `json:"settledAmount,omitempty"`
+	Currency      string   `json:"currency,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// ReconciliationReport compares a settlement file with the ledger.
+// MissingInternally lists settled transactions the ledger doesn't have,
+// MissingExternally ledger transactions in the period the file doesn't
+// have, and Invalid settlement rows that couldn't be read.
+type ReconciliationReport struct {
+	From              time.Time            `json:"from,omitzero"`
+	To                time.Time            `json:"to,omitzero"`
+	Settled           int                  `json:"settled"`
+	Matched           int                  `json:"matched"`
+	MissingInternally []ReconciliationItem `json:"missingInternally"`
+	MissingExternally []ReconciliationItem `json:"missingExternally"`
+	AmountMismatches  []ReconciliationItem `json:"amountMismatches"`
+	Invalid           []ReconciliationItem `json:"invalid"`
+}
+
+// Balanced reports whether every settled and every ledger transaction matched.
+func (r *ReconciliationReport) Balanced() bool {
+	return len(r.MissingInternally) == 0 && len(r.MissingExternally) == 0 && len(r.AmountMismatches) == 0 && len(r.Invalid) == 0
+}
+
+// settlement is one row of a settlement file. currency is empty when the
+// file has no currency column.
+type settlement struct {
+	line     int
+	amount   float64
+	currency string
+}
+
+// sameAmount compares amounts to the cent, the precision of settlement files.
+func sameAmount(a, b float64) bool {
+	return math.Round(a*100) == math.Round(b*100)
+}
+
+// Reconcile matches the settlement file r against the ledger by
+// transactionID and amount. The file is CSV with transactionID and amount
+// columns, amounts signed like the ledger's, and an optional currency
+// column; other columns are ignored. Converted payments are settled in the
+// currency they were paid with, so they match on that amount and currency;
+// other transactions on their ledger amount, in the ledger currency.
+// Ledger transactions processed in [from, to) that the file lacks are
+// missing externally; zero times leave that end open. A settled transaction
+// processed outside the period still matches. System postings such as fees
+// aren't expected in the file.
+func (s *PaymentService) Reconcile(ctx context.Context, r io.Reader, from, to time.Time) (*ReconciliationReport, error) {
+	report := &ReconciliationReport{
+		From:              from,
+		To:                to,
+		MissingInternally: []ReconciliationItem{},
+		MissingExternally: []ReconciliationItem{},
+		AmountMismatches:  []ReconciliationItem{},
+		Invalid:           []ReconciliationItem{},
+	}
+	settled, err := readSettlements(r, report)
+	if err != nil {
+		return nil, err
+	}
+	report.Settled = len(settled)
+
+	journal, outside, err := s.reconciliationView(ctx, from, to, settled)
+	if err != nil {
+		return nil, err
+	}
+	// Without a Converter every amount is in the one, unnamed, currency.
+	var ledgerCurrency string
+	if s.FX != nil {
+		ledgerCurrency = s.FX.Currency
+	}
+	for i, txn := range journal {
+		if i%exportPageSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		st, ok := settled[txn.TransactionID]
+		if !ok && isSystemID(txn.TransactionID) {
+			// Fees and other system postings never reach the processor.
+			continue
+		}
+		if !ok {
+			amount, currency := settledAs(txn, ledgerCurrency)
+			report.MissingExternally = append(report.MissingExternally, ReconciliationItem{
+				TransactionID: txn.TransactionID, UserID: txn.UserID, LedgerAmount: &amount, Currency: currency,
+			})
+			continue
+		}
+		delete(settled, txn.TransactionID)
+		report.match(txn, st, ledgerCurrency)
+	}
+
+	// What's left was not processed in the period, if at all.
+	leftover := make([]string, 0, len(settled))
+	for txnID := range settled {
+		leftover = append(leftover, txnID)
+	}
+	sort.Slice(leftover, func(i, j int) bool { return settled[leftover[i]].line < settled[leftover[j]].line })
+	for _, txnID := range leftover {
+		st := settled[txnID]
+		if txn, ok := outside[txnID]; ok {
+			report.match(txn, st, ledgerCurrency)
+			continue
+		}
+		report.MissingInternally = append(report.MissingInternally, ReconciliationItem{
+			TransactionID: txnID, Line: st.line, SettledAmount: &st.amount, Currency: st.currency,
+		})
+	}
+	sort.Slice(report.AmountMismatches, func(i, j int) bool { return report.AmountMismatches[i].Line < report.AmountMismatches[j].Line })
+
+	slog.InfoContext(ctx, "reconciliation finished", "settled", report.Settled, "matched", report.Matched,
+		"missingInternally", len(report.MissingInternally), "missingExternally", len(report.MissingExternally),
+		"amountMismatches", len(report.AmountMismatches), "invalid", len(report.Invalid))
+	return report, nil
+}
+
+// reconciliationView returns the transactions processed in [from, to), as
+// journalPeriod does, and those of the settled transactions that were
+// processed outside it, in one pass under the lock.
+func (s *PaymentService) reconciliationView(ctx context.Context, from, to time.Time, settled map[string]settlement) ([]*Transaction, map[string]*Transaction, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer s.mu.RUnlock()
+	journal := s.period(from, to)
+	outside := make(map[string]*Transaction)
+	for txnID := range settled {
+		txn, ok := s.transactions[txnID]
+		if ok && (txn.ProcessedAt.Before(from) || !to.IsZero() && !txn.ProcessedAt.Before(to)) {
+			outside[txnID] = txn
+		}
+	}
+	return journal, outside, nil
+}
+
+// settledAs returns the amount and currency txn is expected to settle in.
+func settledAs(txn *Transaction, ledgerCurrency string) (float64, string) {
+	if conv := txn.Conversion; conv != nil {
+		return conv.Amount, conv.Currency
+	}
+	return txn.Amount, ledgerCurrency
+}
+
+func (r *ReconciliationReport) match(txn *Transaction, st settlement, ledgerCurrency string) {
+	amount, currency := settledAs(txn, ledgerCurrency)
+	if sameAmount(amount, st.amount) && (st.currency == "" || currency == "" || strings.EqualFold(st.currency, currency)) {
+		r.Matched++
+		return
+	}
+	r.AmountMismatches = append(r.AmountMismatches, ReconciliationItem{
+		TransactionID: txn.TransactionID, UserID: txn.UserID, Line: st.line, LedgerAmount: &amount, SettledAmount: &st.amount, Currency: currency,
+	})
+}
+
+// readSettlements reads a settlement file into a map by transactionID.
+// Unreadable rows and repeated transactionIDs are added to report.Invalid;
+// only a file that isn't CSV with the required header is an error.
+func readSettlements(r io.Reader, report *ReconciliationReport) (map[string]settlement, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: read settlement header: %v", ErrInvalidRequest, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"transactionID", "amount"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("%w: settlement header lacks column %q", ErrInvalidRequest, required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i := columns[name]; i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	settled := make(map[string]settlement)
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return settled, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.Invalid = append(report.Invalid, ReconciliationItem{Line: parseErr.Line, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		item := ReconciliationItem{TransactionID: field(record, "transactionID"), Line: line}
+		amount, err := strconv.ParseFloat(field(record, "amount"), 64)
+		switch prev, dup := settled[item.TransactionID]; {
+		case item.TransactionID == "":
+			item.Error = "transactionID is required"
+		case err != nil:
+			item.Error = fmt.Sprintf("invalid amount %q", field(record, "amount"))
+		case dup:
+			item.Error = fmt.Sprintf("transactionID already settled on line %d", prev.line)
+		default:
+			settled[item.TransactionID] = settlement{line: line, amount: amount, currency: field(record, "currency")}
+			continue
+		}
+		report.Invalid = append(report.Invalid, item)
+	}
+}
+
+// HandleReconcile serves POST /admin/reconcile?from=&to= with a settlement
+// CSV as the body, from and to in RFC 3339, and answers with the
+// ReconciliationReport.
+func (s *PaymentService) HandleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var bounds [2]time.Time
+	for i, key := range []string{"from", "to"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			var err error
+			if bounds[i], err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, fmt.Errorf("%w: invalid %s: %v", ErrInvalidRequest, key, err))
+				return
+			}
+		}
+	}
+	report, err := s.Reconcile(r.Context(), r.Body, bounds[0], bounds[1])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newReconcileService records txn-1 to txn-4 on Feb 1 2024, one per hour
+// from midnight, and txn-old on Jan 31.
+func newReconcileService(t *testing.T) *PaymentService {
+	t.Helper()
+	service, clock := newClockedService()
+	ctx := context.Background()
+	clock.t = time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "carol", Amount: 5, TransactionID: "txn-old"})
+	clock.t = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	for _, req := range []PaymentRequest{
+		{UserID: "alice", Amount: 100, TransactionID: "txn-1"},
+		{UserID: "alice", Amount: -20.5, TransactionID: "txn-2"},
+		{UserID: "bob", Amount: 30, TransactionID: "txn-3"},
+		{UserID: "bob", Amount: -10, TransactionID: "txn-4"},
+	} {
+		if _, err := service.ProcessPayment(ctx, req); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+		clock.advance(time.Hour)
+	}
+	return service
+}
+
+const settlementCSV = `settlementID,transactionID,amount,currency
+s-1,txn-1,100.00,EUR
+s-2,txn-2,-20.50,EUR
+s-3,txn-3,31.00,EUR
+s-4,txn-old,5.00,EUR
+s-5,txn-unknown,12.00,EUR
+s-6,txn-1,100.00,EUR
+s-7,,1.00,EUR
+s-8,txn-9,ten,EUR
+`
+
+func TestReconcile(t *testing.T) {
+	service := newReconcileService(t)
+	from := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	report, err := service.Reconcile(context.Background(), strings.NewReader(settlementCSV), from, from.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	// txn-old was processed before the period but is settled, so it matches.
+	if report.Settled != 5 || report.Matched != 3 || report.Balanced() {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if len(report.AmountMismatches) != 1 || report.AmountMismatches[0].TransactionID != "txn-3" ||
+		*report.AmountMismatches[0].LedgerAmount != 30 || *report.AmountMismatches[0].SettledAmount != 31 {
+		t.Errorf("Expected txn-3 to mismatch, got %+v", report.AmountMismatches)
+	}
+	if len(report.MissingInternally) != 1 || report.MissingInternally[0].TransactionID != "txn-unknown" || report.MissingInternally[0].Line != 6 {
+		t.Errorf("Expected txn-unknown to be missing internally, got %+v", report.MissingInternally)
+	}
+	if len(report.MissingExternally) != 1 || report.MissingExternally[0].TransactionID != "txn-4" || report.MissingExternally[0].UserID != "bob" {
+		t.Errorf("Expected txn-4 to be missing externally, got %+v", report.MissingExternally)
+	}
+	if len(report.Invalid) != 3 || report.Invalid[0].Line != 7 || !strings.Contains(report.Invalid[0].Error, "line 2") {
+		t.Errorf("Expected the duplicate, blank and malformed rows to be invalid, got %+v", report.Invalid)
+	}
+}
+
+func TestReconcileBalanced(t *testing.T) {
+	service := newReconcileService(t)
+	settlement := "transactionID,amount\ntxn-old,5\ntxn-1,100\ntxn-2,-20.5\ntxn-3,30\ntxn-4,-10.004\n"
+	report, err := service.Reconcile(context.Background(), strings.NewReader(settlement), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if !report.Balanced() || report.Matched != 5 {
+		t.Errorf("Expected a balanced report, got %+v", report)
+	}
+
+	if _, err := service.Reconcile(context.Background(), strings.NewReader("id,amount\n"), time.Time{}, time.Time{}); err == nil {
+		t.Error("Expected an error for a file without a transactionID column")
+	}
+}
+
+func TestReconcileConverted(t *testing.T) {
+	service, clock, _ := newFXService()
+	ctx := context.Background()
+	service.SetBalance(ctx, "alice", 100)
+	for _, req := range []PaymentRequest{
+		{UserID: "alice", Amount: -10, Currency: "USD", TransactionID: "txn-old"},
+		{UserID: "alice", Amount: -20, Currency: "USD", TransactionID: "txn-1"},
+		{UserID: "alice", Amount: -5, TransactionID: "txn-2"},
+		{UserID: "alice", Amount: -30, Currency: "USD", TransactionID: "txn-3"},
+	} {
+		if _, err := service.ProcessPayment(ctx, req); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+		clock.advance(time.Hour)
+	}
+
+	// txn-3 is settled at its ledger amount instead of what was paid.
+	settlement := "transactionID,amount,currency\ntxn-old,-10,USD\ntxn-1,-20,usd\ntxn-2,-5,EUR\ntxn-3,-27.6,EUR\n"
+	report, err := service.Reconcile(ctx, strings.NewReader(settlement), clockStart.Add(time.Hour), time.Time{})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if report.Matched != 3 || len(report.MissingInternally) != 0 || len(report.MissingExternally) != 0 {
+		t.Errorf("Expected converted payments to match on what was paid, got %+v", report)
+	}
+	if len(report.AmountMismatches) != 1 || report.AmountMismatches[0].TransactionID != "txn-3" ||
+		*report.AmountMismatches[0].LedgerAmount != -30 || report.AmountMismatches[0].Currency != "USD" {
+		t.Errorf("Expected txn-3 to mismatch, got %+v", report.AmountMismatches)
+	}
+}
+
+func TestHandleReconcile(t *testing.T) {
+	service := newReconcileService(t)
+	handler := asAdmin(requireAdmin(service.HandleReconcile))
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/reconcile?from=2024-02-01T00:00:00Z&to=2024-02-02T00:00:00Z", strings.NewReader(settlementCSV)))
+	var report ReconciliationReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil || w.Code != http.StatusOK || report.Matched != 3 {
+		t.Fatalf("Unexpected response %d %+v %v", w.Code, report, err)
+	}
+
+	for _, target := range []string{"/admin/reconcile?from=yesterday", "/admin/reconcile"} {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader("")))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+}
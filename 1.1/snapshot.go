@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrCorruptSnapshot is returned for a snapshot that can't be restored: it
+// is truncated, fails its checksum or contradicts itself.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// Version 2 added balance checkpoints. Version 1 snapshots are still
+// restored, with their checkpoints rebuilt from the transactions.
+const (
+	snapshotFormat  = "payment-snapshot"
+	snapshotVersion = 2
+)
+
+// A snapshot file is JSON lines: a header, one line per balance, one line
+// per transaction in commit order, one line per balance checkpoint, and a
+// trailer holding the SHA-256 of every line before it.
+type snapshotHeader struct {
+	Format       string    `json:"format"`
+	Version      int       `json:"version"`
+	TakenAt      time.Time `json:"takenAt"`
+	Balances     int       `json:"balances"`
+	Transactions int       `json:"transactions"`
+	Checkpoints  int       `json:"checkpoints"`
+}
+
+type snapshotRecord struct {
+	Balance     *BalanceResponse    `json:"balance,omitempty"`
+	Transaction *Transaction        `json:"transaction,omitempty"`
+	Checkpoint  *snapshotCheckpoint `json:"checkpoint,omitempty"`
+	SHA256      string              `json:"sha256,omitempty"`
+}
+
+type snapshotCheckpoint struct {
+	UserID string `json:"userID"`
+	balanceCheckpoint
+}
+
+// SnapshotInfo describes a snapshot that was written or restored.
+type SnapshotInfo struct {
+	Version      int       `json:"version"`
+	TakenAt      time.Time `json:"takenAt"`
+	Balances     int       `json:"balances"`
+	Transactions int       `json:"transactions"`
+	SHA256       string    `json:"sha256"`
+}
+
+// snapshotWriter encodes lines while hashing them.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	sum hash.Hash
+	enc *json.Encoder
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	sw := &snapshotWriter{w: bufio.NewWriter(w), sum: sha256.New()}
+	sw.enc = json.NewEncoder(io.MultiWriter(sw.w, sw.sum))
+	return sw
+}
+
+// WriteSnapshot writes the balances, sorted by user ID, and transactions as
+// of one instant. The lock is only held to copy the balances; transactions
+// are read from the append-only journal afterwards, so payments are not held
+// up while the snapshot is encoded.
+func (s *PaymentService) WriteSnapshot(ctx context.Context, w io.Writer) (*SnapshotInfo, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	balances := make([]BalanceResponse, 0, len(s.balances))
+	for userID, balance := range s.balances {
+		balances = append(balances, BalanceResponse{UserID: userID, Balance: balance})
+	}
+	journal := s.journal[:len(s.journal):len(s.journal)]
+	// Checkpoints are append-only like the journal, so the slices can be
+	// read after unlocking.
+	checkpoints := make(map[string][]balanceCheckpoint, len(s.checkpoints))
+	numCheckpoints := 0
+	for userID, cps := range s.checkpoints {
+		checkpoints[userID] = cps[:len(cps):len(cps)]
+		numCheckpoints += len(cps)
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(balances, func(a, b BalanceResponse) int { return strings.Compare(a.UserID, b.UserID) })
+
+	info := &SnapshotInfo{Version: snapshotVersion, TakenAt: s.now().UTC(), Balances: len(balances), Transactions: len(journal)}
+	sw := newSnapshotWriter(w)
+	if err := sw.enc.Encode(snapshotHeader{
+		Format:       snapshotFormat,
+		Version:      info.Version,
+		TakenAt:      info.TakenAt,
+		Balances:     info.Balances,
+		Transactions: info.Transactions,
+		Checkpoints:  numCheckpoints,
+	}); err != nil {
+		return nil, err
+	}
+	for i := range balances {
+		if err := sw.enc.Encode(snapshotRecord{Balance: &balances[i]}); err != nil {
+			return nil, err
+		}
+	}
+	for i, txn := range journal {
+		if i%exportPageSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if err := sw.enc.Encode(snapshotRecord{Transaction: txn}); err != nil {
+			return nil, err
+		}
+	}
+	for _, userID := range slices.Sorted(maps.Keys(checkpoints)) {
+		for _, cp := range checkpoints[userID] {
+			if err := sw.enc.Encode(snapshotRecord{Checkpoint: &snapshotCheckpoint{UserID: userID, balanceCheckpoint: cp}}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	info.SHA256 = hex.EncodeToString(sw.sum.Sum(nil))
+	if err := json.NewEncoder(sw.w).Encode(snapshotRecord{SHA256: info.SHA256}); err != nil {
+		return nil, err
+	}
+	return info, sw.w.Flush()
+}
+
+// SaveSnapshot writes a snapshot to path. It is written to a temporary file
+// in the same directory first and renamed into place, so path always holds
+// a complete snapshot.
+func (s *PaymentService) SaveSnapshot(ctx context.Context, path string) (*SnapshotInfo, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	info, err := s.WriteSnapshot(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "snapshot saved", "path", path, "balances", info.Balances,
+		"transactions", info.Transactions, "sha256", info.SHA256)
+	return info, nil
+}
+
+// RestoreSnapshot replaces the service's balances and transactions with the
+// snapshot read from r. The whole snapshot is read and verified before
+// anything is replaced, so a corrupt snapshot leaves the service untouched.
+// No events are emitted for the restored transactions; balance streams are
+// disconnected instead and resync from a snapshot when they reconnect.
+// Events still waiting in the outbox describe the replaced state and are
+// dropped, and quotes are only used up if a restored transaction paid with
+// them.
+func (s *PaymentService) RestoreSnapshot(ctx context.Context, r io.Reader) (*SnapshotInfo, error) {
+	state, info, err := readSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	s.transactions = state.transactions
+	s.balances = state.balances
+	s.refunded = state.refunded
+	s.history = state.history
+	s.journal = state.journal
+	s.checkpoints = state.checkpoints
+	s.hub.reset()
+	s.FX.restore(state.journal)
+	dropped := s.outbox.discard()
+	s.mu.Unlock()
+	if dropped > 0 {
+		slog.WarnContext(ctx, "dropped outbox events of the replaced state", "events", dropped)
+	}
+	return info, nil
+}
+
+// LoadSnapshot restores the snapshot at path. A missing file is reported
+// as an error satisfying errors.Is(err, fs.ErrNotExist).
+func (s *PaymentService) LoadSnapshot(ctx context.Context, path string) (*SnapshotInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := s.RestoreSnapshot(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	slog.InfoContext(ctx, "snapshot restored", "path", path, "takenAt", info.TakenAt,
+		"balances", info.Balances, "transactions", info.Transactions)
+	return info, nil
+}
+
+// snapshotState is the part of PaymentService a snapshot restores.
+type snapshotState struct {
+	transactions map[string]*Transaction
+	balances     map[string]float64
+	refunded     map[string]float64
+	history      map[string][]*Transaction
+	journal      []*Transaction
+	checkpoints  map[string][]balanceCheckpoint
+}
+
+func readSnapshot(r io.Reader) (*snapshotState, *SnapshotInfo, error) {
+	corrupt := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrCorruptSnapshot, fmt.Sprintf(format, args...))
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	sum := sha256.New()
+	next := func() ([]byte, error) {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, corrupt("unexpected end of file")
+		}
+		return scanner.Bytes(), nil
+	}
+
+	line, err := next()
+	if err != nil {
+		return nil, nil, err
+	}
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Format != snapshotFormat {
+		return nil, nil, corrupt("not a snapshot file")
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version %d, want at most %d", header.Version, snapshotVersion)
+	}
+	sum.Write(line)
+	sum.Write([]byte{'\n'})
+
+	state := &snapshotState{
+		transactions: make(map[string]*Transaction),
+		balances:     make(map[string]float64),
+		refunded:     make(map[string]float64),
+		history:      make(map[string][]*Transaction),
+		checkpoints:  make(map[string][]balanceCheckpoint),
+	}
+	numCheckpoints := 0
+	for n := 1; ; n++ {
+		line, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		var rec snapshotRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, nil, corrupt("line %d: %v", n+1, err)
+		}
+		switch {
+		case rec.SHA256 != "":
+			if got := hex.EncodeToString(sum.Sum(nil)); got != rec.SHA256 {
+				return nil, nil, corrupt("checksum mismatch: file says %s, content hashes to %s", rec.SHA256, got)
+			}
+			if len(state.balances) != header.Balances || len(state.journal) != header.Transactions || numCheckpoints != header.Checkpoints {
+				return nil, nil, corrupt("header announces %d balances, %d transactions and %d checkpoints, found %d, %d and %d",
+					header.Balances, header.Transactions, header.Checkpoints, len(state.balances), len(state.journal), numCheckpoints)
+			}
+			if scanner.Scan() {
+				return nil, nil, corrupt("data after the checksum")
+			}
+			if header.Version == 1 {
+				state.checkpoints = rebuildCheckpoints(state.history, state.balances, header.TakenAt)
+			}
+			return state, &SnapshotInfo{
+				Version:      header.Version,
+				TakenAt:      header.TakenAt,
+				Balances:     header.Balances,
+				Transactions: header.Transactions,
+				SHA256:       rec.SHA256,
+			}, nil
+		case rec.Balance != nil:
+			state.balances[rec.Balance.UserID] = rec.Balance.Balance
+		case rec.Transaction != nil:
+			txn := rec.Transaction
+			if _, dup := state.transactions[txn.TransactionID]; dup {
+				return nil, nil, corrupt("line %d: duplicate transaction %s", n+1, txn.TransactionID)
+			}
+			state.transactions[txn.TransactionID] = txn
+			state.history[txn.UserID] = append(state.history[txn.UserID], txn)
+			state.journal = append(state.journal, txn)
+			if txn.RefundOf != "" {
+				state.refunded[txn.RefundOf] += math.Abs(txn.Amount)
+			}
+		case rec.Checkpoint != nil:
+			cp := rec.Checkpoint
+			if cp.Index < 0 || cp.Index > len(state.history[cp.UserID]) {
+				return nil, nil, corrupt("line %d: checkpoint of %s past its %d transactions", n+1, cp.UserID, len(state.history[cp.UserID]))
+			}
+			state.checkpoints[cp.UserID] = append(state.checkpoints[cp.UserID], cp.balanceCheckpoint)
+			numCheckpoints++
+		default:
+			return nil, nil, corrupt("line %d: empty record", n+1)
+		}
+		sum.Write(line)
+		sum.Write([]byte{'\n'})
+	}
+}
+
+// HandleSnapshot serves POST /admin/snapshot, which saves a snapshot to
+// SnapshotFile and answers with its SnapshotInfo, and GET /admin/snapshot,
+// which streams a fresh snapshot as the response body.
+func (s *PaymentService) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if _, err := s.WriteSnapshot(r.Context(), w); err != nil {
+			// The status line is gone by now; the missing checksum line tells
+			// the client the snapshot is incomplete.
+			slog.ErrorContext(r.Context(), "snapshot download failed", "error", err)
+		}
+	case http.MethodPost:
+		if s.SnapshotFile == "" {
+			writeError(w, fmt.Errorf("%w: no snapshot file configured", ErrInvalidRequest))
+			return
+		}
+		info, err := s.SaveSnapshot(r.Context(), s.SnapshotFile)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "snapshot failed", "error", err)
+			if r.Context().Err() != nil {
+				writeError(w, err)
+				return
+			}
+			http.Error(w, "snapshot failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	service.SetBalance(ctx, "carol", 7.25)
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 100, TransactionID: "txn-1"})
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -40, TransactionID: "txn-2"})
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 30, TransactionID: "txn-3", RefundOf: "txn-2"})
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "bob", Amount: 5, TransactionID: "txn-4"})
+
+	var buf bytes.Buffer
+	written, err := service.WriteSnapshot(ctx, &buf)
+	if err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	if written.Balances != 3 || written.Transactions != 4 {
+		t.Errorf("Unexpected snapshot info %+v", written)
+	}
+
+	restored := NewPaymentService()
+	info, err := restored.RestoreSnapshot(ctx, &buf)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	if info.SHA256 != written.SHA256 || !info.TakenAt.Equal(written.TakenAt) {
+		t.Errorf("Expected the restored info %+v to match the written one %+v", info, written)
+	}
+	for userID, want := range map[string]float64{"alice": 90, "bob": 5, "carol": 7.25} {
+		if got := balanceOf(t, restored, userID); got != want {
+			t.Errorf("Expected %s's balance %.2f, got %.2f", userID, want, got)
+		}
+	}
+	txns, _ := restored.ListTransactions(ctx, "alice")
+	if len(txns) != 3 || txns[2].RefundOf != "txn-2" {
+		t.Errorf("Expected alice's history to be restored, got %+v", txns)
+	}
+
+	// Idempotency and refund limits carry over.
+	resp, err := restored.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 100, TransactionID: "txn-1"})
+	if err != nil || !strings.Contains(resp.Message, "idempotent") {
+		t.Errorf("Expected an idempotent response for a restored transaction, got %+v, %v", resp, err)
+	}
+	if _, err := restored.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 20, TransactionID: "txn-5", RefundOf: "txn-2"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected the refund to exceed the refundable amount, got %v", err)
+	}
+}
+
+func TestSnapshotIsConsistentUnderLoad(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				service.ProcessPayment(ctx, PaymentRequest{UserID: fmt.Sprintf("user-%d", i%5), Amount: 1, TransactionID: fmt.Sprintf("w%d-%d", w, i)})
+			}
+		}()
+	}
+
+	var buf bytes.Buffer
+	if _, err := service.WriteSnapshot(ctx, &buf); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	wg.Wait()
+
+	restored := NewPaymentService()
+	if _, err := restored.RestoreSnapshot(ctx, &buf); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	// Every balance must equal the sum of the transactions in the snapshot.
+	for i := 0; i < 5; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		txns, _ := restored.ListTransactions(ctx, userID)
+		if balance := balanceOf(t, restored, userID); balance != float64(len(txns)) {
+			t.Errorf("%s: balance %.2f doesn't match %d transactions", userID, balance, len(txns))
+		}
+	}
+}
+
+func TestRestoreRejectsCorruptSnapshots(t *testing.T) {
+	service := NewPaymentService()
+	ctx := context.Background()
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 100, TransactionID: "txn-1"})
+	var buf bytes.Buffer
+	if _, err := service.WriteSnapshot(ctx, &buf); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	snapshot := buf.String()
+	lines := strings.SplitAfter(snapshot, "\n")
+
+	tests := []struct {
+		name     string
+		snapshot string
+		want     error
+	}{
+		{"Tampered", strings.Replace(snapshot, `"balance":100`, `"balance":900`, 1), ErrCorruptSnapshot},
+		{"Truncated", strings.Join(lines[:len(lines)-2], ""), ErrCorruptSnapshot},
+		{"Trailing data", snapshot + lines[1], ErrCorruptSnapshot},
+		{"Not a snapshot", "userID,amount\n", ErrCorruptSnapshot},
+		{"Empty", "", ErrCorruptSnapshot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := NewPaymentService()
+			target.SetBalance(ctx, "bob", 1)
+			if _, err := target.RestoreSnapshot(ctx, strings.NewReader(tt.snapshot)); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+			if balanceOf(t, target, "bob") != 1 || balanceOf(t, target, "alice") != 0 {
+				t.Error("A failed restore must leave the service untouched")
+			}
+		})
+	}
+
+	future := strings.Replace(snapshot, `"version":2`, `"version":3`, 1)
+	if _, err := NewPaymentService().RestoreSnapshot(ctx, strings.NewReader(future)); err == nil || !strings.Contains(err.Error(), "unsupported snapshot version 3") {
+		t.Errorf("Expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestSaveAndLoadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.snapshot")
+	ctx := context.Background()
+	if _, err := NewPaymentService().LoadSnapshot(ctx, path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist for a missing snapshot, got %v", err)
+	}
+
+	service := NewPaymentService()
+	service.SnapshotFile = path
+	service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: 42, TransactionID: "txn-1"})
+	handler := asAdmin(requireAdmin(service.HandleSnapshot))
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/snapshot", nil))
+	var info SnapshotInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil || w.Code != http.StatusOK || info.Transactions != 1 {
+		t.Fatalf("Unexpected snapshot response %d %+v %v", w.Code, info, err)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp-*"); len(matches) != 0 {
+		t.Errorf("Expected no temporary files to be left behind, got %v", matches)
+	}
+
+	restored := NewPaymentService()
+	loaded, err := restored.LoadSnapshot(ctx, path)
+	if err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	if loaded.SHA256 != info.SHA256 || balanceOf(t, restored, "alice") != 42 {
+		t.Errorf("Expected the saved snapshot to be restored, got %+v", loaded)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+	if _, err := NewPaymentService().RestoreSnapshot(ctx, w.Body); err != nil {
+		t.Errorf("Expected the downloaded snapshot to restore, got %v", err)
+	}
+
+	service.SnapshotFile = ""
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/snapshot", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a snapshot file, got %d", w.Code)
+	}
+}
+
+func TestRestoreResetsOutboxAndQuotes(t *testing.T) {
+	service, _, _ := newFXService()
+	ctx := context.Background()
+	service.SetBalance(ctx, "alice", 100)
+	kept, _ := service.FX.NewQuote(ctx, "USD", -10)
+	respent, _ := service.FX.NewQuote(ctx, "USD", -20)
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -10, QuoteID: kept.QuoteID, TransactionID: "txn-1"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := service.WriteSnapshot(ctx, &buf); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -20, QuoteID: respent.QuoteID, TransactionID: "txn-2"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+
+	if _, err := service.RestoreSnapshot(ctx, &buf); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	if n := service.Outbox().Len(); n != 0 {
+		t.Errorf("Expected the outbox to be emptied, got %d records", n)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -10, QuoteID: kept.QuoteID, TransactionID: "txn-3"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected a quote used before the snapshot to stay used, got %v", err)
+	}
+	if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: "alice", Amount: -20, QuoteID: respent.QuoteID, TransactionID: "txn-2"}); err != nil {
+		t.Errorf("Expected a quote used after the snapshot to be usable again, got %v", err)
+	}
+	if balance := balanceOf(t, service, "alice"); balance != 72.4 {
+		t.Errorf("Expected balance 72.40, got %.2f", balance)
+	}
+	if pending := service.Outbox().Pending(0); len(pending) != 1 || pending[0].Seq != 3 {
+		t.Errorf("Expected outbox sequence numbers to carry on, got %+v", pending)
+	}
+}
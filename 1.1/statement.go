@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Posting types.
+const (
+	postingPayment    = "payment"
+	postingRefund     = "refund"
+	postingFee        = "fee"
+	postingAdjustment = "adjustment"
+	postingInterest   = "interest"
+)
+
+// Posting is one change of a user's balance on a Statement. Adjustments are
+// balances set directly with SetBalance and have no transaction.
+type Posting struct {
+	TransactionID string    `json:"transactionID,omitempty"`
+	Type          string    `json:"type"`
+	RefundOf      string    `json:"refundOf,omitempty"`
+	FeeOf         string    `json:"feeOf,omitempty"`
+	Amount        float64   `json:"amount"`
+	Balance       float64   `json:"balance"`
+	PostedAt      time.Time `json:"postedAt"`
+}
+
+// Statement lists a user's postings in [From, To) with the running balance
+// after each.
+type Statement struct {
+	UserID         string    `json:"userID"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	OpeningBalance float64   `json:"openingBalance"`
+	Postings       []Posting `json:"postings"`
+	ClosingBalance float64   `json:"closingBalance"`
+}
+
+// StatementPeriod returns the bounds of the UTC day ("day", date as
+// 2006-01-02) or month ("month", date as 2006-01) containing date.
+func StatementPeriod(period, date string) (from, to time.Time, err error) {
+	switch period {
+	case "day":
+		if from, err = time.Parse(time.DateOnly, date); err == nil {
+			return from, from.AddDate(0, 0, 1), nil
+		}
+	case "month":
+		if from, err = time.Parse("2006-01", date); err == nil {
+			return from, from.AddDate(0, 1, 0), nil
+		}
+	default:
+		return from, to, fmt.Errorf("%w: unknown period %q, want day or month", ErrInvalidRequest, period)
+	}
+	return from, to, fmt.Errorf("%w: invalid %s %q", ErrInvalidRequest, period, date)
+}
+
+// Statement builds the user's statement for [from, to). The opening balance
+// is the balance as of just before from; the closing balance is the opening
+// balance plus every posting.
+func (s *PaymentService) Statement(ctx context.Context, userID string, from, to time.Time) (*Statement, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("%w: statement period must end after it starts", ErrInvalidRequest)
+	}
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	opening, next := s.balanceAt(userID, from.Add(-time.Nanosecond))
+	st := &Statement{UserID: userID, From: from.UTC(), To: to.UTC(), OpeningBalance: opening, Postings: []Posting{}}
+	balance := opening
+
+	// Checkpoints within the period whose balance differs from the running
+	// balance were recorded by SetBalance and become adjustments.
+	cps := s.checkpoints[userID]
+	c := sort.Search(len(cps), func(i int) bool { return !cps[i].At.Before(from) })
+	adjust := func(upTo int) {
+		for ; c < len(cps) && cps[c].Index <= upTo && cps[c].At.Before(to); c++ {
+			if cps[c].Balance != balance {
+				st.Postings = append(st.Postings, Posting{
+					Type:     postingAdjustment,
+					Amount:   cps[c].Balance - balance,
+					Balance:  cps[c].Balance,
+					PostedAt: cps[c].At.UTC(),
+				})
+				balance = cps[c].Balance
+			}
+		}
+	}
+
+	history := s.history[userID]
+	for ; next < len(history) && history[next].ProcessedAt.Before(to); next++ {
+		adjust(next)
+		txn := history[next]
+		balance += txn.Amount
+		posting := Posting{
+			TransactionID: txn.TransactionID,
+			Type:          postingPayment,
+			RefundOf:      txn.RefundOf,
+			FeeOf:         txn.FeeOf,
+			Amount:        txn.Amount,
+			Balance:       balance,
+			PostedAt:      txn.ProcessedAt.UTC(),
+		}
+		switch {
+		case txn.RefundOf != "":
+			posting.Type = postingRefund
+		case txn.FeeOf != "":
+			posting.Type = postingFee
+		case txn.InterestFor != "":
+			posting.Type = postingInterest
+		}
+		st.Postings = append(st.Postings, posting)
+	}
+	adjust(next)
+	st.ClosingBalance = balance
+	return st, nil
+}
+
+func formatMoney(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// WriteJSON writes the statement as indented JSON.
+func (st *Statement) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(st)
+}
+
+// WriteCSV writes one row per posting between an opening and a closing row.
+func (st *Statement) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"postedAt", "transactionID", "type", "refundOf", "feeOf", "amount", "balance"})
+	cw.Write([]string{st.From.Format(time.RFC3339), "", "opening", "", "", "", formatMoney(st.OpeningBalance)})
+	for _, p := range st.Postings {
+		cw.Write([]string{p.PostedAt.Format(time.RFC3339Nano), p.TransactionID, p.Type, p.RefundOf, p.FeeOf, formatMoney(p.Amount), formatMoney(p.Balance)})
+	}
+	cw.Write([]string{st.To.Format(time.RFC3339), "", "closing", "", "", "", formatMoney(st.ClosingBalance)})
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteText renders the statement for people: text columns left-aligned,
+// amounts right-aligned.
+func (st *Statement) WriteText(w io.Writer) error {
+	rows := [][]string{{"Date", "Transaction", "Type", "Amount", "Balance"}, {"", "", "Opening balance", "", formatMoney(st.OpeningBalance)}}
+	for _, p := range st.Postings {
+		rows = append(rows, []string{p.PostedAt.Format(time.DateTime), p.TransactionID, p.Type, formatMoney(p.Amount), formatMoney(p.Balance)})
+	}
+	rows = append(rows, []string{"", "", "Closing balance", "", formatMoney(st.ClosingBalance)})
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Statement for %s\n", st.UserID)
+	fmt.Fprintf(bw, "Period: %s to %s (UTC)\n\n", st.From.Format(time.DateTime), st.To.Format(time.DateTime))
+	for _, row := range rows {
+		fmt.Fprintf(bw, "%-*s  %-*s  %-*s  %*s  %*s\n", widths[0], row[0], widths[1], row[1], widths[2], row[2], widths[3], row[3], widths[4], row[4])
+	}
+	return bw.Flush()
+}
+
+var statementContentTypes = map[string]string{
+	"":     "application/json",
+	"json": "application/json",
+	"csv":  "text/csv",
+	"text": "text/plain; charset=utf-8",
+}
+
+// HandleStatement serves GET /users/{id}/statement?period=day|month&date=,
+// with date as 2006-01-02 or 2006-01, and format json (default), csv or text.
+func (s *PaymentService) HandleStatement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	userID := r.PathValue("id")
+	if err := authorizeUser(ctx, userID); err != nil {
+		writeError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	from, to, err := StatementPeriod(query.Get("period"), query.Get("date"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	format := query.Get("format")
+	contentType, ok := statementContentTypes[format]
+	if !ok {
+		writeError(w, fmt.Errorf("%w: unknown format %q, want json, csv or text", ErrInvalidRequest, format))
+		return
+	}
+
+	st, err := s.Statement(ctx, userID, from, to)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	switch format {
+	case "csv":
+		err = st.WriteCSV(w)
+	case "text":
+		err = st.WriteText(w)
+	default:
+		err = st.WriteJSON(w)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to write statement", "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s doesn't match, run go test -update to accept:\ngot\n%s\nwant\n%s", path, got, want)
+	}
+}
+
+// newStatementService gives alice postings on Jan 31, Feb 1 and Feb 2 2024,
+// including a refund and a balance set by an admin, and bob a payment that
+// must not show up on her statement.
+func newStatementService(t *testing.T) *PaymentService {
+	t.Helper()
+	service, clock := newClockedService()
+	ctx := context.Background()
+	at := func(s string) {
+		ts, err := time.Parse(time.DateTime, s)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		clock.t = ts
+	}
+	pay := func(userID string, amount float64, txnID, refundOf string) {
+		if _, err := service.ProcessPayment(ctx, PaymentRequest{UserID: userID, Amount: amount, TransactionID: txnID, RefundOf: refundOf}); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+	}
+
+	at("2024-01-31 09:00:00")
+	pay("alice", 500, "deposit-1", "")
+	at("2024-01-31 23:59:59")
+	pay("alice", -20, "coffee-1", "")
+	at("2024-02-01 00:00:00")
+	pay("alice", -120.5, "order-1", "")
+	at("2024-02-01 08:30:00")
+	pay("bob", 75, "deposit-2", "")
+	at("2024-02-01 12:15:00")
+	pay("alice", 40.25, "refund-1", "order-1")
+	at("2024-02-01 18:00:00")
+	service.SetBalance(ctx, "alice", 1000)
+	at("2024-02-01 23:59:59")
+	pay("alice", -0.1, "fee-1", "")
+	at("2024-02-02 10:00:00")
+	pay("alice", -300, "rent-1", "")
+	return service
+}
+
+func TestStatementGolden(t *testing.T) {
+	service := newStatementService(t)
+	from, to, err := StatementPeriod("day", "2024-02-01")
+	if err != nil {
+		t.Fatalf("StatementPeriod failed: %v", err)
+	}
+	st, err := service.Statement(context.Background(), "alice", from, to)
+	if err != nil {
+		t.Fatalf("Statement failed: %v", err)
+	}
+	if st.OpeningBalance != 480 || st.ClosingBalance != 999.9 || len(st.Postings) != 4 || st.Postings[2].Type != postingAdjustment {
+		t.Errorf("Unexpected statement %+v", st)
+	}
+
+	for _, tt := range []struct {
+		golden string
+		write  func(io.Writer) error
+	}{
+		{"statement_day.json", st.WriteJSON},
+		{"statement_day.csv", st.WriteCSV},
+		{"statement_day.txt", st.WriteText},
+	} {
+		var buf bytes.Buffer
+		if err := tt.write(&buf); err != nil {
+			t.Fatalf("%s: write failed: %v", tt.golden, err)
+		}
+		checkGolden(t, tt.golden, buf.Bytes())
+	}
+}
+
+func TestStatementMonth(t *testing.T) {
+	service := newStatementService(t)
+	ctx := context.Background()
+	from, to, err := StatementPeriod("month", "2024-02")
+	if err != nil {
+		t.Fatalf("StatementPeriod failed: %v", err)
+	}
+	if !to.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected February to end on March 1, got %v", to)
+	}
+	st, err := service.Statement(ctx, "alice", from, to)
+	if err != nil {
+		t.Fatalf("Statement failed: %v", err)
+	}
+	if st.OpeningBalance != 480 || st.ClosingBalance != 699.9 || len(st.Postings) != 5 {
+		t.Errorf("Unexpected statement %+v", st)
+	}
+	// The closing balance of one period is the opening balance of the next.
+	march, err := service.Statement(ctx, "alice", to, to.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatalf("Statement failed: %v", err)
+	}
+	if march.OpeningBalance != st.ClosingBalance || len(march.Postings) != 0 {
+		t.Errorf("Unexpected March statement %+v", march)
+	}
+
+	for _, tt := range []struct{ period, date string }{
+		{"week", "2024-02-01"},
+		{"day", "2024-02"},
+		{"month", "February"},
+	} {
+		if _, _, err := StatementPeriod(tt.period, tt.date); err == nil {
+			t.Errorf("Expected an error for %s %q", tt.period, tt.date)
+		}
+	}
+}
+
+func TestHandleStatement(t *testing.T) {
+	service := newStatementService(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/{id}/statement", asAdmin(service.HandleStatement))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/alice/statement?period=day&date=2024-02-01&format=csv", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("Unexpected response %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	checkGolden(t, "statement_day.csv", w.Body.Bytes())
+
+	for _, target := range []string{
+		"/users/alice/statement?period=day&date=2024-02-01&format=pdf",
+		"/users/alice/statement?period=year&date=2024",
+		"/users/alice/statement",
+	} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHubHistory    = 1024
+	defaultSubscriberBuf = 64
+	streamHeartbeat      = 15 * time.Second
+)
+
+type BalanceUpdate struct {
+	Epoch         string    `json:"epoch"`
+	Seq           uint64    `json:"seq"`
+	UserID        string    `json:"userID"`
+	TransactionID string    `json:"transactionID,omitempty"`
+	Amount        float64   `json:"amount"`
+	Balance       float64   `json:"balance"`
+	PostedAt      time.Time `json:"postedAt"`
+}
+
+// BalanceHub fans out balance postings to per-user subscribers. It keeps a
+// bounded history of recent postings so a reconnecting client can resume
+// from its Last-Event-ID. Publishing never blocks: a subscriber whose buffer
+// is full is disconnected and is expected to reconnect and resume.
+//
+// Sequence numbers start at 1 in every process and after every reset, so
+// event IDs also carry the hub's epoch: a client resuming with an ID from
+// another epoch gets a fresh snapshot.
+type BalanceHub struct {
+	mu          sync.Mutex
+	epoch       string
+	nextSeq     uint64
+	history     []BalanceUpdate
+	historySize int
+	bufferSize  int
+	subscribers map[string]map[*BalanceSubscription]struct{}
+	closed      bool
+}
+
+type BalanceSubscription struct {
+	hub    *BalanceHub
+	userID string
+	ch     chan BalanceUpdate
+	closed bool
+}
+
+// C returns the channel of live updates. It is closed when the subscription
+// is closed or dropped for falling behind.
+func (sub *BalanceSubscription) C() <-chan BalanceUpdate {
+	return sub.ch
+}
+
+func (sub *BalanceSubscription) Close() {
+	sub.hub.mu.Lock()
+	defer sub.hub.mu.Unlock()
+	sub.hub.remove(sub)
+}
+
+func NewBalanceHub() *BalanceHub {
+	return &BalanceHub{
+		epoch:       newEpoch(),
+		nextSeq:     1,
+		historySize: defaultHubHistory,
+		bufferSize:  defaultSubscriberBuf,
+		subscribers: make(map[string]map[*BalanceSubscription]struct{}),
+	}
+}
+
+func newEpoch() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func (h *BalanceHub) publish(userID, transactionID string, amount, balance float64, postedAt time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	update := BalanceUpdate{
+		Epoch:         h.epoch,
+		Seq:           h.nextSeq,
+		UserID:        userID,
+		TransactionID: transactionID,
+		Amount:        amount,
+		Balance:       balance,
+		PostedAt:      postedAt,
+	}
+	h.nextSeq++
+
+	h.history = append(h.history, update)
+	if len(h.history) > h.historySize {
+		h.history = h.history[len(h.history)-h.historySize:]
+	}
+
+	for sub := range h.subscribers[userID] {
+		select {
+		case sub.ch <- update:
+		default:
+			slog.Warn("dropping slow balance subscriber", "userID", userID, "seq", update.Seq)
+			h.remove(sub)
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the postings for userID after
+// lastSeq of epoch that are still in history, along with the epoch and
+// sequence number of the latest posting. complete is false if some postings
+// after lastSeq were already evicted, or lastSeq is from another epoch, in
+// which case the caller should resync.
+func (h *BalanceHub) subscribe(userID, epoch string, lastSeq uint64) (sub *BalanceSubscription, backlog []BalanceUpdate, latest BalanceUpdate, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	latest = BalanceUpdate{Epoch: h.epoch, Seq: h.nextSeq - 1, UserID: userID}
+	complete = true
+	if lastSeq > 0 && len(h.history) > 0 && h.history[0].Seq > lastSeq+1 {
+		complete = false
+	}
+	if lastSeq > 0 && (epoch != h.epoch || lastSeq >= h.nextSeq) {
+		complete = false
+	}
+	if complete && lastSeq > 0 {
+		for _, u := range h.history {
+			if u.Seq > lastSeq && u.UserID == userID {
+				backlog = append(backlog, u)
+			}
+		}
+	}
+
+	sub = &BalanceSubscription{
+		hub:    h,
+		userID: userID,
+		ch:     make(chan BalanceUpdate, h.bufferSize),
+	}
+	if h.closed {
+		sub.closed = true
+		close(sub.ch)
+		return sub, backlog, latest, complete
+	}
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*BalanceSubscription]struct{})
+	}
+	h.subscribers[userID][sub] = struct{}{}
+	return sub, backlog, latest, complete
+}
+
+// Close disconnects every subscriber, e.g. when the server shuts down.
+// Later subscriptions start out closed.
+func (h *BalanceHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.remove(sub)
+		}
+	}
+}
+
+// reset starts a new epoch with an empty history and disconnects every
+// subscriber, for when balances change wholesale, e.g. on a snapshot
+// restore. Reconnecting clients resync from a fresh snapshot.
+func (h *BalanceHub) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.epoch = newEpoch()
+	h.nextSeq = 1
+	h.history = nil
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.remove(sub)
+		}
+	}
+}
+
+// remove must be called with h.mu held.
+func (h *BalanceHub) remove(sub *BalanceSubscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.ch)
+	delete(h.subscribers[sub.userID], sub)
+	if len(h.subscribers[sub.userID]) == 0 {
+		delete(h.subscribers, sub.userID)
+	}
+}
+
+// SubscribeBalance subscribes to balance postings for userID. It returns a
+// snapshot of the user's current balance at the epoch and sequence number it
+// reflects, taken atomically with the subscription, plus any postings after
+// lastSeq of epoch still in history.
+func (s *PaymentService) SubscribeBalance(userID, epoch string, lastSeq uint64) (sub *BalanceSubscription, snapshot BalanceUpdate, backlog []BalanceUpdate, complete bool) {
+	// Holding the read lock blocks ProcessPayment, so no posting can slip
+	// between the balance read and the subscription.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sub, backlog, snapshot, complete = s.hub.subscribe(userID, epoch, lastSeq)
+	snapshot.Balance = s.balances[userID]
+	return sub, snapshot, backlog, complete
+}
+
+// HandleBalanceStream serves GET /users/{id}/balance/stream as Server-Sent Events.
+// A fresh connection (or one whose Last-Event-ID is too old or from another
+// epoch) starts with a "snapshot" event carrying the current balance; every
+// posting afterwards is sent as a "posting" event whose id, <epoch>-<seq>,
+// can be used to resume.
+func (s *PaymentService) HandleBalanceStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.PathValue("id")
+	if userID == "" {
+		http.Error(w, "userID is required", http.StatusBadRequest)
+		return
+	}
+	if err := authorizeUser(r.Context(), userID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var epoch string
+	var lastSeq uint64
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		var seq string
+		epoch, seq, _ = strings.Cut(lastEventID, "-")
+		if seq == "" {
+			// A bare sequence number from before epochs; it resyncs.
+			epoch, seq = "", lastEventID
+		}
+		parsed, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastSeq = parsed
+	}
+
+	sub, snapshot, backlog, complete := s.SubscribeBalance(userID, epoch, lastSeq)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if lastSeq == 0 || !complete {
+		snapshot.PostedAt = time.Now()
+		if err := writeSSE(w, "snapshot", snapshot); err != nil {
+			return
+		}
+	} else {
+		for _, u := range backlog {
+			if err := writeSSE(w, "posting", u); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case u, ok := <-sub.C():
+			if !ok {
+				// dropped for being too slow; the client will reconnect with Last-Event-ID
+				return
+			}
+			if err := writeSSE(w, "posting", u); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, u BalanceUpdate) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s-%d\nevent: %s\ndata: %s\n\n", u.Epoch, u.Seq, event, data)
+	return err
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id    string
+	event string
+	data  BalanceUpdate
+}
+
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var evt sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if evt.event != "" {
+				return evt
+			}
+		case strings.HasPrefix(line, "id: "):
+			evt.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			evt.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &evt.data); err != nil {
+				t.Fatalf("Failed to decode data: %v", err)
+			}
+		}
+	}
+}
+
+func openStream(t *testing.T, srv *httptest.Server, userID, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/users/"+userID+"/balance/stream", nil)
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %s", ct)
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+// newStreamServer registers its own cleanup so it runs after the stream
+// bodies opened later are closed; otherwise Close would wait on open streams.
+func newStreamServer(t *testing.T, service *PaymentService) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/{id}/balance/stream", asAdmin(service.HandleBalanceStream))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBalanceStreamSnapshotAndPostings(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 100.00)
+	srv := newStreamServer(t, service)
+
+	stream := openStream(t, srv, "user123", "")
+	snapshot := readSSE(t, stream)
+	if snapshot.event != "snapshot" || snapshot.data.Balance != 100.00 {
+		t.Fatalf("Expected snapshot with balance 100.00, got %+v", snapshot)
+	}
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "other", Amount: 5, TransactionID: "txn-other"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -30, TransactionID: "txn-001"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+
+	posting := readSSE(t, stream)
+	if posting.event != "posting" {
+		t.Fatalf("Expected posting event, got %s", posting.event)
+	}
+	if posting.data.TransactionID != "txn-001" || posting.data.Balance != 70.00 || posting.data.Amount != -30 {
+		t.Errorf("Unexpected posting: %+v", posting.data)
+	}
+	if posting.id != fmt.Sprintf("%s-%d", service.hub.epoch, posting.data.Seq) {
+		t.Errorf("Event id %s should be the epoch and seq %d", posting.id, posting.data.Seq)
+	}
+}
+
+func TestBalanceStreamPublishesFees(t *testing.T) {
+	service := NewPaymentService()
+	service.Fees = newFeeEngine(t)
+	service.SetBalance(context.Background(), "alice", 100)
+	srv := newStreamServer(t, service)
+
+	stream := openStream(t, srv, "alice", "")
+	readSSE(t, stream)
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "alice", Amount: -50, TransactionID: "txn-1"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	// The payment and its fee are separate postings, each with the balance
+	// right after it.
+	for _, want := range []BalanceUpdate{
+		{TransactionID: "txn-1", Amount: -50, Balance: 50},
+		{TransactionID: "sys:fee:txn-1", Amount: -1.05, Balance: 48.95},
+	} {
+		got := readSSE(t, stream).data
+		if got.TransactionID != want.TransactionID || got.Amount != want.Amount || got.Balance != want.Balance {
+			t.Errorf("Expected posting %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestBalanceStreamResume(t *testing.T) {
+	service := NewPaymentService()
+	srv := newStreamServer(t, service)
+
+	for i := 1; i <= 3; i++ {
+		if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 10, TransactionID: fmt.Sprintf("txn-%03d", i)}); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+	}
+
+	stream := openStream(t, srv, "user123", service.hub.epoch+"-1")
+	for _, want := range []string{"txn-002", "txn-003"} {
+		evt := readSSE(t, stream)
+		if evt.event != "posting" || evt.data.TransactionID != want {
+			t.Errorf("Expected replayed posting %s, got %+v", want, evt)
+		}
+	}
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 10, TransactionID: "txn-004"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	evt := readSSE(t, stream)
+	if evt.data.TransactionID != "txn-004" || evt.data.Balance != 40.00 {
+		t.Errorf("Expected live posting txn-004 with balance 40.00, got %+v", evt.data)
+	}
+}
+
+func TestBalanceStreamResumeAfterEviction(t *testing.T) {
+	service := NewPaymentService()
+	service.hub.historySize = 2
+	srv := newStreamServer(t, service)
+
+	for i := 1; i <= 5; i++ {
+		if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 10, TransactionID: fmt.Sprintf("txn-%03d", i)}); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+	}
+
+	evt := readSSE(t, openStream(t, srv, "user123", service.hub.epoch+"-1"))
+	if evt.event != "snapshot" || evt.data.Balance != 50.00 || evt.id != service.hub.epoch+"-5" {
+		t.Errorf("Expected resync snapshot at seq 5 with balance 50.00, got %+v", evt)
+	}
+}
+
+func TestBalanceStreamResumeAfterRestart(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 30)
+	for i := 1; i <= 3; i++ {
+		if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 10, TransactionID: fmt.Sprintf("txn-%03d", i)}); err != nil {
+			t.Fatalf("ProcessPayment failed: %v", err)
+		}
+	}
+	srv := newStreamServer(t, service)
+
+	// The clients saw seq 2 and seq 7 from the previous process, and one
+	// has an ID from before epochs. Replaying this process's postings after
+	// seq 2 would be wrong.
+	for _, lastEventID := range []string{"previous-2", "previous-7", "2"} {
+		evt := readSSE(t, openStream(t, srv, "user123", lastEventID))
+		if evt.event != "snapshot" || evt.data.Balance != 60 || evt.id != service.hub.epoch+"-4" {
+			t.Errorf("%s: expected resync snapshot at seq 4 with balance 60.00, got %+v", lastEventID, evt)
+		}
+	}
+}
+
+func TestBalanceStreamPublishesSetBalance(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 30)
+	srv := newStreamServer(t, service)
+
+	stream := openStream(t, srv, "user123", "")
+	readSSE(t, stream)
+	service.SetBalance(context.Background(), "user123", 100)
+	evt := readSSE(t, stream)
+	if evt.event != "posting" || evt.data.TransactionID != "" || evt.data.Amount != 70 || evt.data.Balance != 100 {
+		t.Errorf("Expected a posting of 70 to balance 100.00, got %+v", evt)
+	}
+}
+
+func TestBalanceStreamResyncsAfterRestore(t *testing.T) {
+	ctx := context.Background()
+	source := NewPaymentService()
+	source.SetBalance(ctx, "user123", 500)
+	var snapshot bytes.Buffer
+	if _, err := source.WriteSnapshot(ctx, &snapshot); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+
+	service := NewPaymentService()
+	service.SetBalance(ctx, "user123", 10)
+	srv := newStreamServer(t, service)
+	stream := openStream(t, srv, "user123", "")
+	lastEventID := readSSE(t, stream).id
+
+	if _, err := service.RestoreSnapshot(ctx, &snapshot); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	if _, err := io.ReadAll(stream); err != nil {
+		t.Errorf("Expected the stream to end cleanly on restore, got %v", err)
+	}
+	evt := readSSE(t, openStream(t, srv, "user123", lastEventID))
+	if evt.event != "snapshot" || evt.data.Balance != 500 {
+		t.Errorf("Expected a resync snapshot with the restored balance 500.00, got %+v", evt)
+	}
+}
+
+func TestBalanceStreamEndsAfterHubCloses(t *testing.T) {
+	service := NewPaymentService()
+	srv := newStreamServer(t, service)
+	service.hub.Close()
+
+	// A stream opened while the server drains gets its snapshot and ends.
+	stream := openStream(t, srv, "user123", "")
+	if evt := readSSE(t, stream); evt.event != "snapshot" {
+		t.Errorf("Expected a snapshot, got %+v", evt)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(stream)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the stream to end cleanly, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream stayed open after the hub was closed")
+	}
+}
+
+func TestBalanceHubDropsSlowSubscriber(t *testing.T) {
+	service := NewPaymentService()
+	service.hub.bufferSize = 1
+
+	sub, _, _, _ := service.SubscribeBalance("user123", "", 0)
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= 5; i++ {
+			_, _ = service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 1, TransactionID: fmt.Sprintf("txn-%03d", i)})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ProcessPayment blocked on a slow subscriber")
+	}
+
+	received := 0
+	for range sub.C() {
+		received++
+	}
+	if received != 1 {
+		t.Errorf("Expected the buffered posting before the drop, got %d", received)
+	}
+}
+
+func TestHandleBalanceStreamInvalidRequests(t *testing.T) {
+	service := NewPaymentService()
+
+	req := httptest.NewRequest(http.MethodPost, "/users/user123/balance/stream", nil)
+	req.SetPathValue("id", "user123")
+	w := httptest.NewRecorder()
+	asAdmin(service.HandleBalanceStream)(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/users/user123/balance/stream", nil)
+	req.SetPathValue("id", "user123")
+	req.Header.Set("Last-Event-ID", "abc")
+	w = httptest.NewRecorder()
+	asAdmin(service.HandleBalanceStream)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func useSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return recorder
+}
+
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestProcessPaymentSpans(t *testing.T) {
+	recorder := useSpanRecorder(t)
+	service := NewPaymentService()
+
+	resp, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 50, TransactionID: "txn-001"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["PaymentService.ProcessPayment"]
+	if !ok {
+		t.Fatalf("Expected a PaymentService.ProcessPayment span, got %v", spans)
+	}
+	for _, name := range []string{"validate", "lock.acquire", "idempotency.lookup", "storage.write"} {
+		child, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		if child.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of ProcessPayment", name)
+		}
+	}
+
+	if got := spanAttr(root, "payment.outcome"); got != outcomeSucceeded {
+		t.Errorf("Expected outcome %s, got %s", outcomeSucceeded, got)
+	}
+	if got := spanAttr(root, "payment.amount_sign"); got != "credit" {
+		t.Errorf("Expected amount sign credit, got %s", got)
+	}
+	if got := spanAttr(root, "payment.user_hash"); got == "" || got == "user123" {
+		t.Errorf("Expected a hashed user ID, got %q", got)
+	}
+	if resp.TraceID != root.SpanContext().TraceID().String() {
+		t.Errorf("Expected response TraceID %s to match the span trace ID %s", resp.TraceID, root.SpanContext().TraceID())
+	}
+}
+
+func TestProcessPaymentSpanOutcomeDeclined(t *testing.T) {
+	recorder := useSpanRecorder(t)
+	service := NewPaymentService()
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -50, TransactionID: "txn-001"}); err == nil {
+		t.Fatal("Expected insufficient funds error")
+	}
+
+	for _, span := range recorder.Ended() {
+		if span.Name() != "PaymentService.ProcessPayment" {
+			continue
+		}
+		if got := spanAttr(span, "payment.outcome"); got != outcomeDeclined {
+			t.Errorf("Expected outcome %s, got %s", outcomeDeclined, got)
+		}
+		if got := spanAttr(span, "payment.amount_sign"); got != "debit" {
+			t.Errorf("Expected amount sign debit, got %s", got)
+		}
+		return
+	}
+	t.Error("Expected a PaymentService.ProcessPayment span")
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookIDHeader        = "X-Webhook-ID"
+)
+
+var ErrDeliveryNotFound = errors.New("delivery not found")
+
+type WebhookEndpoint struct {
+	ID        string      `json:"id"`
+	URL       string      `json:"url"`
+	Secret    string      `json:"secret,omitempty"`
+	Events    []EventType `json:"events,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// wants reports whether the endpoint subscribed to the event type.
+// An endpoint without an event filter receives everything.
+func (e *WebhookEndpoint) wants(t EventType) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, et := range e.Events {
+		if et == t {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	ID         string    `json:"id"`
+	EndpointID string    `json:"endpointID"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"lastError,omitempty"`
+	FailedAt   time.Time `json:"failedAt"`
+}
+
+// WebhookDispatcher delivers payment events to registered endpoints.
+// Deliveries are retried with exponential backoff and moved to the
+// dead-letter list once MaxAttempts is reached, from where they can be replayed.
+type WebhookDispatcher struct {
+	Client      *http.Client
+	Workers     int
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	mu          sync.Mutex
+	endpoints   map[string]*WebhookEndpoint
+	deadLetters []*WebhookDelivery
+	queue       chan *WebhookDelivery
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	running     atomic.Int32
+}
+
+func NewWebhookDispatcher() *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Workers:     4,
+		MaxAttempts: 5,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		endpoints:   make(map[string]*WebhookEndpoint),
+		queue:       make(chan *WebhookDelivery, 1024),
+	}
+}
+
+func (d *WebhookDispatcher) Start(ctx context.Context) {
+	ctx, d.cancel = context.WithCancel(ctx)
+	for i := 0; i < d.Workers; i++ {
+		d.wg.Add(1)
+		go d.worker(ctx)
+	}
+}
+
+// Stop cancels in-flight retries and waits for the workers to exit.
+// Deliveries interrupted by Stop, and those still queued, end up in the
+// dead-letter list, from where they can be replayed.
+func (d *WebhookDispatcher) Stop() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.wg.Wait()
+
+	stopped := errors.New("dispatcher stopped")
+	for dropped := 0; ; dropped++ {
+		select {
+		case delivery := <-d.queue:
+			d.deadLetter(delivery, stopped)
+		default:
+			if dropped > 0 {
+				slog.Warn("webhook dispatcher stopped with queued deliveries, dead-lettering them", "count", dropped)
+			}
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) RegisterEndpoint(rawURL, secret string, events []EventType) (*WebhookEndpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q", rawURL)
+	}
+	if secret == "" {
+		secret, err = generateSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := &WebhookEndpoint{
+		ID:        uuid.New().String(),
+		URL:       u.String(),
+		Secret:    secret,
+		Events:    events,
+		CreatedAt: time.Now(),
+	}
+
+	d.mu.Lock()
+	d.endpoints[endpoint.ID] = endpoint
+	d.mu.Unlock()
+
+	copied := *endpoint
+	return &copied, nil
+}
+
+// Endpoints returns the registered endpoints without their secrets.
+func (d *WebhookDispatcher) Endpoints() []WebhookEndpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	endpoints := make([]WebhookEndpoint, 0, len(d.endpoints))
+	for _, e := range d.endpoints {
+		copied := *e
+		copied.Secret = ""
+		endpoints = append(endpoints, copied)
+	}
+	return endpoints
+}
+
+// Publish queues the event for every interested endpoint. It never blocks;
+// if the queue is full the delivery goes straight to the dead-letter list.
+func (d *WebhookDispatcher) Publish(_ context.Context, evt Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, e := range d.endpoints {
+		if !e.wants(evt.Type) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:         uuid.New().String(),
+			EndpointID: e.ID,
+			Event:      evt,
+		}
+		select {
+		case d.queue <- delivery:
+		default:
+			slog.Error("webhook queue full, dead-lettering delivery", "eventID", evt.ID, "deliveryID", delivery.ID)
+			delivery.LastError = "queue full"
+			delivery.FailedAt = time.Now()
+			d.deadLetters = append(d.deadLetters, delivery)
+		}
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) DeadLetters() []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := make([]WebhookDelivery, 0, len(d.deadLetters))
+	for _, dl := range d.deadLetters {
+		deliveries = append(deliveries, *dl)
+	}
+	return deliveries
+}
+
+// Replay moves a dead-lettered delivery back onto the queue with a fresh attempt budget.
+func (d *WebhookDispatcher) Replay(deliveryID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, dl := range d.deadLetters {
+		if dl.ID != deliveryID {
+			continue
+		}
+		dl.Attempts = 0
+		dl.LastError = ""
+		dl.FailedAt = time.Time{}
+		select {
+		case d.queue <- dl:
+		default:
+			dl.LastError = "queue full"
+			dl.FailedAt = time.Now()
+			return fmt.Errorf("webhook queue full")
+		}
+		d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+		return nil
+	}
+	return ErrDeliveryNotFound
+}
+
+// Healthy reports an error unless every worker started by Start is running.
+func (d *WebhookDispatcher) Healthy(context.Context) error {
+	if running := int(d.running.Load()); running < d.Workers {
+		return fmt.Errorf("%d of %d webhook workers running", running, d.Workers)
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) worker(ctx context.Context) {
+	defer d.wg.Done()
+	d.running.Add(1)
+	defer d.running.Add(-1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery := <-d.queue:
+			d.deliver(ctx, delivery)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery *WebhookDelivery) {
+	d.mu.Lock()
+	endpoint, exists := d.endpoints[delivery.EndpointID]
+	d.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		d.deadLetter(delivery, err)
+		return
+	}
+
+	for {
+		delivery.Attempts++
+		err = d.send(ctx, endpoint, delivery, body)
+		if err == nil {
+			slog.Info("webhook delivered", "eventID", delivery.Event.ID, "deliveryID", delivery.ID,
+				"url", endpoint.URL, "attempts", delivery.Attempts)
+			return
+		}
+		slog.Warn("webhook delivery attempt failed", "eventID", delivery.Event.ID, "deliveryID", delivery.ID,
+			"url", endpoint.URL, "attempt", delivery.Attempts, "error", err)
+
+		if delivery.Attempts >= d.MaxAttempts {
+			d.deadLetter(delivery, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			d.deadLetter(delivery, ctx.Err())
+			return
+		case <-time.After(d.backoff(delivery.Attempts)):
+		}
+	}
+}
+
+func (d *WebhookDispatcher) send(ctx context.Context, endpoint *WebhookEndpoint, delivery *WebhookDelivery, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, delivery.Event.ID)
+	req.Header.Set(WebhookEventHeader, string(delivery.Event.Type))
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(endpoint.Secret, time.Now().Unix(), body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff returns BaseDelay * 2^(attempt-1), capped at MaxDelay.
+func (d *WebhookDispatcher) backoff(attempt int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= d.MaxDelay {
+			return d.MaxDelay
+		}
+	}
+	return delay
+}
+
+func (d *WebhookDispatcher) deadLetter(delivery *WebhookDelivery, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery.LastError = err.Error()
+	delivery.FailedAt = time.Now()
+	d.deadLetters = append(d.deadLetters, delivery)
+}
+
+// SignWebhookPayload returns the signature header value for a payload:
+// "t=<unix timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>">".
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	ts := strconv.FormatInt(timestamp, 10)
+	return "t=" + ts + ",v1=" + computeWebhookMAC(secret, ts, body)
+}
+
+// VerifyWebhookSignature checks a signature header produced by SignWebhookPayload.
+// A zero tolerance disables the timestamp freshness check.
+func VerifyWebhookSignature(secret, header string, body []byte, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			sig = value
+		}
+	}
+	if ts == "" || sig == "" {
+		return fmt.Errorf("malformed signature header")
+	}
+
+	if tolerance > 0 {
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid signature timestamp: %w", err)
+		}
+		if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+			return fmt.Errorf("signature timestamp outside tolerance")
+		}
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(computeWebhookMAC(secret, ts, body))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func computeWebhookMAC(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type registerWebhookRequest struct {
+	URL    string      `json:"url"`
+	Secret string      `json:"secret"`
+	Events []EventType `json:"events"`
+}
+
+func (d *WebhookDispatcher) HandleEndpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, d.Endpoints())
+	case http.MethodPost:
+		var req registerWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		endpoint, err := d.RegisterEndpoint(req.URL, req.Secret, req.Events)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, endpoint)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *WebhookDispatcher) HandleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.DeadLetters())
+}
+
+func (d *WebhookDispatcher) HandleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := d.Replay(r.PathValue("id"))
+	if errors.Is(err, ErrDeliveryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
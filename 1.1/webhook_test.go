@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDispatcher(t *testing.T) *WebhookDispatcher {
+	t.Helper()
+	d := NewWebhookDispatcher()
+	d.Workers = 1
+	d.MaxAttempts = 3
+	d.BaseDelay = time.Millisecond
+	d.MaxDelay = 5 * time.Millisecond
+	d.Start(context.Background())
+	t.Cleanup(d.Stop)
+	return d
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met before timeout")
+}
+
+func TestProcessPaymentEmitsEvents(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 100.00)
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -40, TransactionID: "txn-001"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -500, TransactionID: "txn-002"}); err == nil {
+		t.Fatal("Expected insufficient funds error")
+	}
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 40, TransactionID: "txn-003", RefundOf: "txn-001"}); err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+	// idempotent replay must not emit a second event
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -40, TransactionID: "txn-001"}); err != nil {
+		t.Fatalf("Idempotent ProcessPayment failed: %v", err)
+	}
+
+	var events []Event
+	for _, rec := range service.Outbox().Pending(0) {
+		events = append(events, rec.Event)
+	}
+
+	want := []EventType{EventPaymentSucceeded, EventPaymentDeclined, EventRefundCreated}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %d", len(want), len(events))
+	}
+	for i, evt := range events {
+		if evt.Type != want[i] {
+			t.Errorf("event %d: expected type %s, got %s", i, want[i], evt.Type)
+		}
+		if evt.ID == "" {
+			t.Errorf("event %d: ID should not be empty", i)
+		}
+	}
+	if events[1].Data.Reason == "" {
+		t.Error("Declined event should carry a reason")
+	}
+	if events[2].Data.RefundOf != "txn-001" || events[2].Data.Balance != 100.00 {
+		t.Errorf("Unexpected refund event data: %+v", events[2].Data)
+	}
+}
+
+func TestPaymentEventCarriesFee(t *testing.T) {
+	service := NewPaymentService()
+	service.Fees = newFeeEngine(t)
+	service.SetBalance(context.Background(), "alice", 100.00)
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "alice", Amount: -50, TransactionID: "txn-1"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "alice", Amount: -500, TransactionID: "txn-2"}); err == nil {
+		t.Fatal("Expected insufficient funds error")
+	}
+
+	pending := service.Outbox().Pending(0)
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(pending))
+	}
+	data := pending[0].Event.Data
+	if data.Amount != -50 || data.Fee == nil || data.Fee.Total != 1.05 || data.Fee.TransactionID != "sys:fee:txn-1" {
+		t.Fatalf("Expected the payment event to carry the fee, got %+v", data)
+	}
+	if before := data.Balance - data.Amount + data.Fee.Total; before != 100 || data.Balance != 48.95 {
+		t.Errorf("Expected the balance after the payment and its fee, 48.95, got %+v", data)
+	}
+	if declined := pending[1].Event.Data; declined.Balance != 48.95 {
+		t.Errorf("Expected the declined event to carry the unchanged balance, got %+v", declined)
+	}
+}
+
+func TestProcessPaymentRefundValidation(t *testing.T) {
+	service := NewPaymentService()
+	service.SetBalance(context.Background(), "user123", 100.00)
+	service.SetBalance(context.Background(), "user456", 100.00)
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: -60, TransactionID: "txn-001"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		req  PaymentRequest
+	}{
+		{"Unknown original", PaymentRequest{UserID: "user123", Amount: 10, TransactionID: "r-1", RefundOf: "missing"}},
+		{"Other user", PaymentRequest{UserID: "user456", Amount: 10, TransactionID: "r-2", RefundOf: "txn-001"}},
+		{"Same sign", PaymentRequest{UserID: "user123", Amount: -10, TransactionID: "r-3", RefundOf: "txn-001"}},
+		{"Exceeds original", PaymentRequest{UserID: "user123", Amount: 70, TransactionID: "r-4", RefundOf: "txn-001"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := service.ProcessPayment(context.Background(), tt.req); err == nil {
+				t.Errorf("Expected error for %s", tt.name)
+			}
+		})
+	}
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 40, TransactionID: "r-5", RefundOf: "txn-001"}); err != nil {
+		t.Fatalf("Partial refund failed: %v", err)
+	}
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 30, TransactionID: "r-6", RefundOf: "txn-001"}); err == nil {
+		t.Error("Expected error when refunds exceed the original amount")
+	}
+	if balance := balanceOf(t, service, "user123"); balance != 80.00 {
+		t.Errorf("Expected balance 80.00 (100 - 60 + 40), got %.2f", balance)
+	}
+}
+
+func TestWebhookDeliverySigned(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	endpoint, err := d.RegisterEndpoint(srv.URL, "s3cret", []EventType{EventPaymentSucceeded})
+	if err != nil {
+		t.Fatalf("RegisterEndpoint failed: %v", err)
+	}
+
+	service := NewPaymentService()
+	relay := NewOutboxRelay(service.Outbox(), d)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go relay.Run(ctx)
+
+	if _, err := service.ProcessPayment(context.Background(), PaymentRequest{UserID: "user123", Amount: 10, TransactionID: "txn-001"}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if err := VerifyWebhookSignature(endpoint.Secret, r.Header.Get(WebhookSignatureHeader), body, time.Minute); err != nil {
+			t.Errorf("Signature verification failed: %v", err)
+		}
+		if err := VerifyWebhookSignature("wrong", r.Header.Get(WebhookSignatureHeader), body, time.Minute); err == nil {
+			t.Error("Verification with the wrong secret should fail")
+		}
+		if got := r.Header.Get(WebhookEventHeader); got != string(EventPaymentSucceeded) {
+			t.Errorf("Expected event header %s, got %s", EventPaymentSucceeded, got)
+		}
+		var evt Event
+		if err := json.Unmarshal(body, &evt); err != nil {
+			t.Fatalf("Failed to decode event: %v", err)
+		}
+		if evt.Data.TransactionID != "txn-001" || evt.Data.Balance != 10 {
+			t.Errorf("Unexpected event data: %+v", evt.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	if _, err := d.RegisterEndpoint(srv.URL, "", nil); err != nil {
+		t.Fatalf("RegisterEndpoint failed: %v", err)
+	}
+	_ = d.Publish(context.Background(), Event{ID: "evt-1", Type: EventPaymentSucceeded})
+
+	waitFor(t, func() bool { return calls.Load() == 3 })
+	time.Sleep(20 * time.Millisecond)
+	if len(d.DeadLetters()) != 0 {
+		t.Error("Delivery should not be dead-lettered after eventual success")
+	}
+}
+
+func TestWebhookDeadLetterAndReplay(t *testing.T) {
+	var healthy atomic.Bool
+	var delivered atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		delivered.Add(1)
+	}))
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	if _, err := d.RegisterEndpoint(srv.URL, "", nil); err != nil {
+		t.Fatalf("RegisterEndpoint failed: %v", err)
+	}
+	_ = d.Publish(context.Background(), Event{ID: "evt-1", Type: EventPaymentDeclined})
+
+	waitFor(t, func() bool { return len(d.DeadLetters()) == 1 })
+	dl := d.DeadLetters()[0]
+	if dl.Attempts != d.MaxAttempts {
+		t.Errorf("Expected %d attempts, got %d", d.MaxAttempts, dl.Attempts)
+	}
+	if dl.LastError == "" {
+		t.Error("Dead letter should record the last error")
+	}
+
+	healthy.Store(true)
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/dead-letters/"+dl.ID+"/replay", nil)
+	req.SetPathValue("id", dl.ID)
+	w := httptest.NewRecorder()
+	d.HandleReplay(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+
+	waitFor(t, func() bool { return delivered.Load() == 1 })
+	if len(d.DeadLetters()) != 0 {
+		t.Error("Replayed delivery should leave the dead-letter list")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/webhooks/dead-letters/missing/replay", nil)
+	req.SetPathValue("id", "missing")
+	w = httptest.NewRecorder()
+	d.HandleReplay(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestWebhookStopDeadLettersQueuedDeliveries(t *testing.T) {
+	// Without workers, every delivery is still queued when Stop runs.
+	d := NewWebhookDispatcher()
+	if _, err := d.RegisterEndpoint("http://example.com/hook", "", nil); err != nil {
+		t.Fatalf("RegisterEndpoint failed: %v", err)
+	}
+	for _, id := range []string{"evt-1", "evt-2"} {
+		_ = d.Publish(context.Background(), Event{ID: id, Type: EventPaymentSucceeded})
+	}
+	d.Stop()
+
+	dls := d.DeadLetters()
+	if len(dls) != 2 || dls[0].Event.ID != "evt-1" || dls[0].LastError != "dispatcher stopped" || dls[0].Attempts != 0 {
+		t.Errorf("Expected the queued deliveries to be dead-lettered, got %+v", dls)
+	}
+}
+
+func TestWebhookDispatcherHealthy(t *testing.T) {
+	d := NewWebhookDispatcher()
+	if err := d.Healthy(context.Background()); err == nil {
+		t.Error("Dispatcher should be unhealthy before Start")
+	}
+
+	d.Start(context.Background())
+	waitFor(t, func() bool { return d.Healthy(context.Background()) == nil })
+
+	d.Stop()
+	if err := d.Healthy(context.Background()); err == nil {
+		t.Error("Dispatcher should be unhealthy after Stop")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := NewWebhookDispatcher()
+	d.BaseDelay = 100 * time.Millisecond
+	d.MaxDelay = time.Second
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, expected := range want {
+		if got := d.backoff(i + 1); got != expected {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, expected)
+		}
+	}
+}
+
+func TestHandleWebhookEndpoints(t *testing.T) {
+	d := NewWebhookDispatcher()
+
+	req := httptest.NewRequest(http.MethodPost, "/webhooks", jsonBody(t, registerWebhookRequest{URL: "not a url"}))
+	w := httptest.NewRecorder()
+	d.HandleEndpoints(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/webhooks", jsonBody(t, registerWebhookRequest{URL: "http://example.com/hook"}))
+	w = httptest.NewRecorder()
+	d.HandleEndpoints(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", w.Code)
+	}
+	var created WebhookEndpoint
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if created.Secret == "" {
+		t.Error("A secret should be generated when none is supplied")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+	w = httptest.NewRecorder()
+	d.HandleEndpoints(w, req)
+	var listed []WebhookEndpoint
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(listed) != 1 || listed[0].Secret != "" {
+		t.Errorf("Expected one endpoint without secret, got %+v", listed)
+	}
+}
+
+func jsonBody(t *testing.T, v any) io.Reader {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to encode body: %v", err)
+	}
+	return bytes.NewReader(b)
+}
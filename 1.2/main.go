@@ -1,102 +1,71 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"sync"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
-)
-
-type ResultBuffer struct {
-	mu      sync.Mutex
-	results map[int]string
-	nextID  int
-	cond    *sync.Cond
-}
-
-func NewResultBuffer() *ResultBuffer {
-	rb := &ResultBuffer{
-		results: make(map[int]string),
-		nextID:  1,
-	}
-	rb.cond = sync.NewCond(&rb.mu)
-	return rb
-}
-
-func (rb *ResultBuffer) Store(input int, output string) {
-	rb.mu.Lock()
-	rb.results[input] = output
-	rb.mu.Unlock()
-	rb.cond.Broadcast()
-}
 
-func (rb *ResultBuffer) PrintInOrder(total int) {
-	rb.mu.Lock()
-	defer rb.mu.Unlock()
+	"sgh-assignment/pkg/workerpool"
+)
 
-	for rb.nextID <= total {
-		for {
-			if output, exists := rb.results[rb.nextID]; exists {
-				fmt.Println(output)
-				delete(rb.results, rb.nextID)
-				rb.nextID++
-				break
-			}
-			rb.cond.Wait()
-		}
-	}
+func squareNumber(x int) int {
+	return x * x
 }
 
-func worker(id int, inputs <-chan int, buffer *ResultBuffer, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	for input := range inputs {
-		time.Sleep(time.Millisecond * 100)
-
-		output := fmt.Sprintf("Worker %d: Squared of %d = %d", id, input, squareNumber(input))
-		buffer.Store(input, output)
+// square is the work done for each input: it takes 100ms and reports which
+// worker did it.
+func square(ctx context.Context, input int) (string, error) {
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
-}
-
-func squareNumber(x int) int {
-	return x * x
+	return fmt.Sprintf("Worker %d: Squared of %d = %d", workerpool.WorkerID(ctx), input, squareNumber(input)), nil
 }
 
 func main() {
-	start := time.Now()
-
-	numWorkers := 5
-	n := 100
+	numWorkers := flag.Int("workers", 5, "number of workers")
+	n := flag.Int("n", 100, "square the numbers 1 to n")
+	unordered := flag.Bool("unordered", false, "print results as they complete instead of in input order")
+	flag.Parse()
 
-	inputs := make(chan int, n)
-	buffer := NewResultBuffer()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	var wg sync.WaitGroup
-
-	for i := 1; i <= numWorkers; i++ {
-		wg.Add(1)
-		go worker(i, inputs, buffer, &wg)
-	}
+	start := time.Now()
+	run(ctx, os.Stdout, *numWorkers, *n, !*unordered)
+	elapsed := time.Since(start)
+	fmt.Printf("\nExecution time: %v\n", elapsed)
+}
 
-	for j := 1; j <= n; j++ {
-		inputs <- j
-	}
-	close(inputs)
+// run squares the numbers 1 to n on numWorkers workers and prints the
+// results to w. It returns early, without the squares still in progress,
+// once ctx is done.
+func run(ctx context.Context, w io.Writer, numWorkers, n int, ordered bool) {
+	pool := workerpool.New(numWorkers, square)
+	pool.Ordered = ordered
 
-	var printerWg sync.WaitGroup
-	printerWg.Add(1)
+	inputs := make(chan int)
 	go func() {
-		defer printerWg.Done()
-		buffer.PrintInOrder(n)
+		defer close(inputs)
+		for j := 1; j <= n; j++ {
+			select {
+			case inputs <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 
-	wg.Wait()
-
-	// Signal printer that all results are in
-	buffer.cond.Broadcast()
-
-	// Wait for printer to finish
-	printerWg.Wait()
-
-	elapsed := time.Since(start)
-	fmt.Printf("\nExecution time: %v\n", elapsed)
+	for result := range pool.Run(ctx, inputs) {
+		if result.Err != nil {
+			continue
+		}
+		fmt.Fprintln(w, result.Output)
+	}
 }
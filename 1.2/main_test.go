@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var out strings.Builder
+	run(context.Background(), &out, 3, 6, true)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 results, got %d:\n%s", len(lines), out.String())
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("Squared of %d = %d", i+1, (i+1)*(i+1)); !strings.HasSuffix(line, want) {
+			t.Errorf("Expected line %d to end with %q, got %q", i+1, want, line)
+		}
+	}
+}
+
+func TestRunStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	var out strings.Builder
+	start := time.Now()
+	run(ctx, &out, 1, 100, true)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected run to stop soon after cancellation, took %v", elapsed)
+	}
+	if n := strings.Count(out.String(), "\n"); n == 0 || n >= 100 {
+		t.Errorf("Expected some but not all results before cancellation, got %d", n)
+	}
+}
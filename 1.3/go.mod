@@ -1,3 +1,7 @@
 module sgh-assignment/1.3
 
 go 1.24.3
+
+require sgh-assignment/pkg v0.0.0
+
+replace sgh-assignment/pkg => ../pkg
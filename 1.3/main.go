@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"sync"
+
+	"sgh-assignment/pkg/server"
 )
 
 var (
@@ -32,10 +36,22 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	_, _ = fmt.Fprintf(w, "Saved: %s", result)
 }
 
+func routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	return mux
+}
+
 func main() {
-	http.HandleFunc("/", handler)
+	cfg := server.DefaultConfig()
+	if err := cfg.LoadEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := server.New(cfg, routes()).Run(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"sgh-assignment/pkg/server"
+)
+
+func TestServeAndShutdown(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() { runErr <- server.New(server.DefaultConfig(), routes()).Serve(ctx, lis) }()
+
+	url := "http://" + lis.Addr().String() + "/"
+	resp, err := http.Post(url, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "Saved: hello" {
+		t.Errorf("Unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	cancel()
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Serve returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+	if _, err := http.Post(url, "text/plain", strings.NewReader("late")); err == nil {
+		t.Error("Server should not accept requests after shutdown")
+	}
+}
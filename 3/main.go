@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"sync"
+
+	"sgh-assignment/pkg/server"
 )
 
 // Using mutex
@@ -129,6 +133,14 @@ func getHandlerWithChannel(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	cfg := server.DefaultConfig()
+	if err := cfg.LoadEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	// Mutex approach
 	http.HandleFunc("/mutex/set", setHandlerWithMutex)
 	http.HandleFunc("/mutex/get", getHandlerWithMutex)
@@ -138,7 +150,7 @@ func main() {
 	http.HandleFunc("/channel/set", setHandlerWithChannel)
 	http.HandleFunc("/channel/get", getHandlerWithChannel)
 
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := server.New(cfg, nil).Run(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,191 @@
+// Package health serves liveness and readiness endpoints that report the
+// status of each registered component as JSON.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusUp   Status = "up"
+	StatusDown Status = "down"
+)
+
+// CheckFunc reports a component as healthy by returning nil.
+type CheckFunc func(ctx context.Context) error
+
+type ComponentStatus struct {
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status     Status                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+	CheckedAt  time.Time                  `json:"checkedAt"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker runs liveness and readiness checks. Liveness answers "should this
+// process be restarted", readiness answers "should it receive traffic"; once
+// shutdown starts the checker stays live but reports not ready.
+type Checker struct {
+	Timeout time.Duration
+
+	mu           sync.RWMutex
+	liveness     []check
+	readiness    []check
+	shuttingDown atomic.Bool
+}
+
+func New() *Checker {
+	return &Checker{Timeout: 2 * time.Second}
+}
+
+// AddLivenessCheck registers a check that counts for both liveness and readiness.
+func (c *Checker) AddLivenessCheck(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness = append(c.liveness, check{name: name, fn: fn})
+}
+
+// AddReadinessCheck registers a check that only counts for readiness.
+func (c *Checker) AddReadinessCheck(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness = append(c.readiness, check{name: name, fn: fn})
+}
+
+// SetShuttingDown makes readiness fail from now on.
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+func (c *Checker) Liveness(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := append([]check(nil), c.liveness...)
+	c.mu.RUnlock()
+
+	return c.run(ctx, checks, nil)
+}
+
+func (c *Checker) Readiness(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := append(append([]check(nil), c.liveness...), c.readiness...)
+	c.mu.RUnlock()
+
+	shutdown := ComponentStatus{Status: StatusUp}
+	if c.shuttingDown.Load() {
+		shutdown = ComponentStatus{Status: StatusDown, Error: "shutting down"}
+	}
+	return c.run(ctx, checks, map[string]ComponentStatus{"shutdown": shutdown})
+}
+
+// run executes the checks concurrently, each bounded by c.Timeout.
+func (c *Checker) run(ctx context.Context, checks []check, extra map[string]ComponentStatus) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	report := Report{
+		Status:     StatusUp,
+		Components: make(map[string]ComponentStatus, len(checks)+len(extra)),
+		CheckedAt:  time.Now(),
+	}
+	for name, status := range extra {
+		report.Components[name] = status
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, chk := range checks {
+		wg.Add(1)
+		go func(chk check) {
+			defer wg.Done()
+			status := ComponentStatus{Status: StatusUp}
+			if err := runCheck(ctx, chk.fn); err != nil {
+				status = ComponentStatus{Status: StatusDown, Error: err.Error()}
+			}
+			mu.Lock()
+			report.Components[chk.name] = status
+			mu.Unlock()
+		}(chk)
+	}
+	wg.Wait()
+
+	for _, status := range report.Components {
+		if status.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// runCheck returns ctx.Err() if fn does not return before ctx is done.
+func runCheck(ctx context.Context, fn CheckFunc) error {
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HandleLiveness serves GET /healthz.
+func (c *Checker) HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, r, c.Liveness)
+}
+
+// HandleReadiness serves GET /readyz.
+func (c *Checker) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, r, c.Readiness)
+}
+
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, probe func(context.Context) Report) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := probe(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusUp {
+		status = http.StatusServiceUnavailable
+		slog.WarnContext(r.Context(), "health check failing", "path", r.URL.Path, "components", failing(report))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode health report", "error", err)
+	}
+}
+
+func failing(report Report) []string {
+	var names []string
+	for name, status := range report.Components {
+		if status.Status != StatusUp {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, handler http.HandlerFunc) (int, Report) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var report Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	return w.Code, report
+}
+
+func TestHealthy(t *testing.T) {
+	c := New()
+	c.AddLivenessCheck("workers", func(ctx context.Context) error { return nil })
+	c.AddReadinessCheck("storage", func(ctx context.Context) error { return nil })
+
+	code, report := probe(t, c.HandleLiveness)
+	if code != http.StatusOK || report.Status != StatusUp {
+		t.Errorf("Expected live, got %d %+v", code, report)
+	}
+	if _, ok := report.Components["storage"]; ok {
+		t.Error("Liveness should not run readiness-only checks")
+	}
+
+	code, report = probe(t, c.HandleReadiness)
+	if code != http.StatusOK || report.Status != StatusUp {
+		t.Errorf("Expected ready, got %d %+v", code, report)
+	}
+	for _, name := range []string{"workers", "storage", "shutdown"} {
+		if report.Components[name].Status != StatusUp {
+			t.Errorf("Expected component %s up, got %+v", name, report.Components[name])
+		}
+	}
+}
+
+func TestFailingCheck(t *testing.T) {
+	c := New()
+	c.AddReadinessCheck("storage", func(ctx context.Context) error { return errors.New("unreachable") })
+
+	code, _ := probe(t, c.HandleLiveness)
+	if code != http.StatusOK {
+		t.Errorf("Readiness failure should not affect liveness, got %d", code)
+	}
+
+	code, report := probe(t, c.HandleReadiness)
+	if code != http.StatusServiceUnavailable || report.Status != StatusDown {
+		t.Errorf("Expected not ready, got %d %+v", code, report)
+	}
+	if report.Components["storage"].Error != "unreachable" {
+		t.Errorf("Expected storage error, got %+v", report.Components["storage"])
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	c := New()
+	c.Timeout = 20 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	c.AddLivenessCheck("stuck", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+
+	code, report := probe(t, c.HandleLiveness)
+	if code != http.StatusServiceUnavailable || report.Components["stuck"].Status != StatusDown {
+		t.Errorf("Expected stuck check to time out, got %d %+v", code, report)
+	}
+}
+
+func TestShuttingDown(t *testing.T) {
+	c := New()
+	c.SetShuttingDown()
+
+	code, _ := probe(t, c.HandleLiveness)
+	if code != http.StatusOK {
+		t.Errorf("Process should stay live while shutting down, got %d", code)
+	}
+
+	code, report := probe(t, c.HandleReadiness)
+	if code != http.StatusServiceUnavailable || report.Components["shutdown"].Status != StatusDown {
+		t.Errorf("Expected not ready while shutting down, got %d %+v", code, report)
+	}
+}
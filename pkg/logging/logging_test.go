@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestLoggerAddsTraceID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+
+	logger.InfoContext(WithTraceID(context.Background(), "abc123"), "hello", "userID", "user123")
+	logger.DebugContext(context.Background(), "hidden")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 log line, got %d: %s", len(lines), buf.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Log line is not JSON: %v", err)
+	}
+	if entry["traceID"] != "abc123" || entry["msg"] != "hello" || entry["userID"] != "user123" {
+		t.Errorf("Unexpected log entry: %v", entry)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != slog.LevelWarn {
+		t.Errorf("ParseLevel(WARN) = %v, %v", level, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+}
+
+func TestEnsureTraceID(t *testing.T) {
+	ctx, id := EnsureTraceID(context.Background())
+	if len(id) != 32 || TraceID(ctx) != id {
+		t.Errorf("Expected a generated 32 char trace ID in context, got %q", id)
+	}
+
+	same, id2 := EnsureTraceID(ctx)
+	if id2 != id || same != ctx {
+		t.Error("EnsureTraceID should keep an existing trace ID")
+	}
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x4b, 0xf9, 0x2f, 0x35},
+		SpanID:  trace.SpanID{0x01},
+	})
+	_, id = EnsureTraceID(trace.ContextWithSpanContext(context.Background(), sc))
+	if id != sc.TraceID().String() {
+		t.Errorf("Expected the span trace ID %s, got %s", sc.TraceID(), id)
+	}
+}
+
+func TestMiddlewareTraceID(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name: "traceparent",
+			headers: map[string]string{
+				TraceparentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				RequestIDHeader:   "req-1",
+			},
+			want: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:    "X-Request-ID",
+			headers: map[string]string{RequestIDHeader: "req-1"},
+			want:    "req-1",
+		},
+		{
+			name:    "Invalid X-Request-ID is replaced",
+			headers: map[string]string{RequestIDHeader: "bad id\nwith newline"},
+		},
+		{
+			name:    "Invalid traceparent falls back",
+			headers: map[string]string{TraceparentHeader: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = TraceID(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if seen == "" {
+				t.Fatal("Handler should see a trace ID")
+			}
+			if tt.want != "" && seen != tt.want {
+				t.Errorf("Expected trace ID %q, got %q", tt.want, seen)
+			}
+			if tt.want == "" && len(seen) != 32 {
+				t.Errorf("Expected a generated trace ID, got %q", seen)
+			}
+			if got := w.Header().Get(RequestIDHeader); got != seen {
+				t.Errorf("Response header %q should echo trace ID %q", got, seen)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"sgh-assignment/pkg/server"
+)
+
+// Middleware assigns each request a trace ID, taken from an incoming
+// traceparent or X-Request-ID header, the request's OpenTelemetry span, or
+// generated, in that order. It stores the ID in the request context, echoes
+// it as X-Request-ID and logs the request once it completes.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID := traceIDFromTraceparent(r.Header.Get(TraceparentHeader))
+		if traceID == "" {
+			traceID = sanitizeRequestID(r.Header.Get(RequestIDHeader))
+		}
+		var ctx context.Context
+		if traceID == "" {
+			ctx, traceID = EnsureTraceID(r.Context())
+		} else {
+			ctx = WithTraceID(r.Context(), traceID)
+		}
+		w.Header().Set(RequestIDHeader, traceID)
+
+		start := time.Now()
+		rec := server.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		slog.InfoContext(ctx, "request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.Status,
+			"duration", time.Since(start),
+			"remoteAddr", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,144 @@
+// Package ratelimit provides per-client token-bucket rate limiting for HTTP
+// handlers, so one noisy client can't starve the others.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limit allows Rate requests per second on average, with bursts of up to Burst.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps one token bucket per client key.
+type Limiter struct {
+	limit Limit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	now       func() time.Time
+	lastSweep time.Time
+
+	allowed  atomic.Uint64
+	rejected atomic.Uint64
+}
+
+func NewLimiter(limit Limit) *Limiter {
+	return &Limiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from key's bucket. When the bucket is empty it reports
+// how long until the next token is available.
+func (l *Limiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		l.allowed.Add(1)
+		return true, 0
+	}
+	l.rejected.Add(1)
+	wait := (1 - b.tokens) / l.limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, since they behave
+// exactly like a new bucket. It runs at most once per refill period.
+func (l *Limiter) sweep(now time.Time) {
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Allowed and Rejected count decisions since the limiter was created.
+func (l *Limiter) Allowed() uint64  { return l.allowed.Load() }
+func (l *Limiter) Rejected() uint64 { return l.rejected.Load() }
+
+// Clients returns the number of clients currently tracked.
+func (l *Limiter) Clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// KeyFunc identifies the client a request is counted against.
+type KeyFunc func(r *http.Request) string
+
+// Middleware rejects requests over their client's limit with 429 Too Many
+// Requests and a Retry-After header in whole seconds.
+func Middleware(l *Limiter, key KeyFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := l.Allow(key(r))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ParseLimits parses per-route limits written as "route=rate:burst" pairs
+// separated by commas, e.g. "/pay=5:10,*=50:100". The "*" route is the
+// default for routes without their own entry.
+func ParseLimits(s string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, spec, ok := strings.Cut(entry, "=")
+		rateStr, burstStr, ok2 := strings.Cut(spec, ":")
+		if !ok || !ok2 || route == "" {
+			return nil, fmt.Errorf("invalid rate limit %q, want route=rate:burst", entry)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate in %q", entry)
+		}
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid burst in %q", entry)
+		}
+		limits[route] = Limit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(limit Limit) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := NewLimiter(limit)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Rate: 2, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Request %d should be allowed within the burst", i+1)
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok {
+		t.Fatal("Request over the burst should be rejected")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected retry after 500ms, got %v", retryAfter)
+	}
+
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("Another client should have its own bucket")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("A token should be available after refilling")
+	}
+	if l.Allowed() != 5 || l.Rejected() != 1 {
+		t.Errorf("Expected 5 allowed and 1 rejected, got %d and %d", l.Allowed(), l.Rejected())
+	}
+}
+
+func TestLimiterSweepsIdleClients(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Rate: 1, Burst: 2})
+	l.Allow("a")
+	l.Allow("b")
+	if l.Clients() != 2 {
+		t.Fatalf("Expected 2 clients, got %d", l.Clients())
+	}
+
+	clock.advance(3 * time.Second)
+	l.Allow("c")
+	if l.Clients() != 1 {
+		t.Errorf("Expected idle clients to be swept, got %d clients", l.Clients())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 0.5, Burst: 1})
+	handler := Middleware(l, func(r *http.Request) string { return r.RemoteAddr }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/pay", nil))
+		if w.Code != want {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, want, w.Code)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "2" {
+			t.Errorf("Expected Retry-After 2, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits("/pay=5:10, *=50:100")
+	if err != nil {
+		t.Fatalf("ParseLimits failed: %v", err)
+	}
+	if limits["/pay"] != (Limit{Rate: 5, Burst: 10}) || limits["*"] != (Limit{Rate: 50, Burst: 100}) {
+		t.Errorf("Unexpected limits: %v", limits)
+	}
+
+	for _, invalid := range []string{"/pay", "/pay=5", "/pay=x:1", "/pay=5:0", "=1:1"} {
+		if _, err := ParseLimits(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
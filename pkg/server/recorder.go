@@ -0,0 +1,42 @@
+package server
+
+import "net/http"
+
+// StatusRecorder wraps a ResponseWriter to record the status of the response
+// for middleware such as logging, tracing and metrics. It passes Flush
+// through for streaming handlers, and Unwrap lets http.ResponseController
+// reach the underlying connection.
+type StatusRecorder struct {
+	http.ResponseWriter
+	// Status is the status written so far, 200 until the handler writes.
+	Status      int
+	wroteHeader bool
+}
+
+// NewStatusRecorder returns a StatusRecorder writing to w.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.Status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *StatusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
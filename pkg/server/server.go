@@ -0,0 +1,243 @@
+// Package server bootstraps the HTTP servers of the assignment modules:
+// configuration from environment and flags, sane timeouts, and graceful
+// shutdown on SIGINT/SIGTERM so in-flight requests are drained on deploy.
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type Config struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	ShutdownTimeout   time.Duration
+	// ShutdownDelay keeps serving for a while after shutdown starts so load
+	// balancers can observe failing readiness before connections are closed.
+	ShutdownDelay time.Duration
+
+	// TLSCertFile and TLSKeyFile enable HTTPS. Both are reloaded when they
+	// change on disk.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables mutual TLS: client certificates signed by one
+	// of its CAs are verified and exposed in http.Request.TLS.
+	TLSClientCAFile string
+	// TLSRequireClientCert rejects connections without a client certificate.
+	TLSRequireClientCert bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:              ":8080",
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+		ShutdownTimeout:   30 * time.Second,
+	}
+}
+
+// LoadEnv overrides the config with SERVER_* environment variables.
+// Durations use time.ParseDuration syntax, e.g. SERVER_READ_TIMEOUT=10s.
+func (c *Config) LoadEnv() error {
+	values := []struct {
+		key string
+		dst *string
+	}{
+		{"SERVER_ADDR", &c.Addr},
+		{"SERVER_TLS_CERT_FILE", &c.TLSCertFile},
+		{"SERVER_TLS_KEY_FILE", &c.TLSKeyFile},
+		{"SERVER_TLS_CLIENT_CA_FILE", &c.TLSClientCAFile},
+	}
+	for _, val := range values {
+		if v, ok := os.LookupEnv(val.key); ok {
+			*val.dst = v
+		}
+	}
+	durations := []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"SERVER_READ_TIMEOUT", &c.ReadTimeout},
+		{"SERVER_READ_HEADER_TIMEOUT", &c.ReadHeaderTimeout},
+		{"SERVER_WRITE_TIMEOUT", &c.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", &c.IdleTimeout},
+		{"SERVER_SHUTDOWN_TIMEOUT", &c.ShutdownTimeout},
+		{"SERVER_SHUTDOWN_DELAY", &c.ShutdownDelay},
+	}
+	for _, d := range durations {
+		v, ok := os.LookupEnv(d.key)
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", d.key, err)
+		}
+		*d.dst = parsed
+	}
+	if v, ok := os.LookupEnv("SERVER_MAX_HEADER_BYTES"); ok {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid SERVER_MAX_HEADER_BYTES: %w", err)
+		}
+		c.MaxHeaderBytes = parsed
+	}
+	if v, ok := os.LookupEnv("SERVER_TLS_REQUIRE_CLIENT_CERT"); ok {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid SERVER_TLS_REQUIRE_CLIENT_CERT: %w", err)
+		}
+		c.TLSRequireClientCert = parsed
+	}
+	return nil
+}
+
+// RegisterFlags binds the config to fs. The current values become the flag
+// defaults, so call LoadEnv first to get flags > env > defaults precedence.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "HTTP listen address")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "maximum duration for reading the entire request")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "maximum duration for reading request headers")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "maximum duration before timing out writes of the response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "maximum time to wait for the next request on keep-alive connections")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "maximum size of request headers")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "maximum time to drain in-flight requests on shutdown")
+	fs.DurationVar(&c.ShutdownDelay, "shutdown-delay", c.ShutdownDelay, "time to keep serving after a shutdown signal before draining")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "PEM certificate file; enables HTTPS together with -tls-key")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "PEM private key file of -tls-cert")
+	fs.StringVar(&c.TLSClientCAFile, "tls-client-ca", c.TLSClientCAFile, "PEM CA bundle used to verify client certificates (mutual TLS)")
+	fs.BoolVar(&c.TLSRequireClientCert, "tls-require-client-cert", c.TLSRequireClientCert, "reject connections without a valid client certificate")
+}
+
+type Server struct {
+	cfg        Config
+	http       *http.Server
+	onShutdown []func()
+}
+
+// New creates a server for handler. A nil handler means http.DefaultServeMux.
+func New(cfg Config, handler http.Handler) *Server {
+	return &Server{
+		cfg: cfg,
+		http: &http.Server{
+			Addr:              cfg.Addr,
+			Handler:           handler,
+			ReadTimeout:       cfg.ReadTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		},
+	}
+}
+
+// WithoutTimeouts lifts ReadTimeout and WriteTimeout for the requests h
+// serves, for streams and large uploads or downloads that would otherwise be
+// cut off. Middleware between the server and h must implement Unwrap, as
+// http.ResponseController requires.
+func WithoutTimeouts(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.WarnContext(r.Context(), "failed to clear read deadline", "error", err)
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.WarnContext(r.Context(), "failed to clear write deadline", "error", err)
+		}
+		h(w, r)
+	}
+}
+
+// RegisterOnShutdown registers a function to call as soon as graceful shutdown
+// starts, before ShutdownDelay and before in-flight requests are drained.
+// Functions run synchronously in registration order.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// RegisterOnDrain registers a function to call once the server has stopped
+// accepting connections, while in-flight requests are drained. It suits
+// ending long-lived responses such as event streams, which would otherwise
+// hold up shutdown until ShutdownTimeout, without cutting them off during
+// ShutdownDelay. Each function runs in its own goroutine.
+func (s *Server) RegisterOnDrain(f func()) {
+	s.http.RegisterOnShutdown(f)
+}
+
+// Run listens on the configured address and serves until ctx is cancelled or
+// the process receives SIGINT or SIGTERM, then drains in-flight requests.
+func (s *Server) Run(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, lis)
+}
+
+// Serve is like Run but uses an existing listener. It serves HTTPS when the
+// config has a TLS certificate.
+func (s *Server) Serve(ctx context.Context, lis net.Listener) error {
+	tlsConfig, err := s.cfg.TLSConfig()
+	if err != nil {
+		return err
+	}
+	s.http.TLSConfig = tlsConfig
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("HTTP server listening", "addr", lis.Addr().String(), "tls", tlsConfig != nil)
+		if tlsConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate.
+			errCh <- s.http.ServeTLS(lis, "", "")
+			return
+		}
+		errCh <- s.http.Serve(lis)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	for _, f := range s.onShutdown {
+		f()
+	}
+	if s.cfg.ShutdownDelay > 0 {
+		slog.Info("shutdown started, still serving during shutdown delay", "delay", s.cfg.ShutdownDelay)
+		time.Sleep(s.cfg.ShutdownDelay)
+	}
+
+	slog.Info("shutting down, draining in-flight requests", "timeout", s.cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := s.http.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("graceful shutdown: %w", err)
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("HTTP server stopped")
+	return nil
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	t.Setenv("SERVER_ADDR", ":9000")
+	t.Setenv("SERVER_READ_TIMEOUT", "7s")
+	t.Setenv("SERVER_MAX_HEADER_BYTES", "4096")
+
+	cfg := DefaultConfig()
+	if err := cfg.LoadEnv(); err != nil {
+		t.Fatalf("LoadEnv failed: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-addr", ":9100", "-idle-timeout", "2m"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if cfg.Addr != ":9100" {
+		t.Errorf("Expected flag to override env addr, got %s", cfg.Addr)
+	}
+	if cfg.ReadTimeout != 7*time.Second {
+		t.Errorf("Expected read timeout from env, got %s", cfg.ReadTimeout)
+	}
+	if cfg.MaxHeaderBytes != 4096 {
+		t.Errorf("Expected max header bytes from env, got %d", cfg.MaxHeaderBytes)
+	}
+	if cfg.IdleTimeout != 2*time.Minute {
+		t.Errorf("Expected idle timeout from flag, got %s", cfg.IdleTimeout)
+	}
+	if cfg.WriteTimeout != DefaultConfig().WriteTimeout {
+		t.Errorf("Expected default write timeout, got %s", cfg.WriteTimeout)
+	}
+}
+
+func TestLoadEnvInvalid(t *testing.T) {
+	t.Setenv("SERVER_WRITE_TIMEOUT", "soon")
+
+	cfg := DefaultConfig()
+	if err := cfg.LoadEnv(); err == nil {
+		t.Error("Expected error for invalid duration")
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := NewStatusRecorder(w)
+	if rec.Status != http.StatusOK {
+		t.Errorf("Expected status 200 before the handler writes, got %d", rec.Status)
+	}
+	rec.WriteHeader(http.StatusTeapot)
+	rec.WriteHeader(http.StatusInternalServerError)
+	if err := http.NewResponseController(rec).Flush(); err != nil {
+		t.Errorf("Expected Flush to reach the underlying writer, got %v", err)
+	}
+	if rec.Status != http.StatusTeapot || w.Code != http.StatusTeapot || !w.Flushed {
+		t.Errorf("Expected the first status to be recorded and flushed, got %d, %d, %v", rec.Status, w.Code, w.Flushed)
+	}
+}
+
+func TestWithoutTimeoutsOutlivesWriteTimeout(t *testing.T) {
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			_, _ = io.WriteString(w, "tick\n")
+			http.NewResponseController(w).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bounded", stream)
+	mux.HandleFunc("/stream", WithoutTimeouts(stream))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	cfg := DefaultConfig()
+	cfg.ReadTimeout = 100 * time.Millisecond
+	cfg.WriteTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go New(cfg, mux).Serve(ctx, lis)
+
+	get := func(path string) (string, error) {
+		resp, err := http.Get("http://" + lis.Addr().String() + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	if body, err := get("/stream"); err != nil || strings.Count(body, "tick") != 5 {
+		t.Errorf("Expected the stream to outlive the write timeout, got %q, %v", body, err)
+	}
+	if body, err := get("/bounded"); err == nil && strings.Count(body, "tick") == 5 {
+		t.Error("Expected the write timeout to cut off a route without WithoutTimeouts")
+	}
+}
+
+func TestGracefulShutdownDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = io.WriteString(w, "done")
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	shutdownStarted := make(chan struct{})
+	srv := New(DefaultConfig(), mux)
+	srv.RegisterOnShutdown(func() { close(shutdownStarted) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- srv.Serve(ctx, lis) }()
+
+	respCh := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + lis.Addr().String() + "/slow")
+		if err != nil {
+			respCh <- "error: " + err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		respCh <- string(body)
+	}()
+
+	<-started
+	cancel()
+
+	if body := <-respCh; body != "done" {
+		t.Errorf("In-flight request should complete, got %q", body)
+	}
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Serve returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+	select {
+	case <-shutdownStarted:
+	default:
+		t.Error("Shutdown hook was not called")
+	}
+
+	if _, err := http.Get("http://" + lis.Addr().String() + "/slow"); err == nil {
+		t.Error("Server should not accept requests after shutdown")
+	}
+}
+
+func TestOnDrainRunsAfterListenerCloses(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ShutdownDelay = 100 * time.Millisecond
+	srv := New(cfg, http.NewServeMux())
+	// Dialing from the hook tells whether the listener is still open.
+	dialErr := make(chan error, 1)
+	srv.RegisterOnDrain(func() {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		dialErr <- err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- srv.Serve(ctx, lis) }()
+	cancel()
+
+	if err := <-runErr; err != nil {
+		t.Errorf("Serve returned error: %v", err)
+	}
+	select {
+	case err := <-dialErr:
+		if err == nil {
+			t.Error("Expected the listener to be closed before the drain hook runs")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Drain hook was not called")
+	}
+}
+
+func TestShutdownDelayKeepsServing(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ShutdownDelay = 300 * time.Millisecond
+	shutdownStarted := make(chan struct{})
+	srv := New(cfg, mux)
+	srv.RegisterOnShutdown(func() { close(shutdownStarted) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- srv.Serve(ctx, lis) }()
+
+	cancel()
+	<-shutdownStarted
+
+	resp, err := http.Get("http://" + lis.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("Server should keep serving during the shutdown delay: %v", err)
+	}
+	resp.Body.Close()
+
+	if err := <-runErr; err != nil {
+		t.Errorf("Serve returned error: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig builds the TLS configuration described by c, or returns nil when
+// no certificate is configured and the server should speak plain HTTP. The
+// certificate is reloaded from disk when its files change, so it can be
+// rotated without a restart.
+func (c Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.TLSClientCAFile != "" || c.TLSRequireClientCert {
+			return nil, errors.New("client certificate verification needs a TLS certificate and key")
+		}
+		return nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("both a TLS certificate and key are required")
+	}
+
+	reloader, err := NewCertReloader(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if c.TLSClientCAFile == "" {
+		if c.TLSRequireClientCert {
+			return nil, errors.New("requiring client certificates needs a client CA")
+		}
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(c.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.TLSClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	// Without TLSRequireClientCert, clients may still authenticate by other
+	// means, but a certificate they do present must be valid.
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.TLSRequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// CertReloader serves a certificate and key pair from disk and picks up new
+// files on the next handshake after they change. A pair that fails to load,
+// e.g. because only the certificate has been replaced so far, is logged and
+// the previous one keeps being served until the files are consistent again.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+	if r.cert != nil {
+		slog.Info("TLS certificate reloaded", "file", r.certFile)
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		slog.Error("failed to reload TLS certificate, serving the previous one", "error", err)
+	}
+	return r.cert, nil
+}
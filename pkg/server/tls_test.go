@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issueCert creates a certificate for cn signed by parent, or a self-signed
+// CA when parent is nil.
+func issueCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "Test CA", 1, nil)
+	serverCert := issueCert(t, "localhost", 2, ca)
+	clientCert := issueCert(t, "shop-42", 3, ca)
+	writeFile(t, filepath.Join(dir, "server.crt"), serverCert.certPEM)
+	writeFile(t, filepath.Join(dir, "server.key"), serverCert.keyPEM)
+	writeFile(t, filepath.Join(dir, "ca.crt"), ca.certPEM)
+
+	cfg := DefaultConfig()
+	cfg.TLSCertFile = filepath.Join(dir, "server.crt")
+	cfg.TLSKeyFile = filepath.Join(dir, "server.key")
+	cfg.TLSClientCAFile = filepath.Join(dir, "ca.crt")
+	cfg.TLSRequireClientCert = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = New(cfg, mux).Serve(ctx, lis) }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	pair, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{pair},
+	}}}
+	resp, err := client.Get("https://" + lis.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "shop-42" {
+		t.Errorf("Expected the handler to see client certificate shop-42, got %q", body)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := anonymous.Get("https://" + lis.Addr().String() + "/"); err == nil {
+		resp.Body.Close()
+		t.Error("Expected connections without a client certificate to be rejected")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ca := issueCert(t, "Test CA", 1, nil)
+	first := issueCert(t, "localhost", 10, ca)
+	writeFile(t, certFile, first.certPEM)
+	writeFile(t, keyFile, first.keyPEM)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	serial := func() int64 {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate failed: %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+	if got := serial(); got != 10 {
+		t.Fatalf("Expected serial 10, got %d", got)
+	}
+
+	// Mod times are set explicitly so the test doesn't depend on the
+	// filesystem's timestamp resolution.
+	touch := func(path string, at time.Time) {
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatalf("Chtimes failed: %v", err)
+		}
+	}
+	second := issueCert(t, "localhost", 11, ca)
+	writeFile(t, certFile, second.certPEM)
+	touch(certFile, time.Now().Add(time.Minute))
+	if got := serial(); got != 10 {
+		t.Errorf("A certificate without its key should not be served, got serial %d", got)
+	}
+
+	writeFile(t, keyFile, second.keyPEM)
+	touch(keyFile, time.Now().Add(2*time.Minute))
+	if got := serial(); got != 11 {
+		t.Errorf("Expected the rotated certificate with serial 11, got %d", got)
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"Certificate without key", Config{TLSCertFile: "tls.crt"}},
+		{"Client CA without certificate", Config{TLSClientCAFile: "ca.crt"}},
+		{"Missing files", Config{TLSCertFile: "missing.crt", TLSKeyFile: "missing.key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.TLSConfig(); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+
+	if cfg, err := DefaultConfig().TLSConfig(); cfg != nil || err != nil {
+		t.Errorf("Expected plain HTTP by default, got %v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,88 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Signer signs outgoing requests with one key of the server's keyring.
+type Signer struct {
+	KeyID  string
+	Secret []byte
+	// Now is used for timestamps; nil means time.Now.
+	Now func() time.Time
+}
+
+// SignRequest sets the signature headers on req. The body is read and
+// replaced, so req can still be sent afterwards.
+func (s *Signer) SignRequest(req *http.Request) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("read body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	timestamp := now().Unix()
+	nonce := newNonce()
+
+	req.Header.Set(HeaderKeyID, s.KeyID)
+	req.Header.Set(HeaderTimestamp, fmt.Sprint(timestamp))
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, Sign(s.Secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return nil
+}
+
+// Transport is an http.RoundTripper that signs every request, so a signing
+// client is just &http.Client{Transport: &signing.Transport{Signer: s}}.
+type Transport struct {
+	Signer *Signer
+	// Base sends the signed request; nil means http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request, and a clone shares
+	// its Body. The clone gets a body of its own from GetBody, so the
+	// caller's stays unread and can still be sent again, e.g. on a redirect.
+	// Without GetBody the body is consumed here, as any transport would.
+	signed := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody != nil {
+		body, err := req.GetBody()
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("get body: %w", err)
+		}
+		signed.Body = body
+	}
+	if err := t.Signer.SignRequest(signed); err != nil {
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(signed)
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,185 @@
+package signing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, v *Verifier) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSignedClientRoundTrip(t *testing.T) {
+	v := NewVerifier(Keyring{"old": []byte("old-secret"), "new": []byte("new-secret")})
+	srv := newTestServer(t, v)
+
+	for _, keyID := range []string{"old", "new"} {
+		client := &http.Client{Transport: &Transport{Signer: &Signer{KeyID: keyID, Secret: v.Keyring[keyID]}}}
+		resp, err := client.Post(srv.URL+"/pay?x=1", "application/json", strings.NewReader(`{"amount":10}`))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 with key %s, got %d: %s", keyID, resp.StatusCode, body)
+		}
+		if string(body) != `{"amount":10}` {
+			t.Errorf("Handler should see the original body, got %s", body)
+		}
+	}
+}
+
+func signedRequest(t *testing.T, signer *Signer, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/pay", strings.NewReader(body))
+	if err := signer.SignRequest(req); err != nil {
+		t.Fatalf("SignRequest failed: %v", err)
+	}
+	return req
+}
+
+func TestVerifyRejections(t *testing.T) {
+	keyring := Keyring{"shop": []byte("secret")}
+	signer := &Signer{KeyID: "shop", Secret: keyring["shop"]}
+
+	tests := []struct {
+		name   string
+		mutate func(*http.Request)
+		signer *Signer
+		want   error
+	}{
+		{"Missing headers", func(r *http.Request) { r.Header.Del(HeaderSignature) }, signer, ErrMissingSignature},
+		{"Unknown key", nil, &Signer{KeyID: "other", Secret: []byte("secret")}, ErrUnknownKey},
+		{"Wrong secret", nil, &Signer{KeyID: "shop", Secret: []byte("guess")}, ErrBadSignature},
+		{"Tampered body", func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"amount":1000}`)) }, signer, ErrBadSignature},
+		{"Tampered path", func(r *http.Request) { r.URL.Path = "/refund" }, signer, ErrBadSignature},
+		{"Stale timestamp", nil, &Signer{KeyID: "shop", Secret: keyring["shop"], Now: func() time.Time { return time.Now().Add(-10 * time.Minute) }}, ErrStaleTimestamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(keyring)
+			req := signedRequest(t, tt.signer, `{"amount":10}`)
+			if tt.mutate != nil {
+				tt.mutate(req)
+			}
+			if err := v.Verify(req); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	keyring := Keyring{"shop": []byte("secret")}
+	v := NewVerifier(keyring)
+	req := signedRequest(t, &Signer{KeyID: "shop", Secret: keyring["shop"]}, `{"amount":10}`)
+
+	body, _ := io.ReadAll(req.Body)
+	replay := req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	replay.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := v.Verify(req); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := v.Verify(replay); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Expected ErrReplayed, got %v", err)
+	}
+}
+
+func TestNonceExpiry(t *testing.T) {
+	v := NewVerifier(Keyring{})
+	now := time.Now()
+	if err := v.useNonce(nonceKey{"shop", "n1"}, now); err != nil {
+		t.Fatalf("useNonce failed: %v", err)
+	}
+	later := now.Add(2*v.MaxSkew + v.MaxSkew)
+	if err := v.useNonce(nonceKey{"shop", "n2"}, later); err != nil {
+		t.Fatalf("useNonce failed: %v", err)
+	}
+	if _, ok := v.nonces[nonceKey{"shop", "n1"}]; ok {
+		t.Error("Expired nonces should be swept")
+	}
+}
+
+func TestNoncesAreScopedToTheirKey(t *testing.T) {
+	v := NewVerifier(Keyring{})
+	now := time.Now()
+	for _, key := range []nonceKey{{"shop", "a:n1"}, {"shop:a", "n1"}, {"other", "a:n1"}} {
+		if err := v.useNonce(key, now); err != nil {
+			t.Errorf("Expected nonce %+v to be fresh, got %v", key, err)
+		}
+	}
+	if err := v.useNonce(nonceKey{"shop", "a:n1"}, now); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Expected ErrReplayed, got %v", err)
+	}
+}
+
+// trackedBody records whether the transport read the caller's body.
+type trackedBody struct {
+	io.Reader
+	read, closed bool
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestTransportLeavesCallerBodyUnread(t *testing.T) {
+	v := NewVerifier(Keyring{"shop": []byte("secret")})
+	srv := newTestServer(t, v)
+	transport := &Transport{Signer: &Signer{KeyID: "shop", Secret: v.Keyring["shop"]}}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/pay", nil)
+	body := &trackedBody{Reader: strings.NewReader(`{"amount":10}`)}
+	req.Body = body
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(`{"amount":10}`)), nil }
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	echoed, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(echoed) != `{"amount":10}` {
+		t.Errorf("Expected the signed body to be sent, got %d: %s", resp.StatusCode, echoed)
+	}
+	if body.read || !body.closed {
+		t.Errorf("Expected the caller's body to be closed unread, got read %v, closed %v", body.read, body.closed)
+	}
+	if req.Header.Get(HeaderSignature) != "" {
+		t.Error("The caller's request should not be signed in place")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keyring, err := LoadKeyring(strings.NewReader(`{"shop-1": "s1", "shop-2": "s2"}`))
+	if err != nil {
+		t.Fatalf("LoadKeyring failed: %v", err)
+	}
+	if string(keyring["shop-2"]) != "s2" {
+		t.Errorf("Unexpected keyring: %v", keyring)
+	}
+	if _, err := LoadKeyring(strings.NewReader(`{"shop-1": ""}`)); err == nil {
+		t.Error("Expected error for an empty secret")
+	}
+}
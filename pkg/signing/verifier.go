@@ -0,0 +1,125 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Verifier checks request signatures against a Keyring. Nonces are remembered
+// for as long as their timestamp is acceptable, which is all that is needed:
+// an older replay is already rejected as stale.
+type Verifier struct {
+	Keyring Keyring
+	// MaxSkew is how far a request timestamp may be from the server clock.
+	MaxSkew time.Duration
+	// MaxBodyBytes caps how much of the body is read to check the signature.
+	MaxBodyBytes int64
+
+	now       func() time.Time
+	mu        sync.Mutex
+	nonces    map[nonceKey]time.Time
+	lastSweep time.Time
+}
+
+// nonceKey scopes a nonce to its key, so clients with different keys can't
+// collide on the same nonce.
+type nonceKey struct {
+	keyID, nonce string
+}
+
+func NewVerifier(keyring Keyring) *Verifier {
+	return &Verifier{
+		Keyring:      keyring,
+		MaxSkew:      5 * time.Minute,
+		MaxBodyBytes: 1 << 20,
+		now:          time.Now,
+		nonces:       make(map[nonceKey]time.Time),
+	}
+}
+
+// Verify checks req's signature and records its nonce. The body is read and
+// replaced so handlers can still decode it.
+func (v *Verifier) Verify(req *http.Request) error {
+	keyID := req.Header.Get(HeaderKeyID)
+	nonce := req.Header.Get(HeaderNonce)
+	signature := req.Header.Get(HeaderSignature)
+	tsHeader := req.Header.Get(HeaderTimestamp)
+	if keyID == "" || nonce == "" || signature == "" || tsHeader == "" {
+		return ErrMissingSignature
+	}
+
+	secret, ok := v.Keyring[keyID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	timestamp, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp", ErrStaleTimestamp)
+	}
+	now := v.now()
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > v.MaxSkew || skew < -v.MaxSkew {
+		return ErrStaleTimestamp
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(req.Body, v.MaxBodyBytes+1))
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("read body: %w", err)
+		}
+		if int64(len(body)) > v.MaxBodyBytes {
+			return fmt.Errorf("body exceeds %d bytes", v.MaxBodyBytes)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := Sign(secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrBadSignature
+	}
+
+	// Only remember nonces of authentic requests, so forged traffic can't
+	// fill the cache or burn a legitimate client's nonce.
+	return v.useNonce(nonceKey{keyID, nonce}, now)
+}
+
+func (v *Verifier) useNonce(key nonceKey, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.lastSweep) > v.MaxSkew {
+		for n, expires := range v.nonces {
+			if now.After(expires) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastSweep = now
+	}
+
+	if expires, seen := v.nonces[key]; seen && now.Before(expires) {
+		return ErrReplayed
+	}
+	// A timestamp may be up to MaxSkew in the future, so the nonce has to be
+	// kept for twice the window to outlive every acceptable timestamp.
+	v.nonces[key] = now.Add(2 * v.MaxSkew)
+	return nil
+}
+
+// Middleware rejects requests without a valid, fresh signature with 401.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			http.Error(w, "Invalid request signature: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
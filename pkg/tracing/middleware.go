@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"sgh-assignment/pkg/server"
+)
+
+const instrumentationName = "sgh-assignment/pkg/tracing"
+
+type serverSpanKey struct{}
+
+// Middleware starts a server span for every request, continuing the trace of
+// an incoming traceparent header. The span is named after the matched
+// ServeMux pattern, e.g. "POST /pay", to keep names bounded. A mux only sets
+// the pattern on the request it passes to its handler, so unless the mux is
+// next itself, its routes must be wrapped in Route for the name to be set.
+func Middleware(next http.Handler) http.Handler {
+	tracer := otel.Tracer(instrumentationName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := server.NewStatusRecorder(w)
+		r = r.WithContext(context.WithValue(ctx, serverSpanKey{}, span))
+		next.ServeHTTP(rec, r)
+
+		nameSpan(span, r)
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.Status))
+		if rec.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status))
+		}
+	})
+}
+
+// Route names the server span started by Middleware after the pattern the
+// ServeMux matched for next. Register each route through it when other
+// middleware sits between Middleware and the mux.
+func Route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if span, ok := r.Context().Value(serverSpanKey{}).(trace.Span); ok {
+			nameSpan(span, r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nameSpan names span after the request's ServeMux pattern, if it has one.
+func nameSpan(span trace.Span, r *http.Request) {
+	if r.Pattern == "" {
+		return
+	}
+	name := r.Pattern
+	if !strings.Contains(name, " ") {
+		name = r.Method + " " + name
+	}
+	span.SetName(name)
+	span.SetAttributes(attribute.String("http.route", r.Pattern))
+}
@@ -0,0 +1,118 @@
+// Package tracing sets up OpenTelemetry tracing for the assignment modules:
+// an exporter chosen by configuration, W3C trace-context propagation, and an
+// HTTP middleware that starts a server span per request.
+package tracing
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+type Config struct {
+	ServiceName string
+	// Exporter is one of none, stdout, file or otlp. With none, spans are not
+	// recorded but trace context is still propagated.
+	Exporter string
+	// File is where the file exporter appends spans as OTLP JSON lines.
+	File string
+	// Endpoint is the host:port of an OTLP/HTTP collector.
+	Endpoint string
+	// SampleRatio is the fraction of new traces to record. Requests that
+	// carry a sampled parent are always recorded.
+	SampleRatio float64
+}
+
+func DefaultConfig(serviceName string) Config {
+	return Config{
+		ServiceName: serviceName,
+		Exporter:    ExporterNone,
+		File:        "traces.jsonl",
+		Endpoint:    "localhost:4318",
+		SampleRatio: 1,
+	}
+}
+
+// LoadEnv overrides the config with TRACE_* environment variables.
+func (c *Config) LoadEnv() error {
+	if v, ok := os.LookupEnv("TRACE_EXPORTER"); ok {
+		c.Exporter = v
+	}
+	if v, ok := os.LookupEnv("TRACE_FILE"); ok {
+		c.File = v
+	}
+	if v, ok := os.LookupEnv("TRACE_OTLP_ENDPOINT"); ok {
+		c.Endpoint = v
+	}
+	if v, ok := os.LookupEnv("TRACE_SAMPLE_RATIO"); ok {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid TRACE_SAMPLE_RATIO: %w", err)
+		}
+		c.SampleRatio = parsed
+	}
+	return nil
+}
+
+// RegisterFlags binds the config to fs. Call LoadEnv first so environment
+// values become the flag defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Exporter, "trace-exporter", c.Exporter, "trace exporter: none, stdout, file or otlp")
+	fs.StringVar(&c.File, "trace-file", c.File, "file the file trace exporter appends OTLP JSON lines to")
+	fs.StringVar(&c.Endpoint, "trace-otlp-endpoint", c.Endpoint, "host:port of the OTLP/HTTP collector")
+	fs.Float64Var(&c.SampleRatio, "trace-sample-ratio", c.SampleRatio, "fraction of new traces to record")
+}
+
+// Setup installs the global tracer provider and W3C trace-context propagator.
+// The returned function flushes pending spans and must be called on shutdown.
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New()
+	case ExporterFile:
+		exporter, err = otlptrace.New(ctx, newFileClient(cfg.File))
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(cfg.Endpoint), otlptracehttp.WithInsecure())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
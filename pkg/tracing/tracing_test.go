@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sgh-assignment/pkg/logging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func useRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return recorder
+}
+
+func TestMiddlewareContinuesIncomingTrace(t *testing.T) {
+	recorder := useRecorder(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pay", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/pay", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Middleware(mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "POST /pay" {
+		t.Errorf("Expected span name 'POST /pay', got '%s'", span.Name())
+	}
+	if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected incoming trace ID, got %s", got)
+	}
+	if got := span.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("Expected remote parent span 00f067aa0ba902b7, got %s", got)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("Expected error status for a 500, got %s", span.Status().Code)
+	}
+}
+
+func TestRouteNamesSpanBehindOtherMiddleware(t *testing.T) {
+	recorder := useRecorder(t)
+
+	mux := http.NewServeMux()
+	mux.Handle("/users/{id}/balance", Route(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	Middleware(logging.Middleware(mux)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/alice/balance", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	if name := spans[0].Name(); name != "GET /users/{id}/balance" {
+		t.Errorf("Expected span name 'GET /users/{id}/balance', got '%s'", name)
+	}
+}
+
+func TestSetupFileExporter(t *testing.T) {
+	prevProvider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prevProvider) })
+
+	cfg := DefaultConfig("test-service")
+	cfg.Exporter = ExporterFile
+	cfg.File = filepath.Join(t.TempDir(), "traces.jsonl")
+
+	shutdown, err := Setup(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "work")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	data, err := os.ReadFile(cfg.File)
+	if err != nil {
+		t.Fatalf("Failed to read trace file: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 OTLP line, got %d", len(lines))
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Name string `json:"name"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(lines[0], &req); err != nil {
+		t.Fatalf("Failed to decode OTLP JSON: %v", err)
+	}
+	if len(req.ResourceSpans) != 1 || req.ResourceSpans[0].ScopeSpans[0].Spans[0].Name != "work" {
+		t.Errorf("Expected span 'work' in trace file, got %s", lines[0])
+	}
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	cfg := DefaultConfig("test-service")
+	cfg.Exporter = "zipkin"
+	if _, err := Setup(context.Background(), cfg); err == nil {
+		t.Error("Expected error for unknown exporter")
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("TRACE_EXPORTER", "otlp")
+	t.Setenv("TRACE_OTLP_ENDPOINT", "collector:4318")
+	t.Setenv("TRACE_SAMPLE_RATIO", "0.25")
+
+	cfg := DefaultConfig("test-service")
+	if err := cfg.LoadEnv(); err != nil {
+		t.Fatalf("LoadEnv failed: %v", err)
+	}
+	if cfg.Exporter != ExporterOTLP || cfg.Endpoint != "collector:4318" || cfg.SampleRatio != 0.25 {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	t.Setenv("TRACE_SAMPLE_RATIO", "half")
+	if err := cfg.LoadEnv(); err == nil {
+		t.Error("Expected error for invalid TRACE_SAMPLE_RATIO")
+	}
+}
@@ -0,0 +1,156 @@
+// Package workerpool runs a function over a stream of inputs on a fixed
+// number of goroutines, delivering the results in input order or as they
+// complete.
+package workerpool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Result is the outcome of one input. Index is the input's position in the
+// stream, counting from 0.
+type Result[In, Out any] struct {
+	Index  int
+	Input  In
+	Output Out
+	Err    error
+}
+
+// Pool calls a function on up to Workers inputs at once. Its fields may be
+// changed before the first call of Run or Map.
+type Pool[In, Out any] struct {
+	// Workers is how many inputs are processed at once; less than 1 means 1.
+	Workers int
+	// Ordered delivers results in input order. A slow input then holds back
+	// the results after it, which are buffered until it completes.
+	Ordered bool
+
+	fn func(context.Context, In) (Out, error)
+}
+
+// New returns an unordered Pool of workers goroutines calling fn.
+func New[In, Out any](workers int, fn func(context.Context, In) (Out, error)) *Pool[In, Out] {
+	return &Pool[In, Out]{Workers: workers, fn: fn}
+}
+
+type workerKey struct{}
+
+// WorkerID returns the number, from 1, of the worker whose fn was called
+// with ctx, or 0 if ctx doesn't come from a Pool.
+func WorkerID(ctx context.Context) int {
+	id, _ := ctx.Value(workerKey{}).(int)
+	return id
+}
+
+type job[In any] struct {
+	index int
+	input In
+}
+
+// Run processes inputs until the channel is closed and returns a channel of
+// their results, closed once every result has been delivered. An error of
+// fn is delivered in its Result and doesn't stop the others. When ctx is
+// done, Run stops taking inputs and closes the results early; callers that
+// stop reading must cancel ctx so the workers can exit.
+func (p *Pool[In, Out]) Run(ctx context.Context, inputs <-chan In) <-chan Result[In, Out] {
+	jobs := make(chan job[In])
+	go func() {
+		defer close(jobs)
+		for index := 0; ; index++ {
+			select {
+			case <-ctx.Done():
+				return
+			case input, ok := <-inputs:
+				if !ok {
+					return
+				}
+				select {
+				case jobs <- job[In]{index, input}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	completed := make(chan Result[In, Out])
+	var wg sync.WaitGroup
+	for id := 1; id <= max(p.Workers, 1); id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workerCtx := context.WithValue(ctx, workerKey{}, id)
+			for j := range jobs {
+				output, err := p.fn(workerCtx, j.input)
+				select {
+				case completed <- Result[In, Out]{Index: j.index, Input: j.input, Output: output, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(completed)
+	}()
+
+	if !p.Ordered {
+		return completed
+	}
+	results := make(chan Result[In, Out])
+	go reorder(ctx, completed, results)
+	return results
+}
+
+// reorder passes results from in to out in Index order.
+func reorder[In, Out any](ctx context.Context, in <-chan Result[In, Out], out chan<- Result[In, Out]) {
+	defer close(out)
+	pending := make(map[int]Result[In, Out])
+	next := 0
+	for r := range in {
+		pending[r.Index] = r
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+			delete(pending, next)
+			next++
+		}
+	}
+}
+
+// Map processes inputs and returns their outputs in input order. It stops
+// at the first error, returning it with the index of its input.
+func (p *Pool[In, Out]) Map(ctx context.Context, inputs []In) ([]Out, error) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan In, len(inputs))
+	for _, input := range inputs {
+		ch <- input
+	}
+	close(ch)
+
+	outputs := make([]Out, len(inputs))
+	received := 0
+	for r := range p.Run(runCtx, ch) {
+		if r.Err != nil {
+			return nil, fmt.Errorf("input %d: %w", r.Index, r.Err)
+		}
+		outputs[r.Index] = r.Output
+		received++
+	}
+	if received < len(inputs) {
+		return nil, ctx.Err()
+	}
+	return outputs, nil
+}
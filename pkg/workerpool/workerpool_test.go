@@ -0,0 +1,142 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func feed(n int) <-chan int {
+	inputs := make(chan int)
+	go func() {
+		defer close(inputs)
+		for i := 0; i < n; i++ {
+			inputs <- i
+		}
+	}()
+	return inputs
+}
+
+func TestRunOrdered(t *testing.T) {
+	// Later inputs finish first, so only reordering puts them back in line.
+	pool := New(4, func(ctx context.Context, x int) (int, error) {
+		time.Sleep(time.Duration(20-x) * time.Millisecond)
+		if id := WorkerID(ctx); id < 1 || id > 4 {
+			t.Errorf("Expected a worker ID from 1 to 4, got %d", id)
+		}
+		return x * x, nil
+	})
+	pool.Ordered = true
+
+	next := 0
+	for r := range pool.Run(context.Background(), feed(20)) {
+		if r.Index != next || r.Input != next || r.Output != next*next || r.Err != nil {
+			t.Fatalf("Expected result %d, got %+v", next, r)
+		}
+		next++
+	}
+	if next != 20 {
+		t.Errorf("Expected 20 results, got %d", next)
+	}
+}
+
+func TestRunUnorderedBoundsConcurrency(t *testing.T) {
+	var running, peak atomic.Int32
+	pool := New(3, func(ctx context.Context, x int) (int, error) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		return x, nil
+	})
+
+	seen := make(map[int]bool)
+	for r := range pool.Run(context.Background(), feed(30)) {
+		if r.Output != r.Input || seen[r.Index] {
+			t.Errorf("Unexpected result %+v", r)
+		}
+		seen[r.Index] = true
+	}
+	if len(seen) != 30 {
+		t.Errorf("Expected 30 results, got %d", len(seen))
+	}
+	if p := peak.Load(); p != 3 {
+		t.Errorf("Expected at most 3 inputs at once, got a peak of %d", p)
+	}
+}
+
+var errOdd = errors.New("odd input")
+
+func TestErrors(t *testing.T) {
+	pool := New(2, func(ctx context.Context, x int) (int, error) {
+		if x%2 == 1 {
+			return 0, errOdd
+		}
+		return x * 10, nil
+	})
+
+	failed := 0
+	for r := range pool.Run(context.Background(), feed(10)) {
+		if (r.Err != nil) != (r.Input%2 == 1) {
+			t.Errorf("Unexpected result %+v", r)
+		}
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed != 5 {
+		t.Errorf("Expected an error not to stop the others, got %d failures", failed)
+	}
+
+	if _, err := pool.Map(context.Background(), []int{0, 2, 3, 4}); !errors.Is(err, errOdd) {
+		t.Errorf("Expected Map to return errOdd, got %v", err)
+	}
+	outputs, err := pool.Map(context.Background(), []int{4, 0, 2})
+	if err != nil || len(outputs) != 3 || outputs[0] != 40 || outputs[1] != 0 || outputs[2] != 20 {
+		t.Errorf("Unexpected outputs %v, %v", outputs, err)
+	}
+}
+
+func TestRunStopsWhenContextDone(t *testing.T) {
+	pool := New(2, func(ctx context.Context, x int) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	pool.Ordered = true
+
+	// The inputs never end; cancelling must still close the results.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	inputs := make(chan int)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case inputs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		for range pool.Run(ctx, inputs) {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't close its results after the context was done")
+	}
+
+	if _, err := pool.Map(ctx, []int{1, 2, 3}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Map to fail with the context's error, got %v", err)
+	}
+}